@@ -0,0 +1,71 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/logging"
+)
+
+var (
+	accountUserID    uint64
+	accountStatus    string
+	accountReason    string
+	accountExpiresIn time.Duration
+)
+
+// accountStatusCmd changes status of a user account.
+var accountStatusCmd = &cobra.Command{
+	Use:   "account-status",
+	Short: "Changes a user account status",
+	Long: `Changes a user account status to one of active, suspended, locked or pending_deletion.
+Any status other than active immediately signs user out from all devices.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		logger := logging.NewLogger(logLevel, logDevelopment)
+		defer logger.Sync()
+
+		ctx = logging.WithLogger(ctx, logger)
+
+		// Status is cached for running frontends, which a memory cache of this process can't reach.
+		if cacheConfig.Backend == cache.BackendMemory {
+			return errors.New("account status requires a redis cache backend")
+		}
+		cache, err := cache.New(ctx, &cacheConfig)
+		if err != nil {
+			return err
+		}
+		defer cache.Close()
+
+		db := database.New(ctx, pgDSN())
+		defer db.Pool.Close()
+
+		if err := db.IsSchemaUpToDate(ctx); err != nil {
+			return err
+		}
+
+		var expiresAt time.Time
+		if accountExpiresIn > 0 {
+			expiresAt = time.Now().Add(accountExpiresIn)
+		}
+		return auth.SetAccountStatus(ctx, cache, db, accountUserID, auth.AccountStatus(accountStatus), accountReason, expiresAt)
+	},
+}
+
+func init() {
+	accountStatusCmd.Flags().Uint64Var(&accountUserID, "user-id", 0, "User id in database")
+	accountStatusCmd.Flags().StringVar(&accountStatus, "status", string(auth.StatusSuspended), "Account status: active, suspended, locked or pending_deletion")
+	accountStatusCmd.Flags().StringVar(&accountReason, "reason", "", "Reason of account status shown to user")
+	accountStatusCmd.Flags().DurationVar(&accountExpiresIn, "expires-in", 0, "Duration after which account becomes active again, 0 means never")
+	accountStatusCmd.MarkFlagRequired("user-id")
+
+	Cmd.AddCommand(accountStatusCmd)
+}
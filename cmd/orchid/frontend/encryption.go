@@ -0,0 +1,102 @@
+package frontend
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/logging"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+var rotateUserID uint64
+
+// withEncryptor runs fn with an Encryptor configured by flags.
+func withEncryptor(fn func(ctx context.Context, logger *zap.SugaredLogger, encryptor *upload.Encryptor) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logging.NewLogger(logLevel, logDevelopment)
+	defer logger.Sync()
+
+	ctx = logging.WithLogger(ctx, logger)
+
+	storage, err := storage.New(ctx, storageConfig)
+	if err != nil {
+		return err
+	}
+
+	db := database.New(ctx, pgDSN())
+	defer db.Pool.Close()
+
+	if err := db.IsSchemaUpToDate(ctx); err != nil {
+		return err
+	}
+
+	encryptor, err := upload.NewEncryptor(logger, db, storage, uploadConfig)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, logger, encryptor)
+}
+
+// rotateDataKeyCmd retires the active data key of a user.
+var rotateDataKeyCmd = &cobra.Command{
+	Use:   "rotate-data-key",
+	Short: "Rotates a user data key",
+	Long: `Retires the active data key of a user, new content of user is encrypted with a new data key.
+Existing content is readable with the retired key until reencrypt-objects re-encrypts it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withEncryptor(func(ctx context.Context, logger *zap.SugaredLogger, encryptor *upload.Encryptor) error {
+			return encryptor.RotateKey(ctx, rotateUserID)
+		})
+	},
+}
+
+// rewrapDataKeysCmd wraps all data keys with the active master key.
+var rewrapDataKeysCmd = &cobra.Command{
+	Use:   "rewrap-data-keys",
+	Short: "Rewraps data keys with the active master key",
+	Long: `Rewraps data keys wrapped by old master keys with the active master key, i.e. the first of --encryption-master-key-files.
+To rotate master key, put a new key file first followed by old ones, run it, then drop old key files.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withEncryptor(func(ctx context.Context, logger *zap.SugaredLogger, encryptor *upload.Encryptor) error {
+			n, err := encryptor.RewrapKeys(ctx)
+			if err != nil {
+				return err
+			}
+			logger.Infof("Rewrapped data keys: %d", n)
+			return nil
+		})
+	},
+}
+
+// reencryptObjectsCmd re-encrypts content in plaintext or encrypted with retired data keys.
+var reencryptObjectsCmd = &cobra.Command{
+	Use:   "reencrypt-objects",
+	Short: "Re-encrypts stored content with active data keys",
+	Long: `Re-encrypts content stored in plaintext or encrypted with retired data keys with active data keys of its owners.
+It encrypts content uploaded before encryption is enabled as well. It can run while frontend serves traffic.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withEncryptor(func(ctx context.Context, logger *zap.SugaredLogger, encryptor *upload.Encryptor) error {
+			n, err := encryptor.ReencryptObjects(ctx)
+			if err != nil {
+				return err
+			}
+			logger.Infof("Re-encrypted objects: %d", n)
+			return nil
+		})
+	},
+}
+
+func init() {
+	rotateDataKeyCmd.Flags().Uint64Var(&rotateUserID, "user-id", 0, "User id in database")
+	rotateDataKeyCmd.MarkFlagRequired("user-id")
+
+	Cmd.AddCommand(rotateDataKeyCmd)
+	Cmd.AddCommand(rewrapDataKeysCmd)
+	Cmd.AddCommand(reencryptObjectsCmd)
+}
@@ -13,10 +13,14 @@ import (
 	jprom "github.com/uber/jaeger-lib/metrics/prometheus"
 
 	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/apis/users"
 	"github.com/williamlsh/orchid/pkg/cache"
 	"github.com/williamlsh/orchid/pkg/database"
 	"github.com/williamlsh/orchid/pkg/email"
+	"github.com/williamlsh/orchid/pkg/jobs"
 	"github.com/williamlsh/orchid/pkg/logging"
+	"github.com/williamlsh/orchid/pkg/scanner"
 	"github.com/williamlsh/orchid/pkg/storage"
 	"github.com/williamlsh/orchid/pkg/tracing"
 	"github.com/williamlsh/orchid/services/frontend"
@@ -41,6 +45,15 @@ var (
 	emailConfig    email.ConfigOptions
 	frontendConfig frontend.ConfigOptions
 	storageConfig  storage.ConfigOptions
+	bucketConfig   string
+	lifecycleEvery time.Duration
+	jobsLease      time.Duration
+	usersConfig    users.ConfigOptions
+	uploadConfig   upload.ConfigOptions
+	scannerConfig  scanner.ConfigOptions
+
+	avatarUpload     upload.PurposeOptions
+	attachmentUpload upload.PurposeOptions
 )
 
 // Cmd runs frontend service.
@@ -49,12 +62,15 @@ var Cmd = &cobra.Command{
 	Short: "Starts Frontend service",
 	Long:  `Starts Frontend service.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		dsn := fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=%s sslmode=%s pool_max_conns=%d",
-			pgUser, pgPass, pgHost, pgPort, pgDbname, pgSslmode, pgMaxConn)
-
 		frontendConfig.FrontendHostPort = net.JoinHostPort(frontendHost, strconv.Itoa(frontendPort))
 		frontendConfig.AuthSecrets = authSecrets
 		frontendConfig.Email = emailConfig
+		frontendConfig.Users = usersConfig
+		uploadConfig.Purposes = map[string]upload.PurposeOptions{
+			upload.PurposeAvatar:     avatarUpload,
+			upload.PurposeAttachment: attachmentUpload,
+		}
+		frontendConfig.Upload = uploadConfig
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -64,12 +80,18 @@ var Cmd = &cobra.Command{
 
 		ctx = logging.WithLogger(ctx, logger)
 
-		cache := cache.New(ctx, &cacheConfig)
-		defer cache.Client.Close()
+		appCache, err := cache.Open(ctx, &cacheConfig)
+		if err != nil {
+			return err
+		}
+		defer appCache.Close()
 
-		storage := storage.New(ctx, storageConfig)
+		objects, err := storage.New(ctx, storageConfig)
+		if err != nil {
+			return err
+		}
 
-		db := database.New(ctx, dsn)
+		db := database.New(ctx, pgDSN())
 		defer db.Pool.Close()
 
 		if err := db.Migrate(ctx); err != nil {
@@ -79,18 +101,97 @@ var Cmd = &cobra.Command{
 			return err
 		}
 
+		// Buckets with object lock have to be created by configuring them.
+		if bucketConfig != "" {
+			configs, err := storage.LoadBucketConfigs(bucketConfig)
+			if err != nil {
+				return err
+			}
+			if err := objects.ConfigureBuckets(ctx, configs...); err != nil {
+				return err
+			}
+		}
+		if err := objects.PrepareBuckets(ctx, uploadConfig.Bucket, usersConfig.ExportBucket); err != nil {
+			return err
+		}
+		if local, ok := objects.(*storage.Local); ok {
+			go jobs.Every(ctx, "apply-storage-lifecycle", lifecycleEvery, local.ApplyLifecycle)
+		}
+
+		encryptor, err := upload.NewEncryptor(logger, db, objects, uploadConfig)
+		if err != nil {
+			return err
+		}
+
+		// Jobs which would conflict across instances run only on the elected leader,
+		// who is elected before jobs start since they run immediately.
+		election := cache.NewElection(appCache, "frontend-jobs", jobsLease)
+		if err := election.Campaign(ctx); err != nil {
+			logger.Errorf("could not campaign for leader of jobs: %v", err)
+		}
+		go election.Run(ctx)
+
+		purger := users.NewPurger(logger, db, objects, usersConfig)
+		go jobs.Every(ctx, "purge-deregistered-users", usersConfig.PurgeInterval, jobs.WhenLeading(election, purger.Purge))
+
+		janitor := upload.NewJanitor(logger, db, objects, uploadConfig)
+		go jobs.Every(ctx, "abort-stale-multipart-uploads", uploadConfig.JanitorInterval, jobs.WhenLeading(election, janitor.AbortStaleUploads))
+
+		collector := upload.NewCollector(logger, db, objects, uploadConfig)
+		go jobs.Every(ctx, "collect-unreferenced-blobs", uploadConfig.BlobCollectInterval, jobs.WhenLeading(election, collector.Collect))
+
+		trashPurger := upload.NewTrashPurger(logger, db, objects, uploadConfig)
+		go jobs.Every(ctx, "purge-trashed-files", uploadConfig.Trash.PurgeInterval, jobs.WhenLeading(election, trashPurger.Purge))
+
+		contentScanner, err := scanner.New(scannerConfig)
+		if err != nil {
+			return err
+		}
+		scanWorker := upload.NewScanWorker(logger, db, encryptor, contentScanner, uploadConfig)
+		go jobs.Every(ctx, "scan-uploaded-files", uploadConfig.Scan.Interval, scanWorker.Scan)
+
+		imageProcessor := upload.NewImageProcessor(logger, db, objects, encryptor, uploadConfig)
+		go jobs.Every(ctx, "process-uploaded-images", uploadConfig.Images.ProcessInterval, imageProcessor.Process)
+
 		tracer := tracing.Init("frontend", jprom.New().Namespace(metrics.NSOptions{Name: "frontend", Tags: nil}), logger)
-		server := frontend.NewServer(logger, tracer, cache, db, storage, frontendConfig)
+		server := frontend.NewServer(logger, tracer, appCache, db, objects, encryptor, frontendConfig)
 		return server.Run()
 	},
 }
 
+// pgDSN returns postgreSQL database data source name from flags.
+func pgDSN() string {
+	return fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=%s sslmode=%s pool_max_conns=%d",
+		pgUser, pgPass, pgHost, pgPort, pgDbname, pgSslmode, pgMaxConn)
+}
+
 func init() {
 	Cmd.PersistentFlags().StringVar(&frontendHost, "frontend-service-host", "0.0.0.0", "Frontend service host")
 	Cmd.PersistentFlags().IntVar(&frontendPort, "frontend-service-port", 8080, "Frontend service port")
 
-	Cmd.PersistentFlags().StringVar(&cacheConfig.Addr, "redis-addr", "localhost:6379", "Redis server address")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.Backend, "cache-backend", cache.BackendRedis, "Cache backend: redis, or memory which only fits a single frontend instance")
+	Cmd.PersistentFlags().IntVar(&cacheConfig.MaxEntries, "cache-max-entries", 0, "Maximum number of keys of memory cache backend, 0 means no limit")
+	Cmd.PersistentFlags().StringSliceVar(&cacheConfig.Addrs, "redis-addr", []string{"localhost:6379"}, "Redis server address, or addresses of sentinels or cluster nodes")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.MasterName, "redis-master-name", "", "Name of redis master monitored by sentinels at --redis-addr, it enables sentinel mode")
+	Cmd.PersistentFlags().BoolVar(&cacheConfig.Cluster, "redis-cluster", false, "Connect to a redis cluster of nodes at --redis-addr")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.Username, "redis-username", "", "Redis ACL username, empty for the default user")
 	Cmd.PersistentFlags().StringVar(&cacheConfig.Passwd, "redis-passwd", "", "Redis server password")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.SentinelPasswd, "redis-sentinel-passwd", "", "Redis sentinel password")
+	Cmd.PersistentFlags().IntVar(&cacheConfig.DB, "redis-db", 0, "Redis database index, cluster supports 0 only")
+	Cmd.PersistentFlags().BoolVar(&cacheConfig.TLS.Enabled, "redis-tls", false, "Connect to redis over TLS")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.TLS.CAFile, "redis-tls-ca-file", "", "PEM file of CA certificates verifying redis, system roots if empty")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.TLS.CertFile, "redis-tls-cert-file", "", "PEM file of client certificate presented to redis")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.TLS.KeyFile, "redis-tls-key-file", "", "PEM file of client certificate key")
+	Cmd.PersistentFlags().StringVar(&cacheConfig.TLS.ServerName, "redis-tls-server-name", "", "Server name verified in redis certificate, host of address if empty")
+	Cmd.PersistentFlags().BoolVar(&cacheConfig.TLS.InsecureSkipVerify, "redis-tls-insecure-skip-verify", false, "Skip verifying redis certificate, for testing only")
+	Cmd.PersistentFlags().IntVar(&cacheConfig.PoolSize, "redis-pool-size", 0, "Maximum number of connections per redis node, 0 means 10 per CPU")
+	Cmd.PersistentFlags().IntVar(&cacheConfig.MinIdleConns, "redis-min-idle-conns", 0, "Minimum number of idle connections per redis node")
+	Cmd.PersistentFlags().IntVar(&cacheConfig.MaxRetries, "redis-max-retries", 5, "Maximum number of retries of a failed redis command")
+	Cmd.PersistentFlags().DurationVar(&cacheConfig.DialTimeout, "redis-dial-timeout", 5*time.Second, "Timeout of connecting to redis")
+	Cmd.PersistentFlags().DurationVar(&cacheConfig.ReadTimeout, "redis-read-timeout", 3*time.Second, "Timeout of reading a redis reply")
+	Cmd.PersistentFlags().DurationVar(&cacheConfig.WriteTimeout, "redis-write-timeout", 3*time.Second, "Timeout of writing a redis command")
+	Cmd.PersistentFlags().DurationVar(&cacheConfig.PoolTimeout, "redis-pool-timeout", 4*time.Second, "Timeout of waiting for a redis connection if all are busy")
+	Cmd.PersistentFlags().DurationVar(&cacheConfig.IdleTimeout, "redis-idle-timeout", 5*time.Minute, "Duration after which idle redis connections are closed")
 
 	Cmd.PersistentFlags().StringVar(&emailConfig.From, "email-from", "abc@gmail.com", "Email from address")
 	Cmd.PersistentFlags().StringVar(&emailConfig.Host, "smtp-server-host", "", "Smtp server host")
@@ -100,6 +201,48 @@ func init() {
 
 	Cmd.PersistentFlags().StringVar(&authSecrets.AccessSecret, "auth-access-secret", "123abc", "Authentication access secret")
 	Cmd.PersistentFlags().StringVar(&authSecrets.RefreshSecret, "auth-refresh-secret", "123abc", "Authentication refresh secret")
+	Cmd.PersistentFlags().StringVar(&authSecrets.VerificationSecret, "auth-verification-secret", "123abc", "Secret keying hashes of cached verification codes")
+	Cmd.PersistentFlags().IntVar(&authSecrets.VerificationMaxAttempts, "auth-verification-max-attempts", 5, "Number of sign in attempts after which a verification code is invalid, 0 means unlimited")
+
+	Cmd.PersistentFlags().StringVar(&usersConfig.HashIDSalt, "hashid-salt", "this my salt.", "Salt of hashids addressing users")
+	Cmd.PersistentFlags().IntVar(&usersConfig.HashIDMinLength, "hashid-min-length", 30, "Minimum length of hashids addressing users")
+	Cmd.PersistentFlags().BoolVar(&usersConfig.AnonymousPublicProfile, "public-profile-anonymous", false, "Allow anonymous access to users' public profiles")
+	Cmd.PersistentFlags().DurationVar(&usersConfig.PurgeGracePeriod, "deregistered-user-grace-period", 30*24*time.Hour, "Grace period before a deregistered user is hard deleted")
+	Cmd.PersistentFlags().DurationVar(&usersConfig.PurgeInterval, "deregistered-user-purge-interval", time.Hour, "Interval of purging deregistered users")
+
+	Cmd.PersistentFlags().StringVar(&usersConfig.ExportBucket, "export-bucket", "exports", "Bucket of user data export archives")
+	Cmd.PersistentFlags().DurationVar(&usersConfig.ExportTimeout, "export-timeout", time.Hour, "Timeout of assembling and emailing a user data export")
+
+	Cmd.PersistentFlags().StringVar(&uploadConfig.Bucket, "upload-bucket", "all", "Bucket of uploaded objects")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.PolicyExpiration, "upload-policy-expiration", 5*time.Minute, "Expiration of presigned upload post policies")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.DownloadURLExpiration, "download-url-expiration", 5*time.Minute, "Expiration of presigned download urls")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.ShareMaxExpiration, "share-max-expiration", 30*24*time.Hour, "Longest expiration of file share links")
+	Cmd.PersistentFlags().Int64Var(&uploadConfig.PartSize, "upload-part-size", 16<<20, "Part size in bytes of multipart upload sessions, at least 5MiB")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.SessionExpiration, "upload-session-expiration", 24*time.Hour, "Expiration of multipart upload sessions")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.JanitorInterval, "upload-janitor-interval", time.Hour, "Interval of aborting stale multipart uploads")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.BlobGracePeriod, "upload-blob-grace-period", 24*time.Hour, "How long unreferenced blobs are kept before deletion")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.BlobCollectInterval, "upload-blob-collect-interval", time.Hour, "Interval of deleting unreferenced blobs")
+	Cmd.PersistentFlags().Int64Var(&uploadConfig.Quota.MaxBytes, "upload-quota-max-bytes", 1<<30, "Default maximum total size in bytes of files a user uploads, 0 means unlimited")
+	Cmd.PersistentFlags().Int64Var(&uploadConfig.Quota.MaxObjects, "upload-quota-max-objects", 10000, "Default maximum number of files a user uploads, 0 means unlimited")
+	Cmd.PersistentFlags().BoolVar(&uploadConfig.Proxy, "upload-proxy", false, "Serve streaming uploads to /api/upload and downloads from /api/files/{id}/content, for storage unreachable by clients")
+	Cmd.PersistentFlags().StringVar(&uploadConfig.Notifications.Token, "storage-notification-token", "", "Token authenticating bucket notifications posted by storage to /internal/storage/events, empty disables them")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.Trash.Retention, "trash-retention", 30*24*time.Hour, "How long deleted files are kept in trash before they are purged")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.Trash.PurgeInterval, "trash-purge-interval", time.Hour, "Interval of purging expired files in trash")
+	Cmd.PersistentFlags().IntSliceVar(&uploadConfig.Images.ThumbnailSizes, "image-thumbnail-sizes", []int{128, 512}, "Sizes in pixels of squares thumbnails of uploaded images fit in")
+	Cmd.PersistentFlags().Int64Var(&uploadConfig.Images.MaxPixels, "image-max-pixels", 50_000_000, "Largest number of pixels of a processed image")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.Images.ProcessInterval, "image-process-interval", 10*time.Second, "Interval of processing uploaded images")
+	Cmd.PersistentFlags().IntVar(&uploadConfig.Images.BatchSize, "image-process-batch-size", 10, "Number of uploaded images processed at a time")
+	Cmd.PersistentFlags().DurationVar(&uploadConfig.Scan.Interval, "scan-interval", 10*time.Second, "Interval of scanning uploaded files")
+	Cmd.PersistentFlags().IntVar(&uploadConfig.Scan.BatchSize, "scan-batch-size", 10, "Number of uploaded files scanned at a time")
+	Cmd.PersistentFlags().StringSliceVar(&uploadConfig.Encryption.MasterKeyFiles, "encryption-master-key-files", nil, "Files of 32 bytes hex or base64 encoded master keys encrypting stored content, the first is active, none disables encryption")
+	Cmd.PersistentFlags().StringVar(&uploadConfig.Encryption.ContentURL, "encryption-content-url", "http://127.0.0.1:8080/content", "Public url under which frontend serves decrypted content")
+	Cmd.PersistentFlags().StringVar(&scannerConfig.Backend, "scanner", scanner.BackendNone, "Content scanner backend: none or clamd")
+	Cmd.PersistentFlags().StringVar(&scannerConfig.ClamdAddress, "clamd-address", "tcp://127.0.0.1:3310", "Address of clamd, tcp://host:port or unix:///path/to/socket")
+	Cmd.PersistentFlags().DurationVar(&scannerConfig.Timeout, "scan-timeout", 5*time.Minute, "Timeout of scanning a single file")
+	Cmd.PersistentFlags().Int64Var(&avatarUpload.MaxSize, "upload-avatar-max-size", 2<<20, "Maximum size in bytes of uploaded avatars")
+	Cmd.PersistentFlags().StringSliceVar(&avatarUpload.ContentTypes, "upload-avatar-content-types", []string{"image/jpeg", "image/png", "image/gif", "image/webp"}, "Allowed MIME types of uploaded avatars")
+	Cmd.PersistentFlags().Int64Var(&attachmentUpload.MaxSize, "upload-attachment-max-size", 25<<20, "Maximum size in bytes of uploaded attachments")
+	Cmd.PersistentFlags().StringSliceVar(&attachmentUpload.ContentTypes, "upload-attachment-content-types", nil, "Allowed MIME types of uploaded attachments, any type if empty")
 
 	Cmd.PersistentFlags().StringVar(&pgUser, "pg-user", "", "postgreSQL database username")
 	Cmd.PersistentFlags().StringVar(&pgPass, "pg-passwd", "", "postgreSQL database password")
@@ -112,10 +255,17 @@ func init() {
 	Cmd.PersistentFlags().StringVar(&logLevel, "log-level", "error", "Log level")
 	Cmd.PersistentFlags().BoolVar(&logDevelopment, "log-development", false, "Log development")
 
+	Cmd.PersistentFlags().StringVar(&storageConfig.Backend, "storage-backend", storage.BackendMinio, "Storage backend: minio, filesystem or memory")
+	Cmd.PersistentFlags().StringVar(&storageConfig.Root, "storage-root", "data", "Directory of filesystem storage backend")
+	Cmd.PersistentFlags().StringVar(&storageConfig.PublicURL, "storage-public-url", "http://127.0.0.1:8080/storage", "Public url under which frontend serves presigned urls of filesystem and memory storage backends")
+	Cmd.PersistentFlags().StringVar(&storageConfig.SigningSecret, "storage-signing-secret", "", "Secret signing presigned urls of filesystem and memory storage backends")
 	Cmd.PersistentFlags().StringVar(&storageConfig.Endpoint, "minio-endpoint", "127.0.0.1:9000", "Minio endpoint")
 	Cmd.PersistentFlags().StringVar(&storageConfig.ID, "minio-id", "", "Minio ID")
 	Cmd.PersistentFlags().StringVar(&storageConfig.Secret, "minio-secret", "", "Minio secret")
 	Cmd.PersistentFlags().BoolVar(&storageConfig.Secure, "minio-enable-secure", false, "Enable minio secure connection")
+	Cmd.PersistentFlags().StringVar(&bucketConfig, "storage-bucket-config", "", "JSON file of bucket configurations: object lock, default retention and lifecycle rules")
+	Cmd.PersistentFlags().DurationVar(&lifecycleEvery, "storage-lifecycle-interval", time.Hour, "Interval of applying lifecycle rules of filesystem and memory storage backends")
+	Cmd.PersistentFlags().DurationVar(&jobsLease, "jobs-leader-lease", 30*time.Second, "Lease of leadership of instances running cleanup jobs, a leader failing to renew it is replaced after it expires")
 
 	rand.Seed(int64(time.Now().Nanosecond()))
 }
@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/logging"
+	"github.com/williamlsh/orchid/pkg/storage"
+)
+
+var (
+	quotaUserID     uint64
+	quotaMaxBytes   int64
+	quotaMaxObjects int64
+	quotaReset      bool
+)
+
+// storageQuotaCmd overrides default storage quota of a user.
+var storageQuotaCmd = &cobra.Command{
+	Use:   "storage-quota",
+	Short: "Overrides a user storage quota",
+	Long: `Overrides default storage quota of a user with maximum bytes and objects, 0 means unlimited.
+With --reset, user falls back to default quota.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		logger := logging.NewLogger(logLevel, logDevelopment)
+		defer logger.Sync()
+
+		ctx = logging.WithLogger(ctx, logger)
+
+		db := database.New(ctx, pgDSN())
+		defer db.Pool.Close()
+
+		if err := db.IsSchemaUpToDate(ctx); err != nil {
+			return err
+		}
+
+		var quota *upload.Quota
+		if !quotaReset {
+			quota = &upload.Quota{MaxBytes: quotaMaxBytes, MaxObjects: quotaMaxObjects}
+		}
+		return upload.SetQuota(ctx, db, quotaUserID, quota)
+	},
+}
+
+// reconcileUsageCmd recomputes storage usage of all users.
+var reconcileUsageCmd = &cobra.Command{
+	Use:   "reconcile-usage",
+	Short: "Recomputes users storage usage",
+	Long: `Recomputes storage usage of all users by listing objects in upload bucket.
+Uploads completing while it runs may be miscounted, so run it when traffic is low.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		logger := logging.NewLogger(logLevel, logDevelopment)
+		defer logger.Sync()
+
+		ctx = logging.WithLogger(ctx, logger)
+
+		storage, err := storage.New(ctx, storageConfig)
+		if err != nil {
+			return err
+		}
+
+		db := database.New(ctx, pgDSN())
+		defer db.Pool.Close()
+
+		if err := db.IsSchemaUpToDate(ctx); err != nil {
+			return err
+		}
+
+		return upload.ReconcileUsage(ctx, logger, db, storage, uploadConfig.Bucket)
+	},
+}
+
+func init() {
+	storageQuotaCmd.Flags().Uint64Var(&quotaUserID, "user-id", 0, "User id in database")
+	storageQuotaCmd.Flags().Int64Var(&quotaMaxBytes, "max-bytes", 0, "Maximum total size in bytes of uploaded files, 0 means unlimited")
+	storageQuotaCmd.Flags().Int64Var(&quotaMaxObjects, "max-objects", 0, "Maximum number of uploaded files, 0 means unlimited")
+	storageQuotaCmd.Flags().BoolVar(&quotaReset, "reset", false, "Restore default quota of user")
+	storageQuotaCmd.MarkFlagRequired("user-id")
+
+	Cmd.AddCommand(storageQuotaCmd)
+	Cmd.AddCommand(reconcileUsageCmd)
+}
@@ -3,11 +3,9 @@ package auth
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"net/http"
 	"strings"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4"
 	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
 	"github.com/williamlsh/orchid/pkg/cache"
@@ -45,7 +43,7 @@ func newAccount(
 
 func (a account) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
-		Email string
+		Email, Challenge string
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
@@ -56,40 +54,32 @@ func (a account) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidEmail, nil)
 		return
 	}
+	if !isChallengeValid(reqBody.Challenge) {
+		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidChallenge, nil)
+		return
+	}
 
 	// Email letters should be lower case.
 	lowercaseEmail := strings.ToLower(reqBody.Email)
 	// If failed to update email, it must be an existing email in users database.
-	if err := a.updateUserEmail(r.Context(), a.amw.GetUserID(), lowercaseEmail); err != nil {
+	if err := a.updateUserEmail(r.Context(), a.amw.GetUserID(r), lowercaseEmail); err != nil {
 		a.logger.Errorf("failed to update user email: %v", err)
 
 		httpx.FinalizeResponse(w, httpx.ErrAuthEmailAlreadyInUse, nil)
 		return
 	}
 
-	// Evict old code before cache new if any.
-	if err := evictUserVerificationCode(r.Context(), a.cache, lowercaseEmail); err != nil && !errors.Is(err, redis.Nil) {
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
-		return
-	}
-
 	code := randString(verificationCodeLength, letterBytes)
-	if err := cacheUserEmail(r.Context(), a.cache, false, code, lowercaseEmail, verificationCodeExpiration); err != nil {
+	if err := cacheVerification(r.Context(), a.cache, a.secrets, lowercaseEmail, code, operationLogIn, reqBody.Challenge); err != nil {
 		a.logger.Errorf("could not cache verification code: %v", err)
 
 		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 		return
 	}
-	a.logger.Debugf("Send email with isNewUser=%t token=%s", false, code)
-
-	// Mark operation after caching new code.
-	if err := markUserOperation(r.Context(), a.cache, lowercaseEmail, code, verificationCodeExpiration); err != nil {
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
-		return
-	}
+	a.logger.Debugf("Send email with isNewUser=%t", false)
 
 	// TODO: add a new user operation: update email, and also add a new email verification mail template. Currently use signin email template.
-	subject, content, err := composeEmail(false, code)
+	subject, content, err := composeEmail(false, code, lowercaseEmail)
 	if err != nil {
 		a.logger.Errorf("could not compose email: %v", err)
 
@@ -19,7 +19,7 @@ func Group(
 	secrets ConfigOptions,
 	r *mux.Router,
 ) {
-	r.Handle("/signup", newSignUpper(logger, cache, db, email)).
+	r.Handle("/signup", newSignUpper(logger, cache, db, email, secrets)).
 		Methods(http.MethodPost).
 		Headers("Content-Type", "application/json")
 
@@ -30,7 +30,7 @@ func Group(
 	r.Handle("/{operation:signout|deregister}", newSignOuter(logger, db, cache, secrets)).
 		Methods(http.MethodGet)
 
-	r.Handle("/token/refresh", newRefresher(logger, cache, secrets)).
+	r.Handle("/token/refresh", newRefresher(logger, cache, db, secrets)).
 		Methods(http.MethodPost).
 		Headers("Content-Type", "application/json")
 
@@ -3,4 +3,8 @@ package auth
 // ConfigOptions provides all config options auth needs.
 type ConfigOptions struct {
 	AccessSecret, RefreshSecret string
+	// VerificationSecret keys hashes of cached verification codes.
+	VerificationSecret string
+	// VerificationMaxAttempts is number of attempts after which a verification code is invalid, 0 means unlimited.
+	VerificationMaxAttempts int
 }
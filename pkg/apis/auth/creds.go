@@ -98,14 +98,20 @@ func cacheCredential(ctx context.Context, cache cache.Cache, userid uint64, cred
 	uid := strconv.Itoa(int(userid))
 	now := time.Now()
 
-	if err := cache.Client.Set(ctx, creds.AccessUUID, uid, accessExpiredAt.Sub(now)).Err(); err != nil {
+	if err := cache.Set(ctx, creds.AccessUUID, uid, accessExpiredAt.Sub(now)); err != nil {
 		return err
 	}
-	if err := cache.Client.Set(ctx, creds.RefreshUUID, uid, refreshExpiredAt.Sub(now)).Err(); err != nil {
+	if err := cache.Set(ctx, creds.RefreshUUID, uid, refreshExpiredAt.Sub(now)); err != nil {
 		return err
 	}
 
-	return nil
+	// Index credentials by user so that all of them can be revoked at once.
+	// The index lives as long as the latest refresh credential, stale members are harmless.
+	key := userCredentialsCacheKey(userid)
+	if err := cache.SAdd(ctx, key, creds.AccessUUID, creds.RefreshUUID); err != nil {
+		return err
+	}
+	return cache.Expire(ctx, key, refreshExpiredAt.Sub(now))
 }
 
 func tokenValid(token *jwt.Token) bool {
@@ -146,7 +152,7 @@ func readIDSInfoFromClaims(claims jwt.MapClaims, uuidKind string) (*IDs, error)
 
 func deleteCredsFromCache(ctx context.Context, cache cache.Cache, uuids []string) error {
 	for _, id := range uuids {
-		deleted, err := cache.Client.Del(ctx, id).Result()
+		deleted, err := cache.Del(ctx, id)
 		if err != nil {
 			return err
 		}
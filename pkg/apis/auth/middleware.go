@@ -3,7 +3,7 @@ package auth
 import (
 	"context"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/golang-jwt/jwt/v4/request"
@@ -15,17 +15,19 @@ import (
 
 // AuthenticationMiddleware is a general JWT token validation,
 // it also checks users in cache system.
+// It's shared by all requests of a router, so user of a request is kept in request context.
 type AuthenticationMiddleware struct {
-	once    sync.Once
 	logger  *zap.SugaredLogger
 	cache   cache.Cache
 	secrets ConfigOptions
-
-	AccessUUID    string
-	ForgeedUserID uint64 // ForgeedUserID is a forged id responding to frontend
-	UserID        uint64
 }
 
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+// userIDKey points to the value in the context where real id of authenticated user is stored.
+const userIDKey = contextKey("user_id")
+
 // New returns a new AuthenticationMiddleware
 func New(logger *zap.SugaredLogger, cache cache.Cache, secrets ConfigOptions) *AuthenticationMiddleware {
 	return &AuthenticationMiddleware{
@@ -80,47 +82,52 @@ func (amw *AuthenticationMiddleware) MiddlewareMustAuthenticate(next http.Handle
 			return
 		}
 
-		exists, err := amw.isUserIDExistInCache(r.Context(), ids.UUID)
+		exists, state, err := amw.checkUserInCache(r.Context(), ids)
 		if err != nil {
 			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 			return
 		}
+		// A blocked account's credentials are revoked, respond with its status rather than unauthorized.
+		if state != nil && state.effective(time.Now()) != StatusActive {
+			amw.logger.Debugf("Blocked user, access_uuid=%s forged_userid=%d status=%s", ids.UUID, ids.UserID, state.Status)
+
+			httpx.FinalizeResponse(w, state.Status.code(), state)
+			return
+		}
 		if !exists {
 			amw.logger.Debugf("Invalid user, access_uuid=%s forged_userid=%d", ids.UUID, ids.UserID)
 
 			httpx.FinalizeResponse(w, httpx.ErrUnauthorized, nil)
 			return
 		}
+		realID, err := confuse.DecodeID(ids.UserID)
+		if err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrUnauthorized, nil)
+			return
+		}
 		amw.logger.Debugf("Valid user, access_uuid=%s forged_userid=%d", ids.UUID, ids.UserID)
 
-		amw.AccessUUID = ids.UUID
-		amw.ForgeedUserID = ids.UserID
-
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey, realID)))
 	})
 }
 
-// GetUserID returns a parsed and existing user's real id in databae.
-func (amw *AuthenticationMiddleware) GetUserID() uint64 {
-	amw.once.Do(func() {
-		realID, err := confuse.DecodeID(amw.ForgeedUserID)
-		if err != nil {
-			panic(err)
-		}
-		amw.UserID = realID
-	})
-	return amw.UserID
+// GetUserID returns real id in database of user authenticated for r, or zero if r isn't authenticated.
+// Real ids start from one, so zero never matches a user.
+func (amw *AuthenticationMiddleware) GetUserID(r *http.Request) uint64 {
+	userID, _ := r.Context().Value(userIDKey).(uint64)
+	return userID
 }
 
-// isUserExistInCache checks whether user id exists in cache.
+// checkUserInCache checks whether user's access uuid exists in cache and whether user's account is blocked.
 // Any user's id that is not in cache system is not authenticated and valid.
-func (amw *AuthenticationMiddleware) isUserIDExistInCache(ctx context.Context, uuid string) (bool, error) {
-	n, err := amw.cache.Client.Exists(ctx, uuid).Result()
+func (amw *AuthenticationMiddleware) checkUserInCache(ctx context.Context, ids *IDs) (bool, *accountState, error) {
+	exists, err := amw.cache.Exists(ctx, ids.UUID)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
-	if n == 0 {
-		return false, nil
+	state, err := getCachedAccountState(amw.cache.Get(ctx, accountStatusCacheKey(ids.UserID)))
+	if err != nil {
+		return false, nil, err
 	}
-	return true, nil
+	return exists > 0, state, nil
 }
@@ -36,7 +36,7 @@ func TestMiddleware(t *testing.T) {
 		AccessSecret:  "abc",
 		RefreshSecret: "xyz",
 	}
-	cache := cache.Cache{Client: client}
+	cache := &cache.Redis{Client: client}
 	amw := New(
 		zap.NewExample().Sugar(),
 		cache,
@@ -70,7 +70,9 @@ func TestMiddleware(t *testing.T) {
 
 		r := mux.NewRouter()
 		r.Use(amw.MiddlewareMustAuthenticate)
+		var userID uint64
 		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			userID = amw.GetUserID(r)
 			httpx.FinalizeResponse(w, httpx.Success, nil)
 		})
 		r.ServeHTTP(rr, req)
@@ -88,8 +90,8 @@ func TestMiddleware(t *testing.T) {
 			t.Errorf("returned: %s, want: %s", response.Code.Msg(), httpx.Success.Msg())
 		}
 
-		if amw.GetUserID() != 1 {
-			t.Fatalf("returned: %d, want: %d", amw.GetUserID(), 1)
+		if userID != 1 {
+			t.Fatalf("returned: %d, want: %d", userID, 1)
 		}
 	})
 
@@ -106,7 +108,9 @@ func TestMiddleware(t *testing.T) {
 
 		r := mux.NewRouter()
 		r.Use(amw.MiddlewareOptionallyAuthenticate)
+		var userID uint64
 		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			userID = amw.GetUserID(r)
 			httpx.FinalizeResponse(w, httpx.Success, nil)
 		})
 		r.ServeHTTP(rr, req)
@@ -124,8 +128,8 @@ func TestMiddleware(t *testing.T) {
 			t.Errorf("returned: %s, want: %s", response.Code.Msg(), httpx.Success.Msg())
 		}
 
-		if amw.GetUserID() != 1 {
-			t.Fatalf("returned: %d, want: %d", amw.GetUserID(), 1)
+		if userID != 1 {
+			t.Fatalf("returned: %d, want: %d", userID, 1)
 		}
 	})
 
@@ -160,4 +164,52 @@ func TestMiddleware(t *testing.T) {
 			t.Errorf("returned: %s, want: %s", response.Code.Msg(), httpx.Success.Msg())
 		}
 	})
+	t.Run("Users of a router", func(t *testing.T) {
+		t.Parallel()
+
+		// Another user authenticates through the same middleware.
+		otherForgedUserID, err := confuse.EncodeID(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherCreds, err := createCreds(otherForgedUserID, secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cacheCredential(context.Background(), cache, otherForgedUserID, otherCreds); err != nil {
+			t.Fatal(err)
+		}
+
+		r := mux.NewRouter()
+		r.Use(amw.MiddlewareMustAuthenticate)
+		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			httpx.FinalizeResponse(w, httpx.Success, amw.GetUserID(r))
+		})
+
+		for _, tc := range []struct {
+			token  string
+			userID uint64
+		}{
+			{creds.AccessToken, 1},
+			{otherCreds.AccessToken, 2},
+			{creds.AccessToken, 1},
+		} {
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tc.token))
+
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			var response httpx.FinalResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if userID, ok := response.Data.(float64); !ok || uint64(userID) != tc.userID {
+				t.Fatalf("returned: %v, want: %d", response.Data, tc.userID)
+			}
+		}
+	})
 }
@@ -4,27 +4,32 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/golang-jwt/jwt/v4/request"
+	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
 	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
 	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
 )
 
 // refresher implements a token refresh handler.
 type refresher struct {
 	logger  *zap.SugaredLogger
 	cache   cache.Cache
+	db      database.Database
 	secrets ConfigOptions
 }
 
 // newRefresher returns a new Refresher.
-func newRefresher(logger *zap.SugaredLogger, cache cache.Cache, secrets ConfigOptions) refresher {
+func newRefresher(logger *zap.SugaredLogger, cache cache.Cache, db database.Database, secrets ConfigOptions) refresher {
 	return refresher{
 		logger,
 		cache,
+		db,
 		secrets,
 	}
 }
@@ -53,6 +58,24 @@ func (rf refresher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A blocked account can't refresh its credentials.
+	realUserID, err := confuse.DecodeID(refreshIDs.UserID)
+	if err != nil {
+		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidToken, nil)
+		return
+	}
+	state, err := getAccountState(r.Context(), rf.db, realUserID)
+	if err != nil {
+		rf.logger.Errorf("failed to get account state: %v", err)
+
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+		return
+	}
+	if state.effective(time.Now()) != StatusActive {
+		httpx.FinalizeResponse(w, state.Status.code(), state)
+		return
+	}
+
 	// Delete old creds from cache, if error occurs, creds may not exist in cache.
 	accessUUID := strings.Split(refreshIDs.UUID, "++")[0]
 	if err := deleteCredsFromCache(r.Context(), rf.cache, []string{accessUUID, refreshIDs.UUID}); err != nil {
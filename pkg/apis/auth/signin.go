@@ -6,8 +6,8 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4"
 	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
 	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
@@ -44,8 +44,9 @@ func newSignInner(
 
 func (s signInner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// The register operation submits alias in request body while login operation doesn't.
+	// Verifier is required if and only if code is bound to a challenge on sign up.
 	var reqBody struct {
-		Alias, Code, Operation string
+		Alias, Email, Code, Operation, Verifier string
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
@@ -56,40 +57,35 @@ func (s signInner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidVerificationCode, nil)
 		return
 	}
+	// Operation of code is part of its cached hash, an operation of another code mismatches as a wrong code does.
+	if reqBody.Operation != operationLogIn && reqBody.Operation != operationRegister {
+		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidOperation, nil)
+		return
+	}
 
-	// We compare reqBody.Code with cached verification code from redis to check validity and to determine operation type.
-	// If reqBody.Code doesn't exist in database, just return soon.
-	key := cacheVerificationCodeKeyPrefix + ":" + reqBody.Code
-	val, err := s.fetchUserEmailFromCache(r.Context(), key)
-	if errors.Is(err, redis.Nil) {
-		// If key doesn't exist, verification code must be expired.
+	// We compare reqBody.Code and operation with cached verification code of email from redis to check validity.
+	// Redeeming a code invalidates it, so that a callack url in authentication email can be used only once.
+	// This reduces complexity of bussiness logic.
+	email := strings.ToLower(reqBody.Email)
+	operation := reqBody.Operation
+	err := redeemVerification(r.Context(), s.cache, s.secrets, email, reqBody.Code, operation, reqBody.Verifier)
+	if errors.Is(err, cache.ErrNotFound) {
+		// If code is not found, verification code must be expired, superseded or redeemed already.
 		httpx.FinalizeResponse(w, httpx.ErrAuthVerificationCodeExpired, nil)
 		return
 	}
-	if err != nil {
-		s.logger.Errorf("could not fetch email from cache: %v", err)
-
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+	if errors.Is(err, errVerificationMismatch) {
+		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidVerificationCode, nil)
 		return
 	}
-	s.logger.Debug("Fetched cached verification code: ", val)
-
-	// Delete caced verification code immediately once user requested,
-	// so that a callack url in authentication email can be used only once.
-	// This reduces complexity of bussiness logic.
-	if err = s.deleteUserEmailFromCache(r.Context(), key); err != nil {
-		s.logger.Errorf("An error occurred when deleting cached verification code: %v", err)
-
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+	if errors.Is(err, errVerificationAttemptsExceeded) {
+		httpx.FinalizeResponse(w, httpx.ErrAuthTooManyAttempts, nil)
 		return
 	}
+	if err != nil {
+		s.logger.Errorf("could not redeem verification code: %v", err)
 
-	// The cached verification code was fetched, then check user's operation.
-	operation, email := splitOpAndEmail(val)
-	if reqBody.Operation != operation {
-		s.logger.Debugf("Operation in request is different from that associated with cached verification code, cached: %s, user: %s", operation, reqBody.Operation)
-
-		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidOperation, nil)
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 		return
 	}
 
@@ -103,6 +99,18 @@ func (s signInner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		s.logger.Debugf("Got userid: %d", userid)
+
+		state, err := getAccountState(r.Context(), s.db, userid)
+		if err != nil {
+			s.logger.Errorf("could not get account state: %v", err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if state.effective(time.Now()) != StatusActive {
+			httpx.FinalizeResponse(w, state.Status.code(), state)
+			return
+		}
 	} else if operation == operationRegister {
 		// Handle empty user alias.
 		if reqBody.Alias == "" {
@@ -119,6 +127,10 @@ func (s signInner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		userid, err = s.createUser(r.Context(), email, username, reqBody.Alias)
+		if errors.Is(err, pgx.ErrNoRows) {
+			httpx.FinalizeResponse(w, httpx.ErrAuthEmailAlreadyInUse, nil)
+			return
+		}
 		if err != nil {
 			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 			return
@@ -155,15 +167,6 @@ func (s signInner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s signInner) fetchUserEmailFromCache(ctx context.Context, key string) (string, error) {
-	return s.cache.Client.Get(ctx, key).Result()
-}
-
-func (s signInner) deleteUserEmailFromCache(ctx context.Context, key string) error {
-	_, err := s.cache.Client.Del(ctx, key).Result()
-	return err
-}
-
 func (s signInner) gerUserIDByEmail(ctx context.Context, email string) (uint64, error) {
 	conn, err := s.db.Pool.Acquire(ctx)
 	if err != nil {
@@ -183,23 +186,21 @@ func (s signInner) gerUserIDByEmail(ctx context.Context, email string) (uint64,
 	return id, nil
 }
 
-// createUser creates a new user.
+// createUser creates a new user, it returns pgx.ErrNoRows if email is already in use.
 // A user has unique email and unique username but may not alias.
 func (s signInner) createUser(ctx context.Context, email, username, alias string) (uint64, error) {
 	var id uint64
 
-	// If a deregistered user register again, just upsert user.
+	// A deregistered user keeps its email till purged, whatever its status it's never overwritten.
 	sql := `
 		INSERT INTO users (email, username, alias)
 		VALUES($1, $2, $3)
-		ON CONFLICT (email)
-		DO
-			UPDATE SET email = $4, username = $5, alias = $6, deregistered = $7
+		ON CONFLICT (email) DO NOTHING
 		RETURNING id;
 	`
 
 	if err := s.db.InTx(ctx, func(tx pgx.Tx) error {
-		return tx.QueryRow(ctx, sql, email, username, alias, email, username, alias, false).Scan(&id)
+		return tx.QueryRow(ctx, sql, email, username, alias).Scan(&id)
 	}); err != nil {
 		return 0, err
 	}
@@ -207,12 +208,6 @@ func (s signInner) createUser(ctx context.Context, email, username, alias string
 	return id, nil
 }
 
-// splitOpAndEmail splits operation and email from cached verification value.
-func splitOpAndEmail(val string) (operation string, email string) {
-	subs := strings.Split(val, ":")
-	return subs[0], subs[1]
-}
-
 // generateUsername generates a globally unique username.
 // It generates username from email, if this usename is not unique,
 // then it generates a random one.
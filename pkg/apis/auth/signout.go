@@ -81,6 +81,14 @@ func (s signOuter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			httpx.FinalizeResponse(w, httpx.ErrAuthAlreadyDeregistered, nil)
 			return
 		}
+
+		// Sign out user from all other devices too.
+		if err := revokeUserCredentials(r.Context(), s.cache, ids.UserID); err != nil {
+			s.logger.Errorf("could not revoke user credentials: %v", err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
 	}
 
 	httpx.FinalizeResponse(w, httpx.Success, nil)
@@ -103,12 +111,12 @@ func (s signOuter) parseTokenFromRequest(r *http.Request) (*jwt.Token, error) {
 func (s signOuter) deregisterUserFromDatabase(ctx context.Context, userid uint64) error {
 	sql := `
 		UPDATE users
-		SET deregistered = $1
-		WHERE id = $2;
+		SET deregistered = $1, deregistered_at = COALESCE(deregistered_at, NOW()), status = $2
+		WHERE id = $3;
 	`
 
 	return s.db.InTx(ctx, func(tx pgx.Tx) error {
-		_, err := tx.Exec(ctx, sql, true, userid)
+		_, err := tx.Exec(ctx, sql, true, StatusPendingDeletion, userid)
 		return err
 	})
 }
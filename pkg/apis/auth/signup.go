@@ -8,13 +8,14 @@ import (
 	"html/template"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"regexp"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
 	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
 	"github.com/williamlsh/orchid/pkg/cache"
 	"github.com/williamlsh/orchid/pkg/database"
@@ -22,9 +23,6 @@ import (
 )
 
 const (
-	// cacheVerificationCodeKeyPrefix is an auth cache key prefix to set verification code.
-	cacheVerificationCodeKeyPrefix = "auth:verification_code"
-
 	verificationCodeLength     = 12
 	verificationCodeExpiration = 2 * time.Hour
 
@@ -43,6 +41,7 @@ type signUpper struct {
 	mailConf email.ConfigOptions
 	cache    cache.Cache
 	db       database.Database
+	secrets  ConfigOptions
 }
 
 // newSignUpper returns a new SignUpper.
@@ -51,18 +50,21 @@ func newSignUpper(
 	cache cache.Cache,
 	db database.Database,
 	mailConf email.ConfigOptions,
+	secrets ConfigOptions,
 ) signUpper {
 	return signUpper{
 		logger,
 		mailConf,
 		cache,
 		db,
+		secrets,
 	}
 }
 
 func (s signUpper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Challenge optionally binds verification code to a verifier which client keeps, see verification.
 	var reqBody struct {
-		Email string
+		Email, Challenge string
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
@@ -73,40 +75,44 @@ func (s signUpper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidEmail, nil)
 		return
 	}
+	if !isChallengeValid(reqBody.Challenge) {
+		httpx.FinalizeResponse(w, httpx.ErrAuthInvalidChallenge, nil)
+		return
+	}
 
 	// Email letters should be lower case.
 	lowercaseEmail := strings.ToLower(reqBody.Email)
 
-	isNewUser, err := s.isNewUser(r.Context(), lowercaseEmail)
+	state, err := s.getExistingUserState(r.Context(), lowercaseEmail)
 	if err != nil {
 		s.logger.Errorf("could not check new user in database: %v", err)
 
 		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 		return
 	}
-
-	// Evict old code before cache new if any.
-	if err := evictUserVerificationCode(r.Context(), s.cache, lowercaseEmail); err != nil && !errors.Is(err, redis.Nil) {
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+	// An existing user with blocked account can't sign in, so don't bother sending email.
+	// A deregistered account pending deletion can't register again either until it's purged.
+	// Reason is not responded since anyone can sign up with this email.
+	if state != nil && state.effective(time.Now()) != StatusActive {
+		httpx.FinalizeResponse(w, state.Status.code(), nil)
 		return
 	}
+	isNewUser := state == nil
 
+	operation := operationLogIn
+	if isNewUser {
+		operation = operationRegister
+	}
 	code := randString(verificationCodeLength, letterBytes)
-	if err := cacheUserEmail(r.Context(), s.cache, isNewUser, code, lowercaseEmail, verificationCodeExpiration); err != nil {
+	if err := cacheVerification(r.Context(), s.cache, s.secrets, lowercaseEmail, code, operation, reqBody.Challenge); err != nil {
 		s.logger.Errorf("could not cache verification code: %v", err)
 
 		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 		return
 	}
-	s.logger.Debugf("Send email with isNewUser=%t token=%s", isNewUser, code)
+	s.logger.Debugf("Send email with isNewUser=%t", isNewUser)
 
-	// Mark operation after caching new code.
-	if err := markUserOperation(r.Context(), s.cache, lowercaseEmail, code, verificationCodeExpiration); err != nil {
-		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
-		return
-	}
-
-	subject, content, err := composeEmail(isNewUser, code)
+	subject, content, err := composeEmail(isNewUser, code, lowercaseEmail)
 	if err != nil {
 		s.logger.Errorf("could not compose email: %v", err)
 
@@ -125,70 +131,28 @@ func (s signUpper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	httpx.FinalizeResponse(w, httpx.Success, nil)
 }
 
-// cacheUserEmail caches user auth operation info with expiration value of verificationCodeExpiration.
-// One user with unique email only has one cache info in redis.
-// The SignInner handler will use cache info to authenticate user.
-func cacheUserEmail(ctx context.Context, cache cache.Cache, isNewUser bool, code, email string, expiration time.Duration) error {
-	// Embed code in cache key, then in /signin, we can construct this key from user submit code again.
-	// Use email as value, then in /signin we can handle user with this email.
-	key := cacheVerificationCodeKeyPrefix + ":" + code
-	// Prefix operation to value.
-	var val string
-
-	if isNewUser {
-		val = operationRegister + ":" + email
-	} else {
-		val = operationLogIn + ":" + email
-	}
-
-	return cache.Client.Set(ctx, key, val, expiration).Err()
-}
-
-// markUserOperation is an helper for cacheUserEmail.
-// This helper marks user auth operation email with expiration value of verificationCodeExpiration.
-// When user frequently request SignUpper handler to receive emails, we always mark the latest operation,
-// delete the old cache, making only the latest operation is valid. This reduces SignInner handler complexity.
-// When SignInner handler receives code from request, it handles only the latest verification code.
-func markUserOperation(ctx context.Context, cache cache.Cache, email, code string, expiration time.Duration) error {
-	key := cacheVerificationCodeKeyPrefix + ":" + email
-
-	return cache.Client.Set(ctx, key, code, expiration).Err()
-}
-
-// evictUserVerificationCode is a helper for cacheUserEmail.
-// It's called before cacheUserEmail.
-func evictUserVerificationCode(ctx context.Context, cache cache.Cache, email string) error {
-	// First, get code from email.
-	key1 := cacheVerificationCodeKeyPrefix + ":" + email
-	code, err := cache.Client.Get(ctx, key1).Result()
-	if err != nil {
-		// May return redis.Nil error, caller should check and skip this error.
-		return err
-	}
-
-	// Second, delete code from code key.
-	key2 := cacheVerificationCodeKeyPrefix + ":" + code
-	return cache.Client.Del(ctx, key2).Err()
-}
-
-// isNewUser checks whether a signing up user is a new user by search its email in database.
-func (s signUpper) isNewUser(ctx context.Context, email string) (bool, error) {
+// getExistingUserState checks whether a signing up user is a new user by search its email in database.
+// It returns account state of an existing user, deregistered or not, or nil for a new user.
+func (s signUpper) getExistingUserState(ctx context.Context, email string) (*accountState, error) {
 	conn, err := s.db.Pool.Acquire(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer conn.Release()
 
-	var exists bool
+	var state accountState
 
-	// An existing user has a email and doesn't deregister.
-	sql := `select exists(select 1 from users where email = $1 and deregistered = $2)`
-	if err := conn.QueryRow(ctx, sql, email, false).Scan(&exists); err != nil {
-		return false, err
+	// A deregistered user is kept pending deletion till purged, its status tells whether it may sign in.
+	sql := `select status, status_reason, status_expires_at from users where email = $1`
+	err = conn.QueryRow(ctx, sql, email).Scan(&state.Status, &state.Reason, &state.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// A user not existing is a new user!
+		return nil, nil
 	}
-
-	// An existing user is not a new user!
-	return !exists, nil
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
 
 // isEmailValid checks if the email provided passes the required structure
@@ -208,8 +172,9 @@ func isEmailValid(e string) bool {
 	return true
 }
 
-func composeEmail(isNewUser bool, code string) (subject string, content string, err error) {
-	url := "https://example.com/m/callback?token=%s&operation=%s&state=example"
+func composeEmail(isNewUser bool, code, email string) (subject string, content string, err error) {
+	// Email is in url since code is verified with it.
+	url := "https://example.com/m/callback?token=%s&operation=%s&email=" + neturl.QueryEscape(email) + "&state=example"
 	if isNewUser {
 		subject = "Finish creating your account on Example"
 		regURL := fmt.Sprintf(url, code, "register")
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/williamlsh/orchid/pkg/cache"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *cache.Redis) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+	t.Cleanup(func() {
+		client.Close()
+		mr.Close()
+	})
+	return mr, &cache.Redis{Client: client}
+}
+
+// issueCode caches a new login verification code of testEmail as sign up does.
+func issueCode(ctx context.Context, c cache.Cache, challenge string) (string, error) {
+	code := randString(verificationCodeLength, letterBytes)
+	return code, cacheVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, challenge)
+}
+
+func TestConcurrentSignUps(t *testing.T) {
+	ctx := context.Background()
+	mr, c := newTestRedis(t)
+
+	const n = 20
+	codes := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code, err := issueCode(ctx, c, "")
+			if err != nil {
+				t.Error(err)
+			}
+			codes[i] = code
+		}(i)
+	}
+	wg.Wait()
+
+	// Replaced codes mismatch and count as failed attempts, so attempts are unlimited here.
+	secrets := testSecrets
+	secrets.VerificationMaxAttempts = 0
+	var redeemed int
+	for _, code := range codes {
+		err := redeemVerification(ctx, c, secrets, testEmail, code, operationLogIn, "")
+		if err == nil {
+			redeemed++
+		} else if !errors.Is(err, cache.ErrNotFound) && !errors.Is(err, errVerificationMismatch) {
+			t.Fatal(err)
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("expect only the latest code valid, %d redeemed", redeemed)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("expect replaced codes evicted, got %v", keys)
+	}
+}
+
+func TestConcurrentSignIns(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRedis(t)
+
+	code, err := issueCode(ctx, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results <- redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, "")
+		}()
+	}
+
+	var redeemed int
+	for i := 0; i < n; i++ {
+		err := <-results
+		if err == nil {
+			redeemed++
+		} else if !errors.Is(err, cache.ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("expect code redeemed once, %d redeemed", redeemed)
+	}
+}
+
+func TestConcurrentFailedSignIns(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRedis(t)
+
+	code, err := issueCode(ctx, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Guesses race to pass attempts check before any of them invalidates code.
+	const n = 20
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results <- redeemVerification(ctx, c, testSecrets, testEmail, "wrong", operationLogIn, "")
+		}()
+	}
+
+	var attempted, exceeded int
+	for i := 0; i < n; i++ {
+		err := <-results
+		switch {
+		case errors.Is(err, errVerificationMismatch):
+			attempted++
+		case errors.Is(err, errVerificationAttemptsExceeded):
+			attempted++
+			exceeded++
+		case !errors.Is(err, cache.ErrNotFound):
+			t.Fatal(err)
+		}
+	}
+	if attempted != testSecrets.VerificationMaxAttempts || exceeded != 1 {
+		t.Fatalf("expect %d attempts with the last exceeded, got %d attempts and %d exceeded", testSecrets.VerificationMaxAttempts, attempted, exceeded)
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, ""); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("expect code invalidated after failed attempts, got %v", err)
+	}
+}
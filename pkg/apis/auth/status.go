@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+)
+
+const (
+	// cacheAccountStatusKeyPrefix is an auth cache key prefix to mark blocked accounts.
+	cacheAccountStatusKeyPrefix = "auth:account_status"
+	// cacheUserCredentialsKeyPrefix is an auth cache key prefix to index credentials of a user.
+	cacheUserCredentialsKeyPrefix = "auth:user_credentials"
+)
+
+// AccountStatus is status of a user account.
+type AccountStatus string
+
+// All account statuses.
+const (
+	StatusActive          AccountStatus = "active"
+	StatusSuspended       AccountStatus = "suspended"
+	StatusLocked          AccountStatus = "locked"
+	StatusPendingDeletion AccountStatus = "pending_deletion"
+)
+
+// Valid reports whether s is a known account status.
+func (s AccountStatus) Valid() bool {
+	switch s {
+	case StatusActive, StatusSuspended, StatusLocked, StatusPendingDeletion:
+		return true
+	}
+	return false
+}
+
+// code returns the HTTP code responding to a user with status s.
+func (s AccountStatus) code() httpx.Code {
+	switch s {
+	case StatusSuspended:
+		return httpx.ErrAuthAccountSuspended
+	case StatusLocked:
+		return httpx.ErrAuthAccountLocked
+	case StatusPendingDeletion:
+		return httpx.ErrAuthAccountPendingDeletion
+	}
+	return httpx.Success
+}
+
+// accountState is status of an account with its reason and expiry.
+type accountState struct {
+	Status    AccountStatus `json:"status"`
+	Reason    string        `json:"reason,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+// effective returns status in effect at now, an expired status falls back to active.
+// Pending deletion never expires, the account stays deregistered until its status is changed.
+func (s accountState) effective(now time.Time) AccountStatus {
+	if s.Status != StatusPendingDeletion && s.ExpiresAt != nil && !now.Before(*s.ExpiresAt) {
+		return StatusActive
+	}
+	return s.Status
+}
+
+// SetAccountStatus changes status of a user account.
+// Any status other than active immediately revokes all cached credentials of the user.
+// A zero expiresAt means the status never expires.
+func SetAccountStatus(
+	ctx context.Context,
+	cache cache.Cache,
+	db database.Database,
+	userid uint64,
+	status AccountStatus,
+	reason string,
+	expiresAt time.Time,
+) error {
+	if !status.Valid() {
+		return fmt.Errorf("invalid account status: %s", status)
+	}
+
+	state := accountState{Status: status, Reason: reason}
+	if !expiresAt.IsZero() {
+		state.ExpiresAt = &expiresAt
+	}
+
+	// An account pending deletion is deregistered, so that it's purged after grace period.
+	sql := `
+		UPDATE users
+		SET status = $1, status_reason = $2, status_expires_at = $3,
+			deregistered = $4,
+			deregistered_at = CASE WHEN $4 THEN COALESCE(deregistered_at, NOW()) ELSE NULL END
+		WHERE id = $5;
+	`
+	deregistered := status == StatusPendingDeletion
+	if err := db.InTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, sql, state.Status, state.Reason, state.ExpiresAt, deregistered, userid)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	forgedUserID, err := confuse.EncodeID(userid)
+	if err != nil {
+		return err
+	}
+
+	key := accountStatusCacheKey(forgedUserID)
+	if status == StatusActive {
+		_, err := cache.Del(ctx, key)
+		return err
+	}
+	// A deregistered account is refused at sign up and sign in and has no credentials left, so it's not marked.
+	if status == StatusPendingDeletion {
+		if _, err := cache.Del(ctx, key); err != nil {
+			return err
+		}
+		return revokeUserCredentials(ctx, cache, forgedUserID)
+	}
+
+	// Mark account in cache so that authentication middleware responds with status without querying database.
+	val, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	var expiration time.Duration
+	if state.ExpiresAt != nil {
+		expiration = time.Until(*state.ExpiresAt)
+		if expiration <= 0 {
+			_, err := cache.Del(ctx, key)
+			return err
+		}
+	}
+	if err := cache.Set(ctx, key, string(val), expiration); err != nil {
+		return err
+	}
+
+	return revokeUserCredentials(ctx, cache, forgedUserID)
+}
+
+// getAccountState returns account state of user in database.
+func getAccountState(ctx context.Context, db database.Database, userid uint64) (*accountState, error) {
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var state accountState
+
+	sql := `
+		SELECT status, status_reason, status_expires_at
+		FROM users
+		WHERE id = $1;
+	`
+	if err := conn.QueryRow(ctx, sql, userid).Scan(&state.Status, &state.Reason, &state.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// getCachedAccountState parses an account state marked in cache.
+// It returns nil if account is not marked.
+func getCachedAccountState(val string, err error) (*accountState, error) {
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state accountState
+	if err := json.Unmarshal([]byte(val), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// revokeUserCredentials deletes all cached credentials of user.
+func revokeUserCredentials(ctx context.Context, cache cache.Cache, forgedUserID uint64) error {
+	key := userCredentialsCacheKey(forgedUserID)
+	uuids, err := cache.SMembers(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = cache.Del(ctx, append(uuids, key)...)
+	return err
+}
+
+func accountStatusCacheKey(forgedUserID uint64) string {
+	return cacheAccountStatusKeyPrefix + ":" + strconv.FormatUint(forgedUserID, 10)
+}
+
+func userCredentialsCacheKey(forgedUserID uint64) string {
+	return cacheUserCredentialsKeyPrefix + ":" + strconv.FormatUint(forgedUserID, 10)
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"go.uber.org/zap"
+)
+
+func TestAccountStateEffective(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	for _, tc := range []struct {
+		state accountState
+		want  AccountStatus
+	}{
+		{accountState{Status: StatusSuspended}, StatusSuspended},
+		{accountState{Status: StatusSuspended, ExpiresAt: &future}, StatusSuspended},
+		{accountState{Status: StatusLocked, ExpiresAt: &past}, StatusActive},
+		{accountState{Status: StatusPendingDeletion, ExpiresAt: &past}, StatusPendingDeletion},
+		{accountState{Status: StatusActive}, StatusActive},
+	} {
+		if got := tc.state.effective(now); got != tc.want {
+			t.Errorf("state %+v: expect %s, got %s", tc.state, tc.want, got)
+		}
+	}
+}
+
+func TestBlockedAccount(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	t.Cleanup(func() {
+		client.Close()
+		mr.Close()
+	})
+
+	secrets := ConfigOptions{
+		AccessSecret:  "abc",
+		RefreshSecret: "xyz",
+	}
+	cache := &cache.Redis{Client: client}
+	amw := New(zap.NewExample().Sugar(), cache, secrets)
+
+	forgedUserID, err := confuse.EncodeID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two sessions of the same user.
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		creds, err := createCreds(forgedUserID, secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cacheCredential(context.Background(), cache, forgedUserID, creds); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, creds.AccessToken)
+	}
+
+	// Block the account the same way SetAccountStatus does after updating database.
+	state, err := json.Marshal(accountState{Status: StatusSuspended, Reason: "abuse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Set(accountStatusCacheKey(forgedUserID), string(state)); err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeUserCredentials(context.Background(), cache, forgedUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		rr := httptest.NewRecorder()
+
+		r := mux.NewRouter()
+		r.Use(amw.MiddlewareMustAuthenticate)
+		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			httpx.FinalizeResponse(w, httpx.Success, nil)
+		})
+		r.ServeHTTP(rr, req)
+
+		var response httpx.FinalResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != httpx.ErrAuthAccountSuspended {
+			t.Errorf("returned: %s, want: %s", response.Code.Msg(), httpx.ErrAuthAccountSuspended.Msg())
+		}
+	}
+
+	// All credentials are revoked.
+	keys := mr.Keys()
+	if len(keys) != 1 || keys[0] != accountStatusCacheKey(forgedUserID) {
+		t.Fatalf("expect only account status key left in cache, got %v", keys)
+	}
+}
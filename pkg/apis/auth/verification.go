@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/williamlsh/orchid/pkg/cache"
+)
+
+const (
+	// cacheVerificationKeyPrefix is an auth cache key prefix to set verification of an email.
+	cacheVerificationKeyPrefix = "auth:verification"
+	// cacheVerificationAttemptsKeyPrefix is an auth cache key prefix to count failed attempts of verifying an email.
+	cacheVerificationAttemptsKeyPrefix = "auth:verification_attempts"
+
+	// challengeLength is length of a base64url encoded SHA-256 code challenge.
+	challengeLength = 43
+)
+
+var (
+	errVerificationMismatch         = errors.New("verification code or verifier mismatch")
+	errVerificationAttemptsExceeded = errors.New("too many verification attempts")
+)
+
+// verificationCacheKey and verificationAttemptsCacheKey share a hash tag, so that they are in a slot of a cluster.
+func verificationCacheKey(email string) string {
+	return cacheVerificationKeyPrefix + ":{" + email + "}"
+}
+
+func verificationAttemptsCacheKey(email string) string {
+	return cacheVerificationAttemptsKeyPrefix + ":{" + email + "}"
+}
+
+// hashVerification returns keyed hash of code sent to email for operation, bound to challenge if it's not empty.
+// Code itself is never cached, a leaked cache reveals no code.
+func hashVerification(secret, email, code, operation, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{email, code, operation, challenge}, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// codeChallenge returns S256 code challenge of verifier, as in PKCE.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// isChallengeValid reports whether challenge is empty or a S256 code challenge.
+func isChallengeValid(challenge string) bool {
+	if challenge == "" {
+		return true
+	}
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(challenge) == challengeLength && len(b) == sha256.Size
+}
+
+// cacheVerification caches a new verification code of email for operation, bound to challenge if it's not empty.
+// A challenge is the S256 code challenge of a verifier the client that requested code keeps, code is redeemed only
+// with the verifier, so that an email link leaked to another device is useless.
+// One email only has one code, a new code replaces the old one and its failed attempts.
+func cacheVerification(ctx context.Context, c cache.Cache, secrets ConfigOptions, email, code, operation, challenge string) error {
+	val := hashVerification(secrets.VerificationSecret, email, code, operation, challenge)
+	return c.Set(ctx, verificationCacheKey(email), val, verificationCodeExpiration)
+}
+
+// redeemVerification invalidates cached verification code of email if code, operation and verifier match it.
+// Verifier is required if and only if code is bound to a challenge.
+// Matching and counting attempts are atomic, so that a code is redeemed once and attempted at most
+// secrets.VerificationMaxAttempts times however many requests race, then it's invalidated.
+//
+// It returns cache.ErrNotFound if no code of email is valid, errVerificationMismatch if code or verifier mismatch,
+// and errVerificationAttemptsExceeded if the code is invalidated by the last failed attempt.
+func redeemVerification(ctx context.Context, c cache.Cache, secrets ConfigOptions, email, code, operation, verifier string) error {
+	challenge := ""
+	if verifier != "" {
+		challenge = codeChallenge(verifier)
+	}
+	val := hashVerification(secrets.VerificationSecret, email, code, operation, challenge)
+
+	maxAttempts := int64(secrets.VerificationMaxAttempts)
+	ok, failed, err := c.DelIfEqualLimited(ctx, verificationCacheKey(email), verificationAttemptsCacheKey(email), val, maxAttempts)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if maxAttempts > 0 && failed >= maxAttempts {
+		return errVerificationAttemptsExceeded
+	}
+	return errVerificationMismatch
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/williamlsh/orchid/pkg/cache"
+)
+
+const testEmail = "user@example.com"
+
+var testSecrets = ConfigOptions{
+	VerificationSecret:      "secret",
+	VerificationMaxAttempts: 3,
+}
+
+func TestVerificationStoredHashed(t *testing.T) {
+	ctx := context.Background()
+	mr, c := newTestRedis(t)
+
+	code, err := issueCode(ctx, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		val, _ := mr.Get(key)
+		if strings.Contains(key, code) || strings.Contains(val, code) {
+			t.Fatalf("expect code not stored in plaintext, got %s=%s", key, val)
+		}
+	}
+
+	if err := redeemVerification(ctx, c, testSecrets, "other@example.com", code, operationLogIn, ""); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("expect code of another email not found, got %v", err)
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationRegister, ""); !errors.Is(err, errVerificationMismatch) {
+		t.Fatalf("expect code of another operation mismatch, got %v", err)
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, ""); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("expect redeemed code and its attempts deleted, got %v", keys)
+	}
+}
+
+func TestVerificationAttempts(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRedis(t)
+
+	code, err := issueCode(ctx, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < testSecrets.VerificationMaxAttempts; i++ {
+		if err := redeemVerification(ctx, c, testSecrets, testEmail, "wrong", operationLogIn, ""); !errors.Is(err, errVerificationMismatch) {
+			t.Fatalf("attempt %d: expect mismatch, got %v", i, err)
+		}
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, "wrong", operationLogIn, ""); !errors.Is(err, errVerificationAttemptsExceeded) {
+		t.Fatalf("expect last attempt exceeded, got %v", err)
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, ""); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("expect code invalidated after failed attempts, got %v", err)
+	}
+
+	// A new code counts attempts from zero.
+	if _, err := issueCode(ctx, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, "wrong", operationLogIn, ""); !errors.Is(err, errVerificationMismatch) {
+		t.Fatalf("expect mismatch, got %v", err)
+	}
+	code, err = issueCode(ctx, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < testSecrets.VerificationMaxAttempts; i++ {
+		if err := redeemVerification(ctx, c, testSecrets, testEmail, "wrong", operationLogIn, ""); !errors.Is(err, errVerificationMismatch) {
+			t.Fatalf("attempt %d: expect mismatch, got %v", i, err)
+		}
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerificationVerifier(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRedis(t)
+
+	verifier := randString(64, letterBytes)
+	challenge := codeChallenge(verifier)
+	if !isChallengeValid(challenge) || isChallengeValid("short") {
+		t.Fatal("expect only S256 challenges valid")
+	}
+
+	code, err := issueCode(ctx, c, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"", "another device"} {
+		if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, v); !errors.Is(err, errVerificationMismatch) {
+			t.Fatalf("expect verifier %q mismatch, got %v", v, err)
+		}
+	}
+	if err := redeemVerification(ctx, c, testSecrets, testEmail, code, operationLogIn, verifier); err != nil {
+		t.Fatal(err)
+	}
+}
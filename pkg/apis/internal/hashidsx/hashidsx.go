@@ -6,41 +6,51 @@ import (
 	"github.com/speps/go-hashids"
 )
 
-const (
-	salt      = "this my salt."
-	minLength = 30
-)
+var ErrInvalidHashID = errors.New("invalid hash string, not exactly one id is encoded")
+
+// ConfigOptions includes hashids config options.
+type ConfigOptions struct {
+	Salt      string
+	MinLength int
+}
 
-var ErrInvalidHashID = errors.New("invalid hash string, more than one id is encoded")
+// HashID encodes integer ids to short unique strings and decodes them back.
+type HashID struct {
+	hd *hashids.HashID
+}
 
-var hd *hashids.HashID
+// New returns a new HashID.
+func New(config ConfigOptions) HashID {
+	hd := hashids.NewData()
+	hd.Salt = config.Salt
+	hd.MinLength = config.MinLength
 
-func init() {
-	hd = hashid()
+	return HashID{hashids.NewWithData(hd)}
 }
 
 // Encode encodes a single integer id to string.
-func Encode(id int) (string, error) {
-	return hd.Encode([]int{id})
+func (h HashID) Encode(id int) (string, error) {
+	return h.hd.Encode([]int{id})
 }
 
 // Decode decodes a hash string to a single integer id.
 // If the decoded hash is not a single id, it returns an error indicating this.
-func Decode(hash string) (int, error) {
-	d, err := hd.DecodeWithError(hash)
+func (h HashID) Decode(hash string) (int, error) {
+	d, err := h.hd.DecodeWithError(hash)
 	if err != nil {
 		return 0, err
 	}
-	if len(d) > 1 {
+	if len(d) != 1 {
 		return 0, ErrInvalidHashID
 	}
-	return d[0], nil
-}
 
-func hashid() *hashids.HashID {
-	hd := hashids.NewData()
-	hd.Salt = salt
-	hd.MinLength = minLength
-
-	return hashids.NewWithData(hd)
+	// Different hashes may decode to the same id, only the canonical one is accepted.
+	canonical, err := h.Encode(d[0])
+	if err != nil {
+		return 0, err
+	}
+	if canonical != hash {
+		return 0, ErrInvalidHashID
+	}
+	return d[0], nil
 }
@@ -7,15 +7,24 @@ import (
 )
 
 func TestHashID(t *testing.T) {
+	hd := New(ConfigOptions{
+		Salt:      "this my salt.",
+		MinLength: 30,
+	})
+
 	t.Run("one id", func(t *testing.T) {
 		id := 7
-		hash, err := Encode(id)
+		hash, err := hd.Encode(id)
 		if err != nil {
 			t.Fatal(err)
 		}
 		fmt.Println("encoded: ", hash)
 
-		decoded, err := Decode(hash)
+		if len(hash) < 30 {
+			t.Fatalf("expect hash at least 30 characters, got %d", len(hash))
+		}
+
+		decoded, err := hd.Decode(hash)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -24,14 +33,28 @@ func TestHashID(t *testing.T) {
 		}
 	})
 	t.Run("more than one id", func(t *testing.T) {
-		e, err := hd.Encode([]int{45, 434, 1313, 99})
+		e, err := hd.hd.Encode([]int{45, 434, 1313, 99})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		_, err = Decode(e)
+		_, err = hd.Decode(e)
 		if !errors.Is(ErrInvalidHashID, err) {
 			t.Fatalf("not this error: %v", err)
 		}
 	})
+	t.Run("different salt", func(t *testing.T) {
+		other := New(ConfigOptions{
+			Salt:      "another salt.",
+			MinLength: 30,
+		})
+		hash, err := other.Encode(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded, err := hd.Decode(hash); err == nil && decoded == 7 {
+			t.Fatal("expect hash of another salt not to decode to the same id")
+		}
+	})
 }
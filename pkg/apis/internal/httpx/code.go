@@ -26,10 +26,40 @@ const (
 	ErrAuthAlreadyDeregistered
 	ErrAuthTokenExpired
 	ErrAuthEmailAlreadyInUse
+	ErrAuthAccountSuspended
+	ErrAuthAccountLocked
+	ErrAuthAccountPendingDeletion
+	ErrAuthInvalidChallenge
+	ErrAuthTooManyAttempts
 
 	ErrUsernameAlreadyInUse
+	ErrUserInvalidProfile
+	ErrUserNotFound
+	ErrUserInvalidPreferences
 
 	ErrUploadEmptyChecksum
+	ErrUploadInvalidChecksum
+	ErrUploadChecksumMismatch
+	ErrUploadObjectNotFound
+	ErrUploadObjectConflict
+	ErrUploadFileNotFound
+	ErrUploadInvalidPurpose
+	ErrUploadInvalidContentType
+	ErrUploadFileNotUploaded
+	ErrUploadInvalidShare
+	ErrUploadShareNotFound
+	ErrUploadSharePasswordMismatch
+	ErrUploadShareExhausted
+	ErrUploadInvalidSession
+	ErrUploadSessionNotFound
+	ErrUploadInvalidPart
+	ErrUploadIncompleteParts
+	ErrUploadSizeMismatch
+	ErrUploadQuotaExceeded
+	ErrUploadNotImage
+	ErrUploadFileNotScanned
+	ErrUploadFileQuarantined
+	ErrUploadTooLarge
 
 	ErrServiceUnavailable
 )
@@ -52,8 +82,38 @@ var Msgs = map[Code]string{
 	ErrAuthAlreadyDeregistered:     "Already deregistered",
 	ErrAuthTokenExpired:            "Token expired",
 	ErrAuthEmailAlreadyInUse:       "User email already in use",
+	ErrAuthAccountSuspended:        "Account suspended",
+	ErrAuthAccountLocked:           "Account locked",
+	ErrAuthAccountPendingDeletion:  "Account pending deletion",
+	ErrAuthInvalidChallenge:        "Invalid code challenge",
+	ErrAuthTooManyAttempts:         "Too many verification attempts",
 	ErrUsernameAlreadyInUse:        "Username already in use",
+	ErrUserInvalidProfile:          "Invalid user profile",
+	ErrUserNotFound:                "User not found",
+	ErrUserInvalidPreferences:      "Invalid user preferences",
 	ErrUploadEmptyChecksum:         "Empty upload file checksum",
+	ErrUploadInvalidChecksum:       "Invalid upload file checksum",
+	ErrUploadChecksumMismatch:      "Upload file checksum mismatch",
+	ErrUploadObjectNotFound:        "Upload object not found",
+	ErrUploadObjectConflict:        "Upload object not owned by user",
+	ErrUploadFileNotFound:          "File not found",
+	ErrUploadInvalidPurpose:        "Invalid upload purpose",
+	ErrUploadInvalidContentType:    "Upload content type not allowed",
+	ErrUploadFileNotUploaded:       "File not uploaded yet",
+	ErrUploadInvalidShare:          "Invalid share link options",
+	ErrUploadShareNotFound:         "Share link not found or expired",
+	ErrUploadSharePasswordMismatch: "Share link password mismatch",
+	ErrUploadShareExhausted:        "Share link download limit reached",
+	ErrUploadInvalidSession:        "Invalid upload session options",
+	ErrUploadSessionNotFound:       "Upload session not found or expired",
+	ErrUploadInvalidPart:           "Invalid upload part",
+	ErrUploadIncompleteParts:       "Upload session has missing parts",
+	ErrUploadSizeMismatch:          "Uploaded object size mismatch",
+	ErrUploadQuotaExceeded:         "Storage quota exceeded",
+	ErrUploadNotImage:              "File is not an image",
+	ErrUploadFileNotScanned:        "File not scanned yet",
+	ErrUploadFileQuarantined:       "File quarantined",
+	ErrUploadTooLarge:              "Upload file too large",
 
 	ErrServiceUnavailable: " Service unavailable",
 }
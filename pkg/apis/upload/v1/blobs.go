@@ -0,0 +1,329 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// errFileNotPending indicates a file to commit is no longer pending.
+var errFileNotPending = errors.New("file not pending")
+
+// blobPrefix is key prefix of blob objects, they are written only by server.
+const blobPrefix = "blobs/"
+
+// Content is stored once per bucket and data key as a blob addressed by its SHA-256, files reference blobs.
+// An uploaded object is copied to a blob object out of user's reach before it's hashed,
+// so that content of a blob can't be changed through a still valid presigned upload url.
+// With encryption enabled, it's hashed as it's encrypted into the blob object instead.
+
+// hashObject returns hex encoded SHA-256 of object content computed by server.
+func hashObject(ctx context.Context, s storage.ObjectStore, bucket, key string) (string, error) {
+	obj, err := s.GetObject(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, obj); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commitUpload marks a file uploaded with its object info, making it reference a blob of its content
+// and accounting it to storage usage of its owner. Images are queued for processing.
+// The uploaded object is removed afterwards. If checksum is empty, object ETag is recorded instead.
+// It returns errFileNotPending if the file is committed or deleted meanwhile,
+// or errQuotaExceeded if it doesn't fit in quota of its owner, in which case the file and its object are deleted.
+func (u uploader) commitUpload(ctx context.Context, fileID uint64, bucket, key, checksum string, info storage.ObjectInfo) error {
+	blobKey := blobPrefix + uuid.NewV4().String()
+	sum, size, dk, err := u.storeBlob(ctx, fileID, bucket, key, blobKey, info)
+	if err != nil {
+		return err
+	}
+	if checksum == "" {
+		checksum = strings.Trim(info.ETag, `"`)
+	}
+
+	var deduplicated bool
+	sql := `
+		UPDATE files
+		SET status = $1, size = $2, content_type = $3, checksum = $4, blob_id = $5
+		WHERE id = $6 AND status = $7
+		RETURNING owner_id;
+	`
+	if err := u.db.InTx(ctx, func(tx pgx.Tx) error {
+		blobID, created, err := referenceBlob(ctx, tx, bucket, blobKey, sum, size, dk.ID)
+		if err != nil {
+			return err
+		}
+		deduplicated = !created
+
+		var ownerID uint64
+		err = tx.QueryRow(ctx, sql, FileStatusUploaded, size, info.ContentType, checksum, blobID, fileID, FileStatusPending).Scan(&ownerID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errFileNotPending
+		}
+		if err != nil {
+			return err
+		}
+		if err := chargeUsage(ctx, tx, ownerID, size, 1, u.config.Quota); err != nil {
+			return err
+		}
+		return queueImage(ctx, tx, fileID, info.ContentType)
+	}); err != nil {
+		if errors.Is(err, errFileNotPending) || errors.Is(err, errQuotaExceeded) {
+			// Blob reference is rolled back, but its object may be new.
+			if err := u.storage.RemoveObject(ctx, bucket, blobKey); err != nil {
+				u.logger.Errorf("failed to remove object, bucket=%s key=%s err=%v", bucket, blobKey, err)
+			}
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			if err := u.rejectUpload(ctx, fileID, bucket, key); err != nil {
+				u.logger.Errorf("failed to reject upload over quota, id=%d err=%v", fileID, err)
+			}
+		}
+		return err
+	}
+
+	// Failing to remove objects only wastes space, content is safely referenced.
+	garbage := []string{key}
+	if deduplicated {
+		garbage = append(garbage, blobKey)
+	}
+	for _, k := range garbage {
+		if err := u.storage.RemoveObject(ctx, bucket, k); err != nil {
+			u.logger.Errorf("failed to remove object, bucket=%s key=%s err=%v", bucket, k, err)
+		}
+	}
+	return nil
+}
+
+// rejectUpload deletes a pending file and its uploaded object.
+func (u uploader) rejectUpload(ctx context.Context, fileID uint64, bucket, key string) error {
+	sql := `
+		DELETE FROM files
+		WHERE id = $1 AND status = $2;
+	`
+	if err := u.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, fileID, FileStatusPending)
+		return err
+	}); err != nil {
+		return err
+	}
+	return u.storage.RemoveObject(ctx, bucket, key)
+}
+
+// storeBlob stores content of an uploaded object in a blob object, returning SHA-256 and size of content
+// and the data key of file owner it's encrypted with.
+func (u uploader) storeBlob(ctx context.Context, fileID uint64, bucket, key, blobKey string, info storage.ObjectInfo) (string, int64, DataKey, error) {
+	if !u.encryptor.Enabled() {
+		copied, err := u.storage.CopyObject(ctx, bucket, blobKey, key)
+		if err != nil {
+			return "", 0, DataKey{}, err
+		}
+		sum, err := hashObject(ctx, u.storage, bucket, blobKey)
+		return sum, copied.Size, DataKey{}, err
+	}
+
+	ownerID, err := u.fileOwner(ctx, fileID)
+	if err != nil {
+		return "", 0, DataKey{}, err
+	}
+	dk, err := u.encryptor.DataKey(ctx, ownerID)
+	if err != nil {
+		return "", 0, DataKey{}, err
+	}
+	obj, err := u.storage.GetObject(ctx, bucket, key)
+	if err != nil {
+		return "", 0, DataKey{}, err
+	}
+	defer obj.Close()
+
+	// Storing exactly size bytes fails if the object changed since it's inspected.
+	h := sha256.New()
+	if err := u.encryptor.PutObject(ctx, bucket, blobKey, dk, io.TeeReader(obj, h), info.Size, storage.PutOptions{
+		ContentType: info.ContentType,
+	}); err != nil {
+		return "", 0, DataKey{}, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), info.Size, dk, nil
+}
+
+// fileOwner returns owner of a file.
+func (u uploader) fileOwner(ctx context.Context, fileID uint64) (uint64, error) {
+	conn, err := u.db.Pool.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var ownerID uint64
+	err = conn.QueryRow(ctx, `SELECT owner_id FROM files WHERE id = $1;`, fileID).Scan(&ownerID)
+	return ownerID, err
+}
+
+// referenceBlob increments reference count of the blob of content encrypted with data key of keyID,
+// or creates it with object key if it doesn't exist.
+func referenceBlob(ctx context.Context, tx pgx.Tx, bucket, key, sum string, size int64, keyID uint64) (blobID uint64, created bool, err error) {
+	// Serialize concurrent uploads of the same content, so that only one of them creates its blob.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1));`, sum); err != nil {
+		return 0, false, err
+	}
+
+	sql := `
+		SELECT id FROM blobs
+		WHERE bucket = $1 AND sha256 = $2 AND key_id = $3
+		FOR UPDATE;
+	`
+	err = tx.QueryRow(ctx, sql, bucket, sum, keyID).Scan(&blobID)
+	if err == nil {
+		sql = `
+			UPDATE blobs
+			SET ref_count = ref_count + 1, unreferenced_at = NULL
+			WHERE id = $1;
+		`
+		_, err = tx.Exec(ctx, sql, blobID)
+		return blobID, false, err
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, err
+	}
+
+	sql = `
+		INSERT INTO blobs (bucket, object_key, sha256, size, key_id, ref_count)
+		VALUES ($1, $2, $3, $4, $5, 1)
+		RETURNING id;
+	`
+	err = tx.QueryRow(ctx, sql, bucket, key, sum, size, keyID).Scan(&blobID)
+	return blobID, true, err
+}
+
+// ReleaseBlobs decrements reference count of blobs once per id in tx.
+// Blobs no longer referenced are deleted by Collector after a grace period.
+func ReleaseBlobs(ctx context.Context, tx pgx.Tx, blobIDs []uint64) error {
+	sql := `
+		UPDATE blobs
+		SET ref_count = ref_count - 1,
+			unreferenced_at = CASE WHEN ref_count = 1 THEN NOW() ELSE unreferenced_at END
+		WHERE id = $1;
+	`
+	for _, id := range blobIDs {
+		if _, err := tx.Exec(ctx, sql, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collector garbage collects unreferenced blobs.
+type Collector struct {
+	logger      *zap.SugaredLogger
+	db          database.Database
+	storage     storage.ObjectStore
+	gracePeriod time.Duration
+}
+
+// NewCollector returns a new Collector.
+func NewCollector(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	storage storage.ObjectStore,
+	config ConfigOptions,
+) Collector {
+	return Collector{
+		logger,
+		db,
+		storage,
+		config.BlobGracePeriod,
+	}
+}
+
+// Collect deletes blobs unreferenced longer than grace period ago together with their objects.
+// It's meant to run periodically as a background job.
+// A blob failing to be collected is logged and left for the next run, the others are still collected.
+func (c Collector) Collect(ctx context.Context) error {
+	blobIDs, err := c.unreferencedBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, id := range blobIDs {
+		if err := c.collectBlob(ctx, id); err != nil {
+			c.logger.Errorf("failed to collect unreferenced blob, id=%d err=%v", id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// unreferencedBlobs returns ids of blobs unreferenced longer than grace period ago.
+func (c Collector) unreferencedBlobs(ctx context.Context) ([]uint64, error) {
+	conn, err := c.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT id FROM blobs
+		WHERE ref_count = 0 AND unreferenced_at < $1;
+	`
+	rows, err := conn.Query(ctx, sql, time.Now().Add(-c.gracePeriod))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobIDs []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blobIDs = append(blobIDs, id)
+	}
+	return blobIDs, rows.Err()
+}
+
+// collectBlob deletes a blob still unreferenced and its object. The object is removed before the row is committed,
+// so that a failed removal rolls back and is retried by the next run. Meanwhile an upload of the same content
+// waits for the deleted row and creates a new blob with a new object instead.
+func (c Collector) collectBlob(ctx context.Context, blobID uint64) error {
+	sql := `
+		DELETE FROM blobs
+		WHERE id = $1 AND ref_count = 0
+		RETURNING bucket, object_key;
+	`
+	return c.db.InTx(ctx, func(tx pgx.Tx) error {
+		var bucket, key string
+		err := tx.QueryRow(ctx, sql, blobID).Scan(&bucket, &key)
+		// Referenced again meanwhile.
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.storage.RemoveObject(ctx, bucket, key); err != nil {
+			return err
+		}
+		c.logger.Debugf("Collected unreferenced blob, bucket=%s key=%s", bucket, key)
+		return nil
+	})
+}
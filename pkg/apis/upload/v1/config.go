@@ -0,0 +1,115 @@
+package upload
+
+import "time"
+
+// Upload purposes.
+const (
+	// PurposeAvatar is purpose of uploading user avatars.
+	PurposeAvatar = "avatar"
+	// PurposeAttachment is purpose of uploading general attachments.
+	PurposeAttachment = "attachment"
+)
+
+// ConfigOptions provides all config options upload needs.
+type ConfigOptions struct {
+	// Bucket is the bucket all uploaded objects are stored in.
+	Bucket string
+	// PolicyExpiration is how long a presigned post policy is valid.
+	PolicyExpiration time.Duration
+	// DownloadURLExpiration is how long a presigned download url is valid.
+	DownloadURLExpiration time.Duration
+	// ShareMaxExpiration is the longest expiration of a share link.
+	ShareMaxExpiration time.Duration
+	// PartSize is the part size in bytes of multipart upload sessions.
+	PartSize int64
+	// SessionExpiration is how long a multipart upload session can be resumed,
+	// incomplete uploads older than it are aborted by janitor.
+	SessionExpiration time.Duration
+	// JanitorInterval is how often stale incomplete uploads are aborted.
+	JanitorInterval time.Duration
+	// BlobGracePeriod is how long an unreferenced blob is kept before it's collected.
+	BlobGracePeriod time.Duration
+	// BlobCollectInterval is how often unreferenced blobs are collected.
+	BlobCollectInterval time.Duration
+	// Quota is the default storage quota of users, it can be overridden per user.
+	Quota Quota
+	// Images configures processing of uploaded images.
+	Images ImageOptions
+	// Scan configures scanning of uploaded content.
+	Scan ScanOptions
+	// Encryption configures encryption of stored content.
+	Encryption EncryptionOptions
+	// Trash configures trash of deleted files.
+	Trash TrashOptions
+	// Proxy enables uploading and downloading content through orchid besides presigned urls,
+	// for deployments where storage isn't reachable by clients.
+	Proxy bool
+	// Notifications configures storage bucket notifications.
+	Notifications NotificationOptions
+	// Purposes are constraints of uploads keyed by purpose name.
+	Purposes map[string]PurposeOptions
+}
+
+// PurposeOptions constrains uploads of a purpose.
+type PurposeOptions struct {
+	// MaxSize is the maximum object size in bytes.
+	MaxSize int64
+	// ContentTypes are allowed MIME types, any type is allowed if it's empty.
+	ContentTypes []string
+}
+
+// ImageOptions configures processing of uploaded images.
+type ImageOptions struct {
+	// ThumbnailSizes are sizes in pixels of squares thumbnails are scaled to fit in.
+	ThumbnailSizes []int
+	// MaxPixels is the largest number of pixels of a processed image, larger images fail processing.
+	MaxPixels int64
+	// ProcessInterval is how often queued images are processed.
+	ProcessInterval time.Duration
+	// BatchSize is the number of images processed at a time.
+	BatchSize int
+}
+
+// ScanOptions configures scanning of uploaded content.
+type ScanOptions struct {
+	// Interval is how often uploaded files pending scanning are scanned.
+	Interval time.Duration
+	// BatchSize is the number of files scanned at a time.
+	BatchSize int
+}
+
+// EncryptionOptions configures encryption of stored content.
+type EncryptionOptions struct {
+	// MasterKeyFiles are files of master keys wrapping data keys, the first is active.
+	// Content is stored in plaintext if it's empty.
+	MasterKeyFiles []string
+	// ContentURL is public url under which orchid serves decrypted content.
+	ContentURL string
+}
+
+// TrashOptions configures trash of deleted files.
+type TrashOptions struct {
+	// Retention is how long a deleted file is kept in trash, where it can be restored, before it's purged.
+	Retention time.Duration
+	// PurgeInterval is how often expired files in trash are purged.
+	PurgeInterval time.Duration
+}
+
+// NotificationOptions configures storage bucket notifications.
+type NotificationOptions struct {
+	// Token authenticates notifications posted by storage, notifications aren't accepted if it's empty.
+	Token string
+}
+
+// allows reports whether content type is allowed for purpose.
+func (p PurposeOptions) allows(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	for _, t := range p.ContentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
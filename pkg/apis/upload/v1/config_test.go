@@ -0,0 +1,18 @@
+package upload
+
+import "testing"
+
+func TestPurposeOptionsAllows(t *testing.T) {
+	avatar := PurposeOptions{MaxSize: 1 << 20, ContentTypes: []string{"image/png", "image/jpeg"}}
+	if !avatar.allows("image/png") {
+		t.Fatal("expect image/png allowed")
+	}
+	if avatar.allows("text/html") {
+		t.Fatal("expect text/html not allowed")
+	}
+
+	attachment := PurposeOptions{MaxSize: 1 << 20}
+	if !attachment.allows("application/zip") {
+		t.Fatal("expect any content type allowed when none is configured")
+	}
+}
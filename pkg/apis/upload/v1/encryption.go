@@ -0,0 +1,430 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/encryption"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// paramKeyID is query parameter of signed content urls carrying id of the data key content is encrypted with.
+const paramKeyID = "keyId"
+
+// errEncryptionDisabled indicates encrypted content is accessed without master keys.
+var errEncryptionDisabled = errors.New("content is encrypted but encryption is disabled")
+
+// DataKey is a data key of a user content is encrypted with, the zero DataKey stores content in plaintext.
+type DataKey struct {
+	ID  uint64
+	key []byte
+}
+
+// Encryptor encrypts content in storage with data keys of users, which are wrapped by master keys.
+// Which data key content is encrypted with is recorded in database along with it, 0 for plaintext.
+// It's never guessed from content, so that uploading ciphertext can't make orchid decrypt it.
+//
+// Content is encrypted when an upload is committed to a blob, i.e. uploaded objects are in plaintext until then.
+// Encrypted content is downloaded through urls signed and served by Encryptor, which decrypts it.
+// Without master keys Encryptor is disabled and new content is stored in plaintext.
+type Encryptor struct {
+	logger  *zap.SugaredLogger
+	db      database.Database
+	storage storage.ObjectStore
+	keyring *encryption.Keyring
+	signer  *storage.Signer
+
+	mu sync.Mutex
+	// keys are unwrapped data keys by id.
+	keys map[uint64][]byte
+}
+
+// NewEncryptor returns a new Encryptor, which is disabled if no master key file is configured.
+func NewEncryptor(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	objects storage.ObjectStore,
+	config ConfigOptions,
+) (*Encryptor, error) {
+	e := &Encryptor{
+		logger:  logger,
+		db:      db,
+		storage: objects,
+		keys:    make(map[uint64][]byte),
+	}
+	if len(config.Encryption.MasterKeyFiles) == 0 {
+		return e, nil
+	}
+
+	keyring, err := encryption.LoadKeyring(config.Encryption.MasterKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := storage.NewSigner(config.Encryption.ContentURL, keyring.Derive("orchid content url"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted content url: %w", err)
+	}
+	e.keyring, e.signer = keyring, signer
+	return e, nil
+}
+
+// Enabled reports whether new content is encrypted, a nil Encryptor is disabled.
+func (e *Encryptor) Enabled() bool {
+	return e != nil && e.keyring != nil
+}
+
+// PathPrefix returns url path under which e serves decrypted content, it's only meaningful if e is enabled.
+func (e *Encryptor) PathPrefix() string {
+	return e.signer.PathPrefix()
+}
+
+// DataKey returns the active data key of user, creating it if user has none.
+// It returns the zero DataKey if e is disabled.
+func (e *Encryptor) DataKey(ctx context.Context, userID uint64) (DataKey, error) {
+	if !e.Enabled() {
+		return DataKey{}, nil
+	}
+
+	dk, err := e.activeKey(ctx, userID)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return dk, err
+	}
+	if err := e.createKey(ctx, userID); err != nil {
+		return DataKey{}, err
+	}
+	// A concurrent request may have created it instead.
+	return e.activeKey(ctx, userID)
+}
+
+// activeKey is an helper for DataKey.
+func (e *Encryptor) activeKey(ctx context.Context, userID uint64) (DataKey, error) {
+	conn, err := e.db.Pool.Acquire(ctx)
+	if err != nil {
+		return DataKey{}, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT id, master_key_id, wrapped_key
+		FROM data_keys
+		WHERE user_id = $1 AND retired_at IS NULL;
+	`
+	var (
+		id       uint64
+		masterID string
+		wrapped  []byte
+	)
+	if err := conn.QueryRow(ctx, sql, userID).Scan(&id, &masterID, &wrapped); err != nil {
+		return DataKey{}, err
+	}
+	key, err := e.unwrap(id, masterID, wrapped)
+	if err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{id, key}, nil
+}
+
+// createKey creates an active data key of user unless user has one.
+func (e *Encryptor) createKey(ctx context.Context, userID uint64) error {
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return err
+	}
+	masterID, wrapped, err := e.keyring.Wrap(key)
+	if err != nil {
+		return err
+	}
+
+	sql := `
+		INSERT INTO data_keys (user_id, master_key_id, wrapped_key)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) WHERE retired_at IS NULL DO NOTHING;
+	`
+	return e.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, userID, masterID, wrapped)
+		return err
+	})
+}
+
+// key returns data key of id.
+func (e *Encryptor) key(ctx context.Context, id uint64) ([]byte, error) {
+	if !e.Enabled() {
+		return nil, errEncryptionDisabled
+	}
+	e.mu.Lock()
+	key, ok := e.keys[id]
+	e.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	conn, err := e.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT master_key_id, wrapped_key
+		FROM data_keys
+		WHERE id = $1;
+	`
+	var (
+		masterID string
+		wrapped  []byte
+	)
+	if err := conn.QueryRow(ctx, sql, id).Scan(&masterID, &wrapped); err != nil {
+		return nil, fmt.Errorf("data key %d: %w", id, err)
+	}
+	return e.unwrap(id, masterID, wrapped)
+}
+
+// unwrap returns data key of id wrapped by master key of masterID, caching it.
+func (e *Encryptor) unwrap(id uint64, masterID string, wrapped []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key, ok := e.keys[id]; ok {
+		return key, nil
+	}
+	key, err := e.keyring.Unwrap(masterID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("data key %d: %w", id, err)
+	}
+	e.keys[id] = key
+	return key, nil
+}
+
+// PutObject stores content of size bytes read from r encrypted with dk, size is -1 if unknown.
+func (e *Encryptor) PutObject(ctx context.Context, bucket, key string, dk DataKey, r io.Reader, size int64, opts storage.PutOptions) error {
+	if dk.ID != 0 {
+		er, err := encryption.NewEncryptReader(r, dk.key)
+		if err != nil {
+			return err
+		}
+		r = er
+		if size >= 0 {
+			size = encryption.EncryptedSize(size)
+		}
+	}
+	_, err := e.storage.PutObject(ctx, bucket, key, r, size, opts)
+	return err
+}
+
+// decryptedObject is content of an object read decrypted.
+type decryptedObject struct {
+	io.Reader
+	io.Closer
+}
+
+// GetObject returns content of an object encrypted with data key of keyID.
+func (e *Encryptor) GetObject(ctx context.Context, bucket, key string, keyID uint64) (io.ReadCloser, error) {
+	if keyID == 0 {
+		return e.storage.GetObject(ctx, bucket, key)
+	}
+	dataKey, err := e.key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := e.storage.GetObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedObject{encryption.NewDecryptReader(obj, dataKey), obj}, nil
+}
+
+// GetObjectRange returns length bytes from offset of content of an object of size bytes in storage
+// encrypted with data key of keyID. Only the segments of encrypted content holding the range are read.
+func (e *Encryptor) GetObjectRange(ctx context.Context, bucket, key string, keyID uint64, size, offset, length int64) (io.ReadCloser, error) {
+	if keyID == 0 {
+		return e.storage.GetObjectRange(ctx, bucket, key, offset, length)
+	}
+	dataKey, err := e.key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	header, err := e.storage.GetObjectRange(ctx, bucket, key, 0, int64(encryption.HeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer header.Close()
+	buf, err := ioutil.ReadAll(header)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := encryption.EncryptedRange(size, offset, length)
+	obj, err := e.storage.GetObjectRange(ctx, bucket, key, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedObject{encryption.NewDecryptRangeReader(bytes.NewReader(buf), obj, dataKey, offset, length), obj}, nil
+}
+
+// PresignGet returns an url downloading content of an object encrypted with data key of keyID.
+// Plaintext content is downloaded from storage directly, encrypted content through e.
+func (e *Encryptor) PresignGet(ctx context.Context, bucket, key string, keyID uint64, expiry time.Duration, params url.Values) (*url.URL, error) {
+	if keyID == 0 {
+		return e.storage.PresignGet(ctx, bucket, key, expiry, params)
+	}
+	if !e.Enabled() {
+		return nil, errEncryptionDisabled
+	}
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set(paramKeyID, strconv.FormatUint(keyID, 10))
+	return e.signer.Sign(http.MethodGet, bucket, key, expiry, query), nil
+}
+
+// ServeHTTP serves urls returned by PresignGet of encrypted content, decrypting it.
+// Failures are reported as plain text like downloads from storage.
+func (e *Encryptor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, ok := e.signer.SplitPath(r.URL.Path)
+	if !ok || key == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.signer.Verify(r, bucket, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	keyID, err := strconv.ParseUint(query.Get(paramKeyID), 10, 64)
+	if err != nil || keyID == 0 {
+		http.Error(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+	info, err := e.storage.StatObject(r.Context(), bucket, key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		http.Error(w, "the specified key does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		e.logger.Errorf("failed to stat object, bucket=%s key=%s err=%v", bucket, key, err)
+
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	obj, err := e.GetObject(r.Context(), bucket, key, keyID)
+	if err != nil {
+		e.logger.Errorf("failed to get object, bucket=%s key=%s err=%v", bucket, key, err)
+
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", info.ContentType)
+	if v := query.Get("response-content-type"); v != "" {
+		header.Set("Content-Type", v)
+	}
+	if v := query.Get("response-content-disposition"); v != "" {
+		header.Set("Content-Disposition", v)
+	}
+	header.Set("Content-Length", strconv.FormatInt(encryption.DecryptedSize(info.Size), 10))
+	header.Set("ETag", `"`+info.ETag+`"`)
+	header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	// Headers are sent, a failure can only cut the response short.
+	if _, err := io.Copy(w, obj); err != nil {
+		e.logger.Errorf("failed to serve decrypted object, bucket=%s key=%s err=%v", bucket, key, err)
+	}
+}
+
+// RotateKey retires the active data key of user, new content of user is encrypted with a new data key.
+// Content encrypted with the retired key is still readable until ReencryptObjects re-encrypts it.
+func (e *Encryptor) RotateKey(ctx context.Context, userID uint64) error {
+	if !e.Enabled() {
+		return errEncryptionDisabled
+	}
+	sql := `
+		UPDATE data_keys
+		SET retired_at = NOW()
+		WHERE user_id = $1 AND retired_at IS NULL;
+	`
+	return e.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, userID)
+		return err
+	})
+}
+
+// RewrapKeys wraps data keys wrapped by other master keys with the active master key, returning how many are rewrapped.
+// It completes a master key rotation, after which the old master keys can be dropped.
+func (e *Encryptor) RewrapKeys(ctx context.Context) (int, error) {
+	if !e.Enabled() {
+		return 0, errEncryptionDisabled
+	}
+	selectSQL := `
+		SELECT id, master_key_id, wrapped_key
+		FROM data_keys
+		WHERE master_key_id <> $1
+		FOR UPDATE;
+	`
+	updateSQL := `
+		UPDATE data_keys
+		SET master_key_id = $1, wrapped_key = $2
+		WHERE id = $3;
+	`
+	type wrappedKey struct {
+		id       uint64
+		masterID string
+		wrapped  []byte
+	}
+	var n int
+	err := e.db.InTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, selectSQL, e.keyring.ActiveID())
+		if err != nil {
+			return err
+		}
+		var keys []wrappedKey
+		for rows.Next() {
+			var k wrappedKey
+			if err := rows.Scan(&k.id, &k.masterID, &k.wrapped); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			key, err := e.unwrap(k.id, k.masterID, k.wrapped)
+			if err != nil {
+				return err
+			}
+			masterID, wrapped, err := e.keyring.Wrap(key)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, updateSQL, masterID, wrapped, k.id); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,202 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/encryption"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// newTestEncryptor returns an Encryptor over memory storage with a data key of id 1 cached,
+// so that it never reaches database.
+func newTestEncryptor(t *testing.T) (*Encryptor, DataKey) {
+	t.Helper()
+	ctx := context.Background()
+	objects, err := storage.NewMemory(ctx, storage.ConfigOptions{
+		PublicURL:     "http://127.0.0.1/storage",
+		SigningSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := objects.PrepareBuckets(ctx, "all"); err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := encryption.NewKeyring(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := storage.NewSigner("http://127.0.0.1/content", keyring.Derive("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Encryptor{
+		logger:  zap.NewNop().Sugar(),
+		storage: objects,
+		keyring: keyring,
+		signer:  signer,
+		keys:    map[uint64][]byte{1: dataKey},
+	}
+	return e, DataKey{1, dataKey}
+}
+
+func TestEncryptorObjects(t *testing.T) {
+	ctx := context.Background()
+	e, dk := newTestEncryptor(t)
+	content := []byte("secret content")
+
+	if err := e.PutObject(ctx, "all", "encrypted", dk, bytes.NewReader(content), int64(len(content)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := e.storage.GetObject(ctx, "all", "encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	raw, _ := ioutil.ReadAll(stored)
+	if bytes.Contains(raw, content) {
+		t.Fatal("expect content stored encrypted")
+	}
+
+	obj, err := e.GetObject(ctx, "all", "encrypted", dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	got, err := ioutil.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("expect content %q, got %q", content, got)
+	}
+
+	// Plaintext content can't be read as encrypted, nor the other way around.
+	if err := e.PutObject(ctx, "all", "plaintext", DataKey{}, bytes.NewReader(content), int64(len(content)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	obj, err = e.GetObject(ctx, "all", "plaintext", dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if _, err := ioutil.ReadAll(obj); err == nil {
+		t.Fatal("expect plaintext content failing decryption")
+	}
+}
+
+func TestEncryptorServeHTTP(t *testing.T) {
+	ctx := context.Background()
+	e, dk := newTestEncryptor(t)
+	content := []byte("secret content")
+	if err := e.PutObject(ctx, "all", "blobs/a", dk, bytes.NewReader(content), int64(len(content)), storage.PutOptions{
+		ContentType: "text/plain",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(e.PathPrefix(), e)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(u *url.URL) *http.Response {
+		t.Helper()
+		u.Scheme, u.Host = "http", strings.TrimPrefix(server.URL, "http://")
+		resp, err := http.Get(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	u, err := e.PresignGet(ctx, "all", "blobs/a", dk.ID, time.Minute, url.Values{
+		"response-content-disposition": {`attachment; filename="a.txt"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := get(u)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect status 200, got %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("expect content %q, got %q", content, body)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="a.txt"` {
+		t.Fatalf("unexpected content disposition %q", got)
+	}
+	if resp.ContentLength != int64(len(content)) {
+		t.Fatalf("expect content length %d, got %d", len(content), resp.ContentLength)
+	}
+
+	// Key id is signed, so an url can't decrypt an object with another key.
+	tampered, _ := url.Parse(u.String())
+	query := tampered.Query()
+	query.Set(paramKeyID, "2")
+	tampered.RawQuery = query.Encode()
+	resp = get(tampered)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expect status 403 for tampered key id, got %d", resp.StatusCode)
+	}
+
+	u, err = e.PresignGet(ctx, "all", "blobs/missing", dk.ID, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = get(u)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expect status 404 for missing object, got %d", resp.StatusCode)
+	}
+}
+
+func TestPresignPlaintext(t *testing.T) {
+	e, _ := newTestEncryptor(t)
+	u, err := e.PresignGet(context.Background(), "all", "blobs/a", 0, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Path, "/storage/") {
+		t.Fatalf("expect plaintext content downloaded from storage, got %s", u)
+	}
+
+	disabled := &Encryptor{storage: e.storage}
+	if _, err := disabled.PresignGet(context.Background(), "all", "blobs/a", 1, time.Minute, nil); err == nil {
+		t.Fatal("expect encrypted content unavailable without master keys")
+	}
+}
+
+func TestThumbnailKey(t *testing.T) {
+	plain := thumbnailKey("u/1/a.png", 128, 0)
+	encrypted := thumbnailKey("u/1/a.png", 128, 3)
+	if plain == encrypted {
+		t.Fatal("expect thumbnails encrypted with different keys stored at different keys")
+	}
+	for _, k := range []string{plain, encrypted} {
+		if !strings.HasPrefix(k, thumbnailPrefix("u/1/a.png")) {
+			t.Fatalf("expect thumbnail key %s under thumbnail prefix", k)
+		}
+	}
+}
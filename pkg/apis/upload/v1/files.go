@@ -0,0 +1,382 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// File statuses.
+const (
+	// FileStatusPending is status of a file whose upload url is issued but upload is not confirmed.
+	FileStatusPending = "pending"
+	// FileStatusUploaded is status of a file whose object is verified in storage.
+	FileStatusUploaded = "uploaded"
+)
+
+// File is an object uploaded by a user.
+type File struct {
+	ID          uint64 `json:"id"`
+	Purpose     string `json:"purpose"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Checksum    string `json:"checksum"`
+	// SHA256 is content hash of an uploaded file computed by server.
+	SHA256 string `json:"sha256"`
+	Status string `json:"status"`
+	// ScanStatus is result of content scanning, a file is served only if it's clean.
+	ScanStatus string    `json:"scan_status"`
+	CreatedAt  time.Time `json:"created_at"`
+	// DeletedAt is when a file was moved to trash, it's nil unless the file is in trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// BlobKey is object key of the blob holding content of an uploaded file.
+	BlobKey string `json:"-"`
+	// KeyID is id of the data key content is encrypted with, 0 for plaintext.
+	KeyID uint64 `json:"-"`
+}
+
+// StorageKey returns object key holding file content in storage.
+func (f *File) StorageKey() string {
+	if f.BlobKey != "" {
+		return f.BlobKey
+	}
+	return f.Key
+}
+
+// errFileNotFound indicates a file doesn't exist or isn't owned by the user.
+var errFileNotFound = errors.New("file not found")
+
+// fileColumns are columns scanned by scanFile, selected from files f joined with blobs b.
+const fileColumns = `f.id, f.purpose, f.bucket, f.object_key, f.size, f.content_type, f.checksum,
+	COALESCE(b.sha256, ''), f.status, f.scan_status, f.created_at, f.deleted_at, COALESCE(b.object_key, ''), COALESCE(b.key_id, 0)`
+
+// fileTables are tables fileColumns are selected from.
+const fileTables = `files f LEFT JOIN blobs b ON b.id = f.blob_id`
+
+// fields returns scan destinations of fileColumns.
+func (f *File) fields() []interface{} {
+	return []interface{}{
+		&f.ID, &f.Purpose, &f.Bucket, &f.Key, &f.Size, &f.ContentType, &f.Checksum,
+		&f.SHA256, &f.Status, &f.ScanStatus, &f.CreatedAt, &f.DeletedAt, &f.BlobKey, &f.KeyID,
+	}
+}
+
+func scanFile(row pgx.Row) (*File, error) {
+	var f File
+	if err := row.Scan(f.fields()...); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ListFiles returns all files owned by user, except files in trash.
+func ListFiles(ctx context.Context, db database.Database, ownerID uint64) ([]File, error) {
+	return listFiles(ctx, db, ownerID, false)
+}
+
+// listFiles returns files owned by user, either in trash or not.
+func listFiles(ctx context.Context, db database.Database, ownerID uint64, trashed bool) ([]File, error) {
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT ` + fileColumns + `
+		FROM ` + fileTables + `
+		WHERE f.owner_id = $1 AND (f.deleted_at IS NOT NULL) = $2
+		ORDER BY f.id;
+	`
+	rows, err := conn.Query(ctx, sql, ownerID, trashed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, rows.Err()
+}
+
+// getFile returns a file owned by user, it returns errFileNotFound if user doesn't own it or it's in trash.
+// Its object key is checked to be in user's namespace as well, since handlers operate storage with it.
+func getFile(ctx context.Context, db database.Database, ownerID, id uint64) (*File, error) {
+	return queryFile(ctx, db, ownerID, id, false)
+}
+
+// queryFile returns a file owned by user either in trash or not, like getFile.
+func queryFile(ctx context.Context, db database.Database, ownerID, id uint64, trashed bool) (*File, error) {
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT ` + fileColumns + `
+		FROM ` + fileTables + `
+		WHERE f.id = $1 AND f.owner_id = $2 AND (f.deleted_at IS NOT NULL) = $3;
+	`
+	f, err := scanFile(conn.QueryRow(ctx, sql, id, ownerID, trashed))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckOwnership(ownerID, f.Key); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type files struct {
+	logger    *zap.SugaredLogger
+	amw       *auth.AuthenticationMiddleware
+	cache     cache.Cache
+	db        database.Database
+	storage   storage.ObjectStore
+	encryptor *Encryptor
+	config    ConfigOptions
+}
+
+func newFiles(
+	logger *zap.SugaredLogger,
+	amw *auth.AuthenticationMiddleware,
+	cache cache.Cache,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+) files {
+	return files{
+		logger,
+		amw,
+		cache,
+		db,
+		storage,
+		encryptor,
+		config,
+	}
+}
+
+// listFiles returns all files of user.
+func (f files) listFiles() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := f.amw.GetUserID(r)
+		list, err := ListFiles(r.Context(), f.db, userID)
+		if err != nil {
+			f.logger.Errorf("failed to list files, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, list)
+	}
+}
+
+// getFile returns a file of user.
+func (f files) getFile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, file)
+	}
+}
+
+// downloadFile returns a short-lived presigned download url of a file to its owner.
+func (f files) downloadFile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if file.Status != FileStatusUploaded {
+			httpx.FinalizeResponse(w, httpx.ErrUploadFileNotUploaded, nil)
+			return
+		}
+		if code := scanCode(file); code != httpx.Success {
+			httpx.FinalizeResponse(w, code, nil)
+			return
+		}
+
+		url, err := f.presignDownload(r.Context(), file, f.config.DownloadURLExpiration)
+		if err != nil {
+			f.logger.Errorf("failed to presign download url, id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, map[string]string{
+			"url": url,
+		})
+	}
+}
+
+// presignDownload returns a presigned url downloading file as an attachment.
+func (f files) presignDownload(ctx context.Context, file *File, expiration time.Duration) (string, error) {
+	reqParams := make(url.Values)
+	reqParams.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.Key)))
+	u, err := f.encryptor.PresignGet(ctx, file.Bucket, file.StorageKey(), file.KeyID, expiration, reqParams)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// deleteFile moves an uploaded file of user to trash, from which it can be restored until it's purged.
+// A pending file, or any file with query permanent=true, is destroyed at once.
+func (f files) deleteFile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if file.Status != FileStatusUploaded || r.URL.Query().Get("permanent") == "true" {
+			f.destroyFile(w, r, file)
+			return
+		}
+
+		sql := `
+			UPDATE files
+			SET deleted_at = NOW()
+			WHERE id = $1 AND deleted_at IS NULL;
+		`
+		if err := f.db.InTx(r.Context(), func(tx pgx.Tx) error {
+			_, err := tx.Exec(r.Context(), sql, file.ID)
+			return err
+		}); err != nil {
+			f.logger.Errorf("failed to trash file, id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, nil)
+	}
+}
+
+// destroyFile deletes file together with its content in storage and finalizes response.
+func (f files) destroyFile(w http.ResponseWriter, r *http.Request, file *File) {
+	err := destroyFile(r.Context(), f.logger, f.db, f.storage, file)
+	if errors.Is(err, errFileNotFound) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+		return
+	}
+	if err != nil {
+		f.logger.Errorf("failed to delete file, id=%d err=%v", file.ID, err)
+
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+		return
+	}
+
+	httpx.FinalizeResponse(w, httpx.Success, nil)
+}
+
+// destroyFile deletes a file together with its content in storage, it returns errFileNotFound
+// if the file is deleted, trashed or restored meanwhile.
+// Content shared with other files through a blob is kept until its last reference is released.
+func destroyFile(ctx context.Context, logger *zap.SugaredLogger, db database.Database, storage storage.ObjectStore, file *File) error {
+	// Remove object of a pending file first, so that a failure leaves a file record to retry deletion with.
+	// Removing a non-existing object succeeds.
+	if file.BlobKey == "" {
+		if err := storage.RemoveObject(ctx, file.Bucket, file.Key); err != nil {
+			return err
+		}
+	}
+
+	sql := `
+		DELETE FROM files
+		WHERE id = $1 AND deleted_at IS NOT DISTINCT FROM $2
+		RETURNING owner_id, status, size, blob_id;
+	`
+	if err := db.InTx(ctx, func(tx pgx.Tx) error {
+		var (
+			ownerID uint64
+			status  string
+			size    int64
+			blobID  *uint64
+		)
+		err := tx.QueryRow(ctx, sql, file.ID, file.DeletedAt).Scan(&ownerID, &status, &size, &blobID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errFileNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status == FileStatusUploaded {
+			if err := addUsage(ctx, tx, ownerID, -size, -1); err != nil {
+				return err
+			}
+		}
+		if blobID == nil {
+			return nil
+		}
+		return ReleaseBlobs(ctx, tx, []uint64{*blobID})
+	}); err != nil {
+		return err
+	}
+
+	// Thumbnails are removed once the file is gone, so that a file restored meanwhile keeps them.
+	// Failing to remove them only wastes space.
+	if err := RemoveThumbnails(ctx, storage, file.Bucket, file.Key); err != nil {
+		logger.Errorf("failed to remove thumbnails, bucket=%s key=%s err=%v", file.Bucket, file.Key, err)
+	}
+	return nil
+}
+
+// fileFromRequest returns the file addressed by request path owned by user.
+// If it returns false, response is already finalized.
+func (f files) fileFromRequest(w http.ResponseWriter, r *http.Request) (*File, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+		return nil, false
+	}
+
+	file, err := getFile(r.Context(), f.db, f.amw.GetUserID(r), id)
+	if errors.Is(err, errFileNotFound) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+		return nil, false
+	}
+	if errors.Is(err, ErrObjectNotOwned) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadObjectConflict, nil)
+		return nil, false
+	}
+	if err != nil {
+		f.logger.Errorf("failed to get file, id=%d err=%v", id, err)
+
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+		return nil, false
+	}
+	return file, true
+}
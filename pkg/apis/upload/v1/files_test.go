@@ -0,0 +1,23 @@
+package upload
+
+import "testing"
+
+func TestFileStorageKey(t *testing.T) {
+	key, err := objectKey(7, PurposeAttachment, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := File{Key: key}
+	if got := pending.StorageKey(); got != key {
+		t.Fatalf("expect pending file stored at its own key %s, got %s", key, got)
+	}
+
+	uploaded := File{Key: key, BlobKey: blobPrefix + "blob"}
+	if got := uploaded.StorageKey(); got != uploaded.BlobKey {
+		t.Fatalf("expect uploaded file stored at its blob key %s, got %s", uploaded.BlobKey, got)
+	}
+	if err := CheckOwnership(7, uploaded.BlobKey); err == nil {
+		t.Fatal("expect blob key outside of user namespace")
+	}
+}
@@ -0,0 +1,460 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/imaging"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// Image processing statuses.
+const (
+	// ImageStatusPending is status of an uploaded image waiting for processing.
+	ImageStatusPending = "pending"
+	// ImageStatusProcessing is status of an image claimed by a processor.
+	ImageStatusProcessing = "processing"
+	// ImageStatusProcessed is status of an image stripped of metadata with thumbnails generated.
+	ImageStatusProcessed = "processed"
+	// ImageStatusFailed is status of an upload which turned out not to be a supported image.
+	ImageStatusFailed = "failed"
+)
+
+// imageClaimTimeout is how long an image claimed by a processor which didn't finish it waits to be claimed again.
+const imageClaimTimeout = 10 * time.Minute
+
+// imageContentTypes are content types of uploads queued for image processing.
+var imageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// errInvalidImage indicates an uploaded file can't be processed as an image, retrying won't help.
+var errInvalidImage = errors.New("invalid image")
+
+// Image is processing result of an uploaded image.
+type Image struct {
+	Status     string      `json:"status"`
+	Width      int         `json:"width"`
+	Height     int         `json:"height"`
+	Error      string      `json:"error,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails"`
+}
+
+// Thumbnail is a scaled down copy of an image fitting in a size x size square.
+type Thumbnail struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+	key         string
+	keyID       uint64
+}
+
+// thumbnailPrefix is key prefix of thumbnails of an object.
+func thumbnailPrefix(key string) string {
+	return key + ".thumb."
+}
+
+// thumbnailKey is key of thumbnail of an object in size encrypted with data key of keyID.
+// Key id is part of the key of an encrypted thumbnail, so that re-encrypting it never overwrites one in use.
+func thumbnailKey(key string, size int, keyID uint64) string {
+	if keyID == 0 {
+		return fmt.Sprintf("%s%d", thumbnailPrefix(key), size)
+	}
+	return fmt.Sprintf("%s%d.k%d", thumbnailPrefix(key), size, keyID)
+}
+
+// RemoveThumbnails removes all thumbnails of an object.
+func RemoveThumbnails(ctx context.Context, s storage.ObjectStore, bucket, key string) error {
+	return s.RemovePrefix(ctx, bucket, thumbnailPrefix(key))
+}
+
+// queueImage queues a just uploaded file for image processing in tx if its content type is an image.
+func queueImage(ctx context.Context, tx pgx.Tx, fileID uint64, contentType string) error {
+	if !imageContentTypes[contentType] {
+		return nil
+	}
+	sql := `
+		INSERT INTO file_images (file_id, status)
+		VALUES ($1, $2)
+		ON CONFLICT (file_id) DO NOTHING;
+	`
+	_, err := tx.Exec(ctx, sql, fileID, ImageStatusPending)
+	return err
+}
+
+// getImage returns processing result of an image file of user.
+func (f files) getImage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		image, err := f.queryImage(r.Context(), file.ID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadNotImage, nil)
+			return
+		}
+		if err == nil {
+			err = f.presignThumbnails(r.Context(), file.Bucket, image.Thumbnails)
+		}
+		if err != nil {
+			f.logger.Errorf("failed to get image, file_id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, image)
+	}
+}
+
+// presignThumbnails fills in presigned download urls of thumbnails.
+func (f files) presignThumbnails(ctx context.Context, bucket string, thumbnails []Thumbnail) error {
+	for i := range thumbnails {
+		u, err := f.encryptor.PresignGet(ctx, bucket, thumbnails[i].key, thumbnails[i].keyID, f.config.DownloadURLExpiration, nil)
+		if err != nil {
+			return err
+		}
+		thumbnails[i].URL = u.String()
+	}
+	return nil
+}
+
+// queryImage is an helper for getImage.
+func (f files) queryImage(ctx context.Context, fileID uint64) (*Image, error) {
+	conn, err := f.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT status, width, height, error
+		FROM file_images
+		WHERE file_id = $1;
+	`
+	var image Image
+	if err := conn.QueryRow(ctx, sql, fileID).Scan(&image.Status, &image.Width, &image.Height, &image.Error); err != nil {
+		return nil, err
+	}
+
+	sql = `
+		SELECT size, width, height, content_type, object_key, key_id
+		FROM file_thumbnails
+		WHERE file_id = $1
+		ORDER BY size;
+	`
+	rows, err := conn.Query(ctx, sql, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	image.Thumbnails = []Thumbnail{}
+	for rows.Next() {
+		var t Thumbnail
+		if err := rows.Scan(&t.Size, &t.Width, &t.Height, &t.ContentType, &t.key, &t.keyID); err != nil {
+			return nil, err
+		}
+		image.Thumbnails = append(image.Thumbnails, t)
+	}
+	return &image, rows.Err()
+}
+
+// ImageProcessor strips metadata of uploaded images and generates their thumbnails.
+type ImageProcessor struct {
+	logger    *zap.SugaredLogger
+	db        database.Database
+	storage   storage.ObjectStore
+	encryptor *Encryptor
+	config    ImageOptions
+}
+
+// NewImageProcessor returns a new ImageProcessor.
+func NewImageProcessor(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+) ImageProcessor {
+	return ImageProcessor{
+		logger,
+		db,
+		storage,
+		encryptor,
+		config.Images,
+	}
+}
+
+// Process processes a batch of queued images.
+// It's meant to run periodically as a background job, concurrent processors claim different images.
+func (p ImageProcessor) Process(ctx context.Context) error {
+	ids, err := p.claimImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := p.processImage(ctx, id)
+		if err == nil {
+			p.logger.Debugf("Processed image, file_id=%d", id)
+			continue
+		}
+
+		// An invalid image fails for good, other errors are transient and image is queued again.
+		status, message := ImageStatusPending, ""
+		if errors.Is(err, errInvalidImage) {
+			status, message = ImageStatusFailed, err.Error()
+		}
+		p.logger.Errorf("failed to process image, file_id=%d err=%v", id, err)
+
+		sql := `
+			UPDATE file_images
+			SET status = $1, error = $2
+			WHERE file_id = $3;
+		`
+		if err := p.db.InTx(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, sql, status, message, id)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimImages marks a batch of queued images, or images whose processor went away, processing.
+// Only images scanned clean are processed, so that derived content never comes from quarantined files.
+func (p ImageProcessor) claimImages(ctx context.Context) ([]uint64, error) {
+	sql := `
+		UPDATE file_images
+		SET status = $1
+		WHERE file_id IN (
+			SELECT i.file_id FROM file_images i
+			JOIN files f ON f.id = i.file_id
+			WHERE (i.status = $2 OR (i.status = $1 AND i.updated_at < $3)) AND f.scan_status = $5
+			ORDER BY i.file_id
+			LIMIT $4
+			FOR UPDATE OF i SKIP LOCKED
+		)
+		RETURNING file_id;
+	`
+	var ids []uint64
+	err := p.db.InTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, sql, ImageStatusProcessing, ImageStatusPending, time.Now().Add(-imageClaimTimeout), p.config.BatchSize, ScanStatusClean)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+// imageFile is an uploaded file being processed as an image.
+type imageFile struct {
+	File
+	ownerID uint64
+	blobID  *uint64
+}
+
+// processImage strips metadata of an image file, replacing its content, and generates its thumbnails.
+func (p ImageProcessor) processImage(ctx context.Context, fileID uint64) error {
+	sql := `
+		SELECT ` + fileColumns + `, f.owner_id, f.blob_id
+		FROM ` + fileTables + `
+		WHERE f.id = $1 AND f.status = $2;
+	`
+	var f imageFile
+	err := func() error {
+		conn, err := p.db.Pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+
+		return conn.QueryRow(ctx, sql, fileID, FileStatusUploaded).Scan(
+			append(f.fields(), &f.ownerID, &f.blobID)...,
+		)
+	}()
+	// File is deleted meanwhile, its image row is gone with it.
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	obj, err := p.encryptor.GetObject(ctx, f.Bucket, f.StorageKey(), f.KeyID)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(io.LimitReader(obj, f.Size+1))
+	if err != nil {
+		return err
+	}
+
+	info, err := imaging.Inspect(data, p.config.MaxPixels)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	stripped, err := imaging.StripMetadata(info.Format, data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	img, err := imaging.Decode(stripped)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	// Derived content is encrypted with the active data key of owner, like new uploads.
+	dk, err := p.encryptor.DataKey(ctx, f.ownerID)
+	if err != nil {
+		return err
+	}
+
+	thumbnails := make([]Thumbnail, 0, len(p.config.ThumbnailSizes))
+	for _, size := range p.config.ThumbnailSizes {
+		thumb := imaging.Thumbnail(img, size)
+		var buf bytes.Buffer
+		contentType, err := imaging.EncodeThumbnail(&buf, thumb, info.Format)
+		if err != nil {
+			return err
+		}
+		t := Thumbnail{
+			Size:        size,
+			Width:       thumb.Bounds().Dx(),
+			Height:      thumb.Bounds().Dy(),
+			ContentType: contentType,
+			key:         thumbnailKey(f.Key, size, dk.ID),
+			keyID:       dk.ID,
+		}
+		if err := p.encryptor.PutObject(ctx, f.Bucket, t.key, dk, &buf, int64(buf.Len()), storage.PutOptions{
+			ContentType: contentType,
+		}); err != nil {
+			return err
+		}
+		thumbnails = append(thumbnails, t)
+	}
+
+	if !bytes.Equal(stripped, data) || f.ContentType != imaging.ContentType(info.Format) {
+		if err := p.replaceContent(ctx, &f, dk, stripped, imaging.ContentType(info.Format)); err != nil {
+			return err
+		}
+	}
+
+	imageSQL := `
+		UPDATE file_images
+		SET status = $1, width = $2, height = $3, error = ''
+		WHERE file_id = $4;
+	`
+	thumbnailSQL := `
+		INSERT INTO file_thumbnails (file_id, size, width, height, content_type, object_key, key_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (file_id, size) DO UPDATE
+		SET width = EXCLUDED.width, height = EXCLUDED.height, content_type = EXCLUDED.content_type,
+			object_key = EXCLUDED.object_key, key_id = EXCLUDED.key_id;
+	`
+	bounds := img.Bounds()
+	return p.db.InTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, imageSQL, ImageStatusProcessed, bounds.Dx(), bounds.Dy(), fileID); err != nil {
+			return err
+		}
+		for _, t := range thumbnails {
+			if _, err := tx.Exec(ctx, thumbnailSQL, fileID, t.Size, t.Width, t.Height, t.ContentType, t.key, t.keyID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replaceContent replaces content of a file with data stored in a blob of its own encrypted with dk,
+// releasing the blob of old content. Storage usage of the owner is adjusted by the size difference.
+func (p ImageProcessor) replaceContent(ctx context.Context, f *imageFile, dk DataKey, data []byte, contentType string) error {
+	blobKey := blobPrefix + uuid.NewV4().String()
+	if err := p.encryptor.PutObject(ctx, f.Bucket, blobKey, dk, bytes.NewReader(data), int64(len(data)), storage.PutOptions{
+		ContentType: contentType,
+	}); err != nil {
+		return err
+	}
+	sha := sha256.Sum256(data)
+	md := md5.Sum(data)
+	size := int64(len(data))
+
+	var created bool
+	// File must still reference the old content, otherwise it's changed meanwhile.
+	sql := `
+		UPDATE files
+		SET size = $1, content_type = $2, checksum = $3, blob_id = $4
+		WHERE id = $5 AND blob_id IS NOT DISTINCT FROM $6;
+	`
+	err := p.db.InTx(ctx, func(tx pgx.Tx) error {
+		var (
+			blobID uint64
+			err    error
+		)
+		blobID, created, err = referenceBlob(ctx, tx, f.Bucket, blobKey, hex.EncodeToString(sha[:]), size, dk.ID)
+		if err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, sql, size, contentType, hex.EncodeToString(md[:]), blobID, f.ID, f.blobID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("file %d changed while processing", f.ID)
+		}
+		if f.blobID != nil {
+			if err := ReleaseBlobs(ctx, tx, []uint64{*f.blobID}); err != nil {
+				return err
+			}
+		}
+		return addUsage(ctx, tx, f.ownerID, size-f.Size, 0)
+	})
+
+	// Failing to remove objects only wastes space.
+	var garbage []string
+	if err != nil || !created {
+		garbage = append(garbage, blobKey)
+	}
+	// Content of a file uploaded before deduplication is at its own key.
+	if err == nil && f.blobID == nil {
+		garbage = append(garbage, f.Key)
+	}
+	for _, k := range garbage {
+		if err := p.storage.RemoveObject(ctx, f.Bucket, k); err != nil {
+			p.logger.Errorf("failed to remove object, bucket=%s key=%s err=%v", f.Bucket, k, err)
+		}
+	}
+	return err
+}
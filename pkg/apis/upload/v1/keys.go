@@ -0,0 +1,54 @@
+package upload
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
+)
+
+// ErrObjectNotOwned indicates an object key is outside of a user's namespace.
+var ErrObjectNotOwned = errors.New("object not owned by user")
+
+// UserPrefix returns key prefix of all objects of user.
+// User id is confused so that object keys don't reveal it.
+func UserPrefix(userID uint64) (string, error) {
+	forgedID, err := confuse.EncodeID(userID)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(forgedID, 10) + "/", nil
+}
+
+// objectPrefix returns key prefix of user's objects of purpose.
+func objectPrefix(userID uint64, purpose string) (string, error) {
+	prefix, err := UserPrefix(userID)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(prefix, purpose) + "/", nil
+}
+
+// objectKey derives object key of a file server side as {user}/{purpose}/{id}.
+func objectKey(userID uint64, purpose string, fileID uint64) (string, error) {
+	prefix, err := objectPrefix(userID, purpose)
+	if err != nil {
+		return "", err
+	}
+	return prefix + strconv.FormatUint(fileID, 10), nil
+}
+
+// CheckOwnership returns ErrObjectNotOwned if key is not in user's namespace.
+// It must be called before every storage operation on behalf of a user.
+func CheckOwnership(userID uint64, key string) error {
+	prefix, err := UserPrefix(userID)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(key, prefix) || path.Clean(key) != key {
+		return ErrObjectNotOwned
+	}
+	return nil
+}
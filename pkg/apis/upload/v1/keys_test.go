@@ -0,0 +1,51 @@
+package upload
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestObjectPrefix(t *testing.T) {
+	prefix, err := objectPrefix(7, PurposeAvatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(prefix, "/"+PurposeAvatar+"/") {
+		t.Fatalf("expect prefix ending with purpose, got %s", prefix)
+	}
+	if strings.HasPrefix(prefix, "7/") {
+		t.Fatalf("expect user id confused in prefix, got %s", prefix)
+	}
+
+	other, err := objectPrefix(8, PurposeAvatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == prefix {
+		t.Fatal("expect different users have different prefixes")
+	}
+}
+
+func TestCheckOwnership(t *testing.T) {
+	key, err := objectKey(7, PurposeAttachment, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(key, "/"+PurposeAttachment+"/42") {
+		t.Fatalf("expect key ending with purpose and file id, got %s", key)
+	}
+	if err := CheckOwnership(7, key); err != nil {
+		t.Fatalf("expect user owns key %s, got %v", key, err)
+	}
+	if err := CheckOwnership(8, key); err != ErrObjectNotOwned {
+		t.Fatalf("expect another user doesn't own key %s, got %v", key, err)
+	}
+
+	prefix, err := UserPrefix(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckOwnership(7, prefix+"../escaped"); err != ErrObjectNotOwned {
+		t.Fatalf("expect key escaping namespace not owned, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package upload
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/williamlsh/orchid/pkg/apis/internal/confuse"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// eventObjectCreated is prefix of names of S3 events of created objects, e.g. s3:ObjectCreated:Put.
+const eventObjectCreated = "s3:ObjectCreated:"
+
+// bucketEvent is an S3 bucket notification, as MinIO webhook targets post it.
+type bucketEvent struct {
+	Records []eventRecord `json:"Records"`
+}
+
+// eventRecord is a record of a bucket notification.
+type eventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			// Key is URL encoded.
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// NotificationsGroup groups routers of storage bucket notifications, they are authenticated by a static token.
+// Nothing is routed if no token is configured.
+func NotificationsGroup(
+	logger *zap.SugaredLogger,
+	cache cache.Cache,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+	r *mux.Router,
+) {
+	if config.Notifications.Token == "" {
+		return
+	}
+	r.Use(notificationAuth(config.Notifications.Token))
+
+	uploader := newUploader(logger, nil, cache, db, storage, encryptor, config)
+
+	r.HandleFunc("/events", uploader.receiveEvents()).
+		Methods(http.MethodPost)
+}
+
+// notificationAuth returns a middleware authenticating requests bearing token in Authorization header.
+func notificationAuth(token string) mux.MiddlewareFunc {
+	// MinIO sends its webhook auth token as is if it contains a space, otherwise as a bearer token.
+	expected := "Bearer " + token
+	if strings.Contains(token, " ") {
+		expected = token
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// receiveEvents registers uploads of created objects notified by storage, so that an upload is
+// complete even if client never confirms it. It responds an error status only if events should be
+// redelivered, registering an upload twice is harmless.
+func (u uploader) receiveEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var event bucketEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, "invalid bucket notification", http.StatusBadRequest)
+			return
+		}
+
+		for _, record := range event.Records {
+			if !strings.HasPrefix(record.EventName, eventObjectCreated) || record.S3.Bucket.Name != u.config.Bucket {
+				continue
+			}
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				continue
+			}
+			if err := u.registerUpload(r.Context(), record.S3.Bucket.Name, key); err != nil {
+				u.logger.Errorf("failed to register notified upload, bucket=%s key=%s err=%v", record.S3.Bucket.Name, key, err)
+
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// registerUpload commits a pending file uploaded to key through a presigned post policy.
+// Objects which aren't such uploads, e.g. blobs, thumbnails or parts of upload sessions, which
+// orchid completes itself, are ignored.
+func (u uploader) registerUpload(ctx context.Context, bucket, key string) error {
+	ownerID, fileID, ok := parseObjectKey(key)
+	if !ok {
+		return nil
+	}
+	file, err := getFile(ctx, u.db, ownerID, fileID)
+	if errors.Is(err, errFileNotFound) || errors.Is(err, ErrObjectNotOwned) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file.Bucket != bucket || file.Key != key || file.Status != FileStatusPending || file.Checksum == "" {
+		return nil
+	}
+
+	info, err := u.storage.StatObject(ctx, bucket, key)
+	// Upload is confirmed by client meanwhile.
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Client is told about a mismatch when it confirms the upload, the file is left pending till then.
+	if strings.Trim(info.ETag, `"`) != file.Checksum {
+		u.logger.Warnf("Notified upload checksum mismatch, id=%d key=%s", file.ID, key)
+		return nil
+	}
+
+	err = u.commitUpload(ctx, file.ID, bucket, key, file.Checksum, info)
+	if errors.Is(err, errFileNotPending) || errors.Is(err, storage.ErrObjectNotFound) {
+		return nil
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		u.logger.Warnf("Notified upload exceeds quota, id=%d owner=%d key=%s", file.ID, ownerID, key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	u.logger.Debugf("Registered notified upload, id=%d owner=%d key=%s", file.ID, ownerID, key)
+	return nil
+}
+
+// parseObjectKey returns owner and file id of an object key derived by objectKey.
+func parseObjectKey(key string) (ownerID, fileID uint64, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	forgedID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	ownerID, err = confuse.DecodeID(forgedID)
+	if err != nil {
+		return 0, 0, false
+	}
+	fileID, err = strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	// Keys are derived one way, anything else isn't an upload.
+	if derived, err := objectKey(ownerID, parts[1], fileID); err != nil || derived != key {
+		return 0, 0, false
+	}
+	return ownerID, fileID, true
+}
@@ -0,0 +1,73 @@
+package upload
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"go.uber.org/zap"
+)
+
+func TestParseObjectKey(t *testing.T) {
+	key, err := objectKey(42, PurposeAttachment, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerID, fileID, ok := parseObjectKey(key)
+	if !ok || ownerID != 42 || fileID != 7 {
+		t.Fatalf("expect owner 42 and file 7, got %d %d %v", ownerID, fileID, ok)
+	}
+
+	for _, k := range []string{
+		blobPrefix + "0b9c2625-dc21-4ad1-8ac3-4d7c3b6e1f4e",
+		thumbnailKey(key, 128, 0),
+		key + "/extra",
+		"18446744073709551615/" + PurposeAttachment + "/7",
+		strings.Replace(key, "/7", "/x", 1),
+	} {
+		if _, _, ok := parseObjectKey(k); ok {
+			t.Errorf("expect key %s not parsed as an upload", k)
+		}
+	}
+}
+
+func TestNotificationsGroup(t *testing.T) {
+	r := mux.NewRouter()
+	NotificationsGroup(zap.NewNop().Sugar(), &cache.Redis{}, database.Database{}, nil, nil, ConfigOptions{
+		Bucket:        "all",
+		Notifications: NotificationOptions{Token: "secret"},
+	}, r)
+
+	// Records aren't uploads to the upload bucket, so they are acknowledged without reaching database.
+	ignored := `{"Records": [
+		{"eventName": "s3:ObjectRemoved:Delete", "s3": {"bucket": {"name": "all"}, "object": {"key": "1/attachment/1"}}},
+		{"eventName": "s3:ObjectCreated:Put", "s3": {"bucket": {"name": "exports"}, "object": {"key": "1/attachment/1"}}},
+		{"eventName": "s3:ObjectCreated:Copy", "s3": {"bucket": {"name": "all"}, "object": {"key": "blobs%2Fa"}}}
+	]}`
+	cases := []struct {
+		name, auth, body string
+		status           int
+	}{
+		{"no token", "", ignored, http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", ignored, http.StatusUnauthorized},
+		{"invalid body", "Bearer secret", "{", http.StatusBadRequest},
+		{"ignored records", "Bearer secret", ignored, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(c.body))
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != c.status {
+				t.Fatalf("expect status %d, got %d", c.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// checksumRegexp matches a hex encoded MD5 checksum, which S3 reports as ETag of a single part upload.
+var checksumRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type uploader struct {
+	logger    *zap.SugaredLogger
+	amw       *auth.AuthenticationMiddleware
+	cache     cache.Cache
+	db        database.Database
+	storage   storage.ObjectStore
+	encryptor *Encryptor
+	config    ConfigOptions
+}
+
+func newUploader(
+	logger *zap.SugaredLogger,
+	amw *auth.AuthenticationMiddleware,
+	cache cache.Cache,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+) uploader {
+	return uploader{
+		logger,
+		amw,
+		cache,
+		db,
+		storage,
+		encryptor,
+		config,
+	}
+}
+
+// policyRequest is request body of getPresignedPostPolicy.
+type policyRequest struct {
+	Purpose     string `json:"purpose"`
+	Checksum    string `json:"checksum"`
+	ContentType string `json:"content_type"`
+}
+
+// getPresignedPostPolicy returns a presigned post policy to client,
+// so client can perform an HTTP multipart form post request to store an object file.
+// The policy constrains object key, size and content type according to upload purpose.
+func (u uploader) getPresignedPostPolicy() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody policyRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		purpose, ok := u.config.Purposes[reqBody.Purpose]
+		if !ok {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPurpose, nil)
+			return
+		}
+		contentType := strings.ToLower(strings.TrimSpace(reqBody.ContentType))
+		if contentType == "" || !purpose.allows(contentType) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidContentType, nil)
+			return
+		}
+		checksum := strings.ToLower(strings.TrimSpace(reqBody.Checksum))
+		if checksum == "" {
+			httpx.FinalizeResponse(w, httpx.ErrUploadEmptyChecksum, nil)
+			return
+		}
+		if !checksumRegexp.MatchString(checksum) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidChecksum, nil)
+			return
+		}
+
+		userID := u.amw.GetUserID(r)
+		usage, err := GetUsage(r.Context(), u.db, userID, u.config.Quota)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		// Object size is unknown until upload, the policy limits it to what's left in quota.
+		if !usage.allows(1) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+
+		fileID, key, err := u.registerFile(r.Context(), userID, reqBody.Purpose, checksum)
+		if err != nil {
+			u.logger.Errorf("failed to register file, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		prefix, err := objectPrefix(userID, reqBody.Purpose)
+		if err != nil {
+			u.logger.Errorf("failed to get object prefix, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		url, formData, err := u.presignPostPolicy(r.Context(), prefix, key, contentType, usage.limitSize(purpose.MaxSize))
+		if err != nil {
+			u.logger.Errorf("failed to get presigned post policy: %v", err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, map[string]interface{}{
+			"url":       url,
+			"form_data": formData,
+			"file_id":   fileID,
+			"key":       key,
+		})
+	})
+}
+
+// presignPostPolicy is an helper for getPresignedPostPolicy.
+func (u uploader) presignPostPolicy(ctx context.Context, prefix, key, contentType string, maxSize int64) (string, map[string]string, error) {
+	url, formData, err := u.storage.PresignPost(ctx, storage.PostPolicy{
+		Bucket: u.config.Bucket,
+		Key:    key,
+		// The key is fixed, prefix condition guards against the key ever leaving user's namespace.
+		KeyPrefix:   prefix,
+		ContentType: contentType,
+		MinSize:     1,
+		MaxSize:     maxSize,
+		Expires:     time.Now().Add(u.config.PolicyExpiration),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return url.String(), formData, nil
+}
+
+// registerFile records a pending file of user before its object is uploaded,
+// the object key is derived from the new file id.
+func (u uploader) registerFile(ctx context.Context, userID uint64, purpose, checksum string) (fileID uint64, key string, err error) {
+	sql := `
+		INSERT INTO files (id, owner_id, purpose, bucket, object_key, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`
+	err = u.db.InTx(ctx, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `SELECT nextval(pg_get_serial_sequence('files', 'id'));`).Scan(&fileID); err != nil {
+			return err
+		}
+		key, err = objectKey(userID, purpose, fileID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, sql, fileID, userID, purpose, u.config.Bucket, key, checksum)
+		return err
+	})
+	return
+}
+
+// completeUpload verifies an uploaded object exists in storage and matches its checksum,
+// then marks its file uploaded.
+func (u uploader) completeUpload() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			FileID uint64 `json:"file_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+
+		userID := u.amw.GetUserID(r)
+		file, err := getFile(r.Context(), u.db, userID, reqBody.FileID)
+		if errors.Is(err, errFileNotFound) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+			return
+		}
+		if errors.Is(err, ErrObjectNotOwned) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadObjectConflict, nil)
+			return
+		}
+		if err != nil {
+			u.logger.Errorf("failed to get file, id=%d err=%v", reqBody.FileID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		// Upload is registered by a bucket notification already.
+		if file.Status == FileStatusUploaded {
+			httpx.FinalizeResponse(w, httpx.Success, file)
+			return
+		}
+
+		info, err := u.storage.StatObject(r.Context(), file.Bucket, file.Key)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotFound) {
+				httpx.FinalizeResponse(w, httpx.ErrUploadObjectNotFound, nil)
+				return
+			}
+			u.logger.Errorf("failed to stat object, bucket=%s key=%s err=%v", file.Bucket, file.Key, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if strings.Trim(info.ETag, `"`) != file.Checksum {
+			httpx.FinalizeResponse(w, httpx.ErrUploadChecksumMismatch, nil)
+			return
+		}
+
+		err = u.commitUpload(r.Context(), file.ID, file.Bucket, file.Key, file.Checksum, info)
+		if errors.Is(err, errQuotaExceeded) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+		if err != nil && !errors.Is(err, errFileNotPending) {
+			u.logger.Errorf("failed to complete file upload, id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		file, err = getFile(r.Context(), u.db, userID, file.ID)
+		if err != nil {
+			u.logger.Errorf("failed to get file, id=%d err=%v", reqBody.FileID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, file)
+	})
+}
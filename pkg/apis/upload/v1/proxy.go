@@ -0,0 +1,253 @@
+package upload
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/storage"
+)
+
+// In proxy mode content is uploaded and downloaded through orchid, for deployments where storage
+// isn't reachable by clients and presigned urls are useless.
+
+// proxyUpload stores an object streamed in request body as a file of purpose in query,
+// its content type is the request Content-Type. If Content-MD5 is present, content is verified
+// against it as it's stored. The file is uploaded once the response is received.
+func (u uploader) proxyUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		purposeName := r.URL.Query().Get("purpose")
+		purpose, ok := u.config.Purposes[purposeName]
+		if !ok {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPurpose, nil)
+			return
+		}
+		contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !purpose.allows(contentType) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidContentType, nil)
+			return
+		}
+		var expected []byte
+		if v := r.Header.Get("Content-MD5"); v != "" {
+			expected, err = base64.StdEncoding.DecodeString(v)
+			if err != nil || len(expected) != md5.Size {
+				httpx.FinalizeResponse(w, httpx.ErrUploadInvalidChecksum, nil)
+				return
+			}
+		}
+
+		userID := u.amw.GetUserID(r)
+		usage, err := GetUsage(r.Context(), u.db, userID, u.config.Quota)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if !usage.allows(1) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+		// Size of a chunked body is unknown until it's read, it's limited as it's stored.
+		limit := usage.limitSize(purpose.MaxSize)
+		if r.ContentLength > limit {
+			httpx.FinalizeResponse(w, httpx.ErrUploadTooLarge, nil)
+			return
+		}
+
+		// Checksum is filled on commit, so that bucket notifications leave the file to this request.
+		fileID, key, err := u.registerFile(r.Context(), userID, purposeName, "")
+		if err != nil {
+			u.logger.Errorf("failed to register file, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		code, err := u.storeProxiedUpload(r, fileID, key, contentType, expected, limit)
+		if err != nil {
+			u.logger.Errorf("failed to store proxied upload, id=%d err=%v", fileID, err)
+		}
+		if code != httpx.Success {
+			file := &File{ID: fileID, Bucket: u.config.Bucket, Key: key}
+			if err := destroyFile(r.Context(), u.logger, u.db, u.storage, file); err != nil {
+				u.logger.Errorf("failed to discard proxied upload, id=%d err=%v", fileID, err)
+			}
+
+			httpx.FinalizeResponse(w, code, nil)
+			return
+		}
+
+		file, err := getFile(r.Context(), u.db, userID, fileID)
+		if err != nil {
+			u.logger.Errorf("failed to get file, id=%d err=%v", fileID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, file)
+	}
+}
+
+// storeProxiedUpload stores request body of at most limit bytes at key and commits file upload,
+// it returns the code to respond and an error worth logging, if any.
+func (u uploader) storeProxiedUpload(r *http.Request, fileID uint64, key, contentType string, expected []byte, limit int64) (httpx.Code, error) {
+	h := md5.New()
+	body := &countingReader{r: io.LimitReader(r.Body, limit+1)}
+	if _, err := u.storage.PutObject(r.Context(), u.config.Bucket, key, io.TeeReader(body, h), r.ContentLength, storage.PutOptions{
+		ContentType: contentType,
+	}); err != nil {
+		return httpx.ErrServiceUnavailable, err
+	}
+	if body.n > limit {
+		return httpx.ErrUploadTooLarge, nil
+	}
+	if body.n == 0 {
+		return httpx.ErrUploadSizeMismatch, nil
+	}
+	sum := h.Sum(nil)
+	if expected != nil && string(sum) != string(expected) {
+		return httpx.ErrUploadChecksumMismatch, nil
+	}
+
+	info, err := u.storage.StatObject(r.Context(), u.config.Bucket, key)
+	if err != nil {
+		return httpx.ErrServiceUnavailable, err
+	}
+	err = u.commitUpload(r.Context(), fileID, u.config.Bucket, key, hex.EncodeToString(sum), info)
+	if errors.Is(err, errQuotaExceeded) {
+		return httpx.ErrUploadQuotaExceeded, nil
+	}
+	if err != nil {
+		return httpx.ErrServiceUnavailable, err
+	}
+	return httpx.Success, nil
+}
+
+// fileContent streams content of a file of user, supporting conditional and range requests.
+// ETag of content is its SHA-256, which is stable however content is stored.
+func (f files) fileContent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if file.Status != FileStatusUploaded {
+			httpx.FinalizeResponse(w, httpx.ErrUploadFileNotUploaded, nil)
+			return
+		}
+		if code := scanCode(file); code != httpx.Success {
+			httpx.FinalizeResponse(w, code, nil)
+			return
+		}
+
+		// Encrypted content is larger in storage.
+		storedSize := file.Size
+		if file.KeyID != 0 {
+			info, err := f.storage.StatObject(r.Context(), file.Bucket, file.StorageKey())
+			if err != nil {
+				f.logger.Errorf("failed to stat object, bucket=%s key=%s err=%v", file.Bucket, file.StorageKey(), err)
+
+				httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+				return
+			}
+			storedSize = info.Size
+		}
+
+		etag := file.SHA256
+		if etag == "" {
+			etag = file.Checksum
+		}
+		header := w.Header()
+		header.Set("ETag", `"`+etag+`"`)
+		header.Set("Content-Type", file.ContentType)
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.Key)))
+
+		content := &objectReader{
+			ctx:        r.Context(),
+			encryptor:  f.encryptor,
+			bucket:     file.Bucket,
+			key:        file.StorageKey(),
+			keyID:      file.KeyID,
+			storedSize: storedSize,
+			size:       file.Size,
+		}
+		defer content.Close()
+		http.ServeContent(w, r, "", file.CreatedAt, content)
+		if content.err != nil {
+			f.logger.Errorf("failed to serve file content, id=%d err=%v", file.ID, content.err)
+		}
+	}
+}
+
+// objectReader reads content of an object from storage as an io.ReadSeeker, a seek reopens
+// content at the new offset, so that a range is read from storage only.
+type objectReader struct {
+	ctx         context.Context
+	encryptor   *Encryptor
+	bucket, key string
+	keyID       uint64
+	// storedSize is size of the object in storage, size is size of its content.
+	storedSize, size int64
+
+	offset int64
+	rc     io.ReadCloser
+	// err is the first error reading storage.
+	err error
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.rc == nil {
+		rc, err := o.encryptor.GetObjectRange(o.ctx, o.bucket, o.key, o.keyID, o.storedSize, o.offset, o.size-o.offset)
+		if err != nil {
+			o.err = err
+			return 0, err
+		}
+		o.rc = rc
+	}
+	n, err := o.rc.Read(p)
+	o.offset += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && o.err == nil {
+		o.err = err
+	}
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes content being read, if any.
+func (o *objectReader) Close() error {
+	if o.rc == nil {
+		return nil
+	}
+	err := o.rc.Close()
+	o.rc = nil
+	return err
+}
@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/storage"
+)
+
+func TestObjectReader(t *testing.T) {
+	ctx := context.Background()
+	e, dk := newTestEncryptor(t)
+	content := make([]byte, 200<<10)
+	rand.Read(content)
+
+	for name, dk := range map[string]DataKey{"plaintext": {}, "encrypted": dk} {
+		t.Run(name, func(t *testing.T) {
+			if err := e.PutObject(ctx, "all", name, dk, bytes.NewReader(content), int64(len(content)), storage.PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := e.storage.StatObject(ctx, "all", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serve := func(header http.Header) *httptest.ResponseRecorder {
+				t.Helper()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header = header
+				w := httptest.NewRecorder()
+				w.Header().Set("ETag", `"sum"`)
+				o := &objectReader{
+					ctx:        ctx,
+					encryptor:  e,
+					bucket:     "all",
+					key:        name,
+					keyID:      dk.ID,
+					storedSize: info.Size,
+					size:       int64(len(content)),
+				}
+				defer o.Close()
+				http.ServeContent(w, r, "", time.Now(), o)
+				if o.err != nil {
+					t.Fatal(o.err)
+				}
+				return w
+			}
+
+			w := serve(http.Header{})
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+				t.Fatalf("expect whole content, got status %d and %d bytes", w.Code, w.Body.Len())
+			}
+
+			// The range spans two segments of encrypted content.
+			w = serve(http.Header{"Range": {"bytes=65530-65545"}})
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[65530:65546]) {
+				t.Fatalf("expect partial content, got status %d", w.Code)
+			}
+			w = serve(http.Header{"Range": {"bytes=-10"}})
+			if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[len(content)-10:]) {
+				t.Fatalf("expect content suffix, got status %d", w.Code)
+			}
+
+			w = serve(http.Header{"If-None-Match": {`"sum"`}})
+			if w.Code != http.StatusNotModified {
+				t.Fatalf("expect status 304, got %d", w.Code)
+			}
+		})
+	}
+}
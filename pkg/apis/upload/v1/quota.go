@@ -0,0 +1,239 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/encryption"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// errQuotaExceeded indicates an upload to commit doesn't fit in quota of its owner.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// Quota limits storage a user can consume, a zero limit means unlimited.
+type Quota struct {
+	// MaxBytes is the maximum total size in bytes of uploaded files.
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxObjects is the maximum number of uploaded files.
+	MaxObjects int64 `json:"max_objects"`
+}
+
+// Usage is storage consumed by a user together with the user's quota.
+// Only uploaded files are accounted, content shared through a blob counts for every file referencing it.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+	Quota
+}
+
+// allows reports whether one more object of size bytes fits in quota.
+func (u Usage) allows(size int64) bool {
+	return (u.MaxObjects == 0 || u.Objects+1 <= u.MaxObjects) &&
+		(u.MaxBytes == 0 || u.Bytes+size <= u.MaxBytes)
+}
+
+// limitSize returns the largest size in bytes up to maxSize which fits in quota.
+func (u Usage) limitSize(maxSize int64) int64 {
+	if u.MaxBytes == 0 {
+		return maxSize
+	}
+	if left := u.MaxBytes - u.Bytes; left < maxSize {
+		return left
+	}
+	return maxSize
+}
+
+// GetUsage returns storage usage of user, quota overrides of user take precedence over defaults.
+func GetUsage(ctx context.Context, db database.Database, userID uint64, defaults Quota) (*Usage, error) {
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT bytes, objects, COALESCE(max_bytes, $2), COALESCE(max_objects, $3)
+		FROM storage_usage
+		WHERE user_id = $1;
+	`
+	var u Usage
+	err = conn.QueryRow(ctx, sql, userID, defaults.MaxBytes, defaults.MaxObjects).
+		Scan(&u.Bytes, &u.Objects, &u.MaxBytes, &u.MaxObjects)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Usage{Quota: defaults}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetQuota overrides default quota of user, a nil quota restores defaults.
+func SetQuota(ctx context.Context, db database.Database, userID uint64, quota *Quota) error {
+	sql := `
+		INSERT INTO storage_usage (user_id, max_bytes, max_objects)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET max_bytes = EXCLUDED.max_bytes, max_objects = EXCLUDED.max_objects;
+	`
+	var maxBytes, maxObjects *int64
+	if quota != nil {
+		maxBytes, maxObjects = &quota.MaxBytes, &quota.MaxObjects
+	}
+	return db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, userID, maxBytes, maxObjects)
+		return err
+	})
+}
+
+// addUsage accounts bytes and objects to usage of user in tx, negative values release usage.
+func addUsage(ctx context.Context, tx pgx.Tx, userID uint64, bytes, objects int64) error {
+	sql := `
+		INSERT INTO storage_usage (user_id, bytes, objects)
+		VALUES ($1, GREATEST($2, 0), GREATEST($3, 0))
+		ON CONFLICT (user_id) DO UPDATE
+		SET bytes = GREATEST(storage_usage.bytes + $2, 0),
+			objects = GREATEST(storage_usage.objects + $3, 0);
+	`
+	_, err := tx.Exec(ctx, sql, userID, bytes, objects)
+	return err
+}
+
+// chargeUsage accounts bytes and objects to usage of user in tx like addUsage,
+// but returns errQuotaExceeded leaving usage untouched if they don't fit in quota of user.
+// Concurrent charges of a user are serialized by the row lock of the update.
+func chargeUsage(ctx context.Context, tx pgx.Tx, userID uint64, bytes, objects int64, defaults Quota) error {
+	if _, err := tx.Exec(ctx, `INSERT INTO storage_usage (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING;`, userID); err != nil {
+		return err
+	}
+
+	sql := `
+		UPDATE storage_usage
+		SET bytes = bytes + $2, objects = objects + $3
+		WHERE user_id = $1
+			AND (COALESCE(max_bytes, $4) = 0 OR bytes + $2 <= COALESCE(max_bytes, $4))
+			AND (COALESCE(max_objects, $5) = 0 OR objects + $3 <= COALESCE(max_objects, $5));
+	`
+	tag, err := tx.Exec(ctx, sql, userID, bytes, objects, defaults.MaxBytes, defaults.MaxObjects)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// fitsQuota reports whether an upload of size bytes fits in quota of user.
+// It's checked early to reject an upload before it's transferred, commitUpload charges quota for real.
+func (u uploader) fitsQuota(ctx context.Context, userID uint64, size int64) (bool, error) {
+	usage, err := GetUsage(ctx, u.db, userID, u.config.Quota)
+	if err != nil {
+		return false, err
+	}
+	return usage.allows(size), nil
+}
+
+// getUsage returns storage usage and quota of user.
+func (u uploader) getUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := u.amw.GetUserID(r)
+		usage, err := GetUsage(r.Context(), u.db, userID, u.config.Quota)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, usage)
+	}
+}
+
+// ReconcileUsage recomputes storage usage of all users from objects listed in bucket,
+// correcting any drift of accounted usage, e.g. after a crash between storage and database writes.
+// Uploaded files whose objects are missing from bucket aren't accounted and are logged.
+func ReconcileUsage(ctx context.Context, logger *zap.SugaredLogger, db database.Database, objects storage.ObjectStore, bucket string) error {
+	// Owners of uploaded files keyed by object key holding their content.
+	// Usage counts content size, which is less than size of an encrypted object.
+	sql := `
+		SELECT f.owner_id, COALESCE(b.object_key, f.object_key), COALESCE(b.key_id, 0) <> 0
+		FROM files f
+		LEFT JOIN blobs b ON b.id = f.blob_id
+		WHERE f.bucket = $1 AND f.status = $2;
+	`
+	owners := make(map[string][]uint64)
+	encrypted := make(map[string]bool)
+	if err := func() error {
+		conn, err := db.Pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+
+		rows, err := conn.Query(ctx, sql, bucket, FileStatusUploaded)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				ownerID     uint64
+				key         string
+				isEncrypted bool
+			)
+			if err := rows.Scan(&ownerID, &key, &isEncrypted); err != nil {
+				return err
+			}
+			owners[key] = append(owners[key], ownerID)
+			encrypted[key] = isEncrypted
+		}
+		return rows.Err()
+	}(); err != nil {
+		return err
+	}
+
+	usages := make(map[uint64]*Usage)
+	if err := objects.ListObjects(ctx, bucket, "", func(info storage.ObjectInfo) error {
+		size := info.Size
+		if encrypted[info.Key] {
+			size = encryption.DecryptedSize(size)
+		}
+		for _, ownerID := range owners[info.Key] {
+			u, ok := usages[ownerID]
+			if !ok {
+				u = &Usage{}
+				usages[ownerID] = u
+			}
+			u.Bytes += size
+			u.Objects++
+		}
+		delete(owners, info.Key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for key, ids := range owners {
+		logger.Errorf("Uploaded file object not found in storage, bucket=%s key=%s owners=%v", bucket, key, ids)
+	}
+
+	return db.InTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `UPDATE storage_usage SET bytes = 0, objects = 0;`); err != nil {
+			return err
+		}
+		for userID, u := range usages {
+			if err := addUsage(ctx, tx, userID, u.Bytes, u.Objects); err != nil {
+				return err
+			}
+			logger.Debugf("Reconciled storage usage, userid=%d bytes=%d objects=%d", userID, u.Bytes, u.Objects)
+		}
+		return nil
+	})
+}
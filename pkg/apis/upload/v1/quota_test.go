@@ -0,0 +1,35 @@
+package upload
+
+import "testing"
+
+func TestUsageAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage Usage
+		size  int64
+		want  bool
+	}{
+		{"unlimited", Usage{Bytes: 1 << 40, Objects: 1 << 20}, 1 << 30, true},
+		{"fits", Usage{Bytes: 10, Objects: 1, Quota: Quota{MaxBytes: 20, MaxObjects: 2}}, 10, true},
+		{"too large", Usage{Bytes: 10, Objects: 1, Quota: Quota{MaxBytes: 20, MaxObjects: 2}}, 11, false},
+		{"too many objects", Usage{Bytes: 10, Objects: 2, Quota: Quota{MaxBytes: 20, MaxObjects: 2}}, 1, false},
+	}
+	for _, tt := range tests {
+		if got := tt.usage.allows(tt.size); got != tt.want {
+			t.Errorf("%s: expect %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestUsageLimitSize(t *testing.T) {
+	if got := (Usage{Bytes: 5}).limitSize(100); got != 100 {
+		t.Fatalf("expect unlimited quota keep max size, got %d", got)
+	}
+	usage := Usage{Bytes: 70, Quota: Quota{MaxBytes: 100}}
+	if got := usage.limitSize(100); got != 30 {
+		t.Fatalf("expect max size limited to what's left in quota, got %d", got)
+	}
+	if got := usage.limitSize(10); got != 10 {
+		t.Fatalf("expect max size kept if it fits in quota, got %d", got)
+	}
+}
@@ -0,0 +1,297 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+	"github.com/williamlsh/orchid/pkg/encryption"
+	"github.com/williamlsh/orchid/pkg/storage"
+)
+
+// errContentChanged indicates files of re-encrypted content changed meanwhile, so nothing is repointed.
+var errContentChanged = errors.New("content changed while re-encrypting")
+
+// staleKey returns SQL condition of key id column of content to re-encrypt: plaintext or encrypted with a retired data key.
+func staleKey(column string) string {
+	return `(` + column + ` = 0 OR ` + column + ` IN (SELECT id FROM data_keys WHERE retired_at IS NOT NULL))`
+}
+
+// staleContent is content of uploaded files of an owner to re-encrypt.
+type staleContent struct {
+	bucket, key string
+	keyID       uint64
+	// blobID is nil for a file uploaded before deduplication, whose content is at its own key.
+	blobID  *uint64
+	ownerID uint64
+}
+
+// ReencryptObjects re-encrypts content in plaintext or encrypted with retired data keys with active data keys
+// of their owners, returning how many objects are re-encrypted. It completes a data key rotation.
+//
+// Re-encrypted content is stored in new blobs, deduplicated among content of the same data key.
+// A plaintext blob shared by files of several users is split into a blob per user.
+// Old blobs are released to Collector, objects of files uploaded before deduplication and old thumbnails are removed.
+func (e *Encryptor) ReencryptObjects(ctx context.Context) (int, error) {
+	if !e.Enabled() {
+		return 0, errEncryptionDisabled
+	}
+
+	contents, err := e.staleContents(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, c := range contents {
+		err := e.reencryptContent(ctx, c)
+		if errors.Is(err, errContentChanged) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	thumbnails, err := e.staleThumbnails(ctx)
+	if err != nil {
+		return n, err
+	}
+	for _, t := range thumbnails {
+		ok, err := e.reencryptThumbnail(ctx, t)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// staleContents returns content of uploaded files to re-encrypt.
+func (e *Encryptor) staleContents(ctx context.Context) ([]staleContent, error) {
+	conn, err := e.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT DISTINCT f.bucket, COALESCE(b.object_key, f.object_key), COALESCE(b.key_id, 0), f.blob_id, f.owner_id
+		FROM files f
+		LEFT JOIN blobs b ON b.id = f.blob_id
+		WHERE f.status = $1 AND ` + staleKey("COALESCE(b.key_id, 0)") + `;
+	`
+	rows, err := conn.Query(ctx, sql, FileStatusUploaded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contents []staleContent
+	for rows.Next() {
+		var c staleContent
+		if err := rows.Scan(&c.bucket, &c.key, &c.keyID, &c.blobID, &c.ownerID); err != nil {
+			return nil, err
+		}
+		contents = append(contents, c)
+	}
+	return contents, rows.Err()
+}
+
+// reencrypt copies an object encrypted with data key of keyID to key encrypted with dk,
+// returning SHA-256 and size of its content.
+func (e *Encryptor) reencrypt(ctx context.Context, bucket, srcKey string, keyID uint64, dstKey string, dk DataKey) (string, int64, error) {
+	info, err := e.storage.StatObject(ctx, bucket, srcKey)
+	if err != nil {
+		return "", 0, err
+	}
+	size := info.Size
+	if keyID != 0 {
+		size = encryption.DecryptedSize(size)
+	}
+
+	obj, err := e.GetObject(ctx, bucket, srcKey, keyID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer obj.Close()
+
+	h := sha256.New()
+	if err := e.PutObject(ctx, bucket, dstKey, dk, io.TeeReader(obj, h), size, storage.PutOptions{
+		ContentType: info.ContentType,
+	}); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// reencryptContent re-encrypts content of files of an owner into a blob, repointing the files to it.
+func (e *Encryptor) reencryptContent(ctx context.Context, c staleContent) error {
+	dk, err := e.DataKey(ctx, c.ownerID)
+	if err != nil {
+		return err
+	}
+	blobKey := blobPrefix + uuid.NewV4().String()
+	sum, size, err := e.reencrypt(ctx, c.bucket, c.key, c.keyID, blobKey, dk)
+	if err != nil {
+		return err
+	}
+
+	blobFilesSQL := `
+		UPDATE files
+		SET blob_id = $1
+		WHERE blob_id = $2 AND owner_id = $3;
+	`
+	ownFileSQL := `
+		UPDATE files
+		SET blob_id = $1
+		WHERE bucket = $2 AND object_key = $3 AND blob_id IS NULL AND owner_id = $4 AND status = $5;
+	`
+	refSQL := `
+		UPDATE blobs
+		SET ref_count = ref_count + $1
+		WHERE id = $2;
+	`
+	var created bool
+	err = e.db.InTx(ctx, func(tx pgx.Tx) error {
+		var (
+			blobID uint64
+			err    error
+		)
+		blobID, created, err = referenceBlob(ctx, tx, c.bucket, blobKey, sum, size, dk.ID)
+		if err != nil {
+			return err
+		}
+
+		sql, args := ownFileSQL, []interface{}{blobID, c.bucket, c.key, c.ownerID, FileStatusUploaded}
+		if c.blobID != nil {
+			sql, args = blobFilesSQL, []interface{}{blobID, *c.blobID, c.ownerID}
+		}
+		tag, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		// Files are deleted meanwhile.
+		n := tag.RowsAffected()
+		if n == 0 {
+			return errContentChanged
+		}
+
+		// referenceBlob counts one file, the new blob is referenced by n and the old one released n times.
+		if _, err := tx.Exec(ctx, refSQL, n-1, blobID); err != nil {
+			return err
+		}
+		if c.blobID == nil {
+			return nil
+		}
+		released := make([]uint64, n)
+		for i := range released {
+			released[i] = *c.blobID
+		}
+		return ReleaseBlobs(ctx, tx, released)
+	})
+
+	// Failing to remove objects only wastes space.
+	var garbage []string
+	if err != nil || !created {
+		garbage = append(garbage, blobKey)
+	}
+	if err == nil && c.blobID == nil {
+		garbage = append(garbage, c.key)
+	}
+	for _, k := range garbage {
+		if err := e.storage.RemoveObject(ctx, c.bucket, k); err != nil {
+			e.logger.Errorf("failed to remove object, bucket=%s key=%s err=%v", c.bucket, k, err)
+		}
+	}
+	if err == nil {
+		e.logger.Debugf("Re-encrypted content, bucket=%s key=%s key_id=%d new_key_id=%d", c.bucket, c.key, c.keyID, dk.ID)
+	}
+	return err
+}
+
+// staleThumbnail is a thumbnail to re-encrypt.
+type staleThumbnail struct {
+	fileID          uint64
+	size            int
+	bucket, fileKey string
+	key             string
+	keyID           uint64
+	ownerID         uint64
+}
+
+// staleThumbnails returns thumbnails to re-encrypt.
+func (e *Encryptor) staleThumbnails(ctx context.Context) ([]staleThumbnail, error) {
+	conn, err := e.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT t.file_id, t.size, f.bucket, f.object_key, t.object_key, t.key_id, f.owner_id
+		FROM file_thumbnails t
+		JOIN files f ON f.id = t.file_id
+		WHERE ` + staleKey("t.key_id") + `;
+	`
+	rows, err := conn.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var thumbnails []staleThumbnail
+	for rows.Next() {
+		var t staleThumbnail
+		if err := rows.Scan(&t.fileID, &t.size, &t.bucket, &t.fileKey, &t.key, &t.keyID, &t.ownerID); err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, t)
+	}
+	return thumbnails, rows.Err()
+}
+
+// reencryptThumbnail re-encrypts a thumbnail to a new key, reporting whether it's replaced.
+// A thumbnail regenerated meanwhile is kept.
+func (e *Encryptor) reencryptThumbnail(ctx context.Context, t staleThumbnail) (bool, error) {
+	dk, err := e.DataKey(ctx, t.ownerID)
+	if err != nil {
+		return false, err
+	}
+	key := thumbnailKey(t.fileKey, t.size, dk.ID)
+	if _, _, err := e.reencrypt(ctx, t.bucket, t.key, t.keyID, key, dk); err != nil {
+		// File is deleted meanwhile together with its thumbnails.
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	sql := `
+		UPDATE file_thumbnails
+		SET object_key = $1, key_id = $2
+		WHERE file_id = $3 AND size = $4 AND object_key = $5;
+	`
+	var replaced bool
+	if err := e.db.InTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, sql, key, dk.ID, t.fileID, t.size, t.key)
+		replaced = tag.RowsAffected() > 0
+		return err
+	}); err != nil {
+		return false, err
+	}
+	if !replaced {
+		return false, nil
+	}
+
+	if err := e.storage.RemoveObject(ctx, t.bucket, t.key); err != nil {
+		e.logger.Errorf("failed to remove object, bucket=%s key=%s err=%v", t.bucket, t.key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/scanner"
+	"go.uber.org/zap"
+)
+
+// Scan statuses of file content.
+const (
+	// ScanStatusPending is scan status of a file waiting for scanning.
+	ScanStatusPending = "pending"
+	// ScanStatusScanning is scan status of a file claimed by a scan worker.
+	ScanStatusScanning = "scanning"
+	// ScanStatusClean is scan status of a file in which no threat is found, only clean files are served.
+	ScanStatusClean = "clean"
+	// ScanStatusQuarantined is scan status of a file in which a threat is found.
+	ScanStatusQuarantined = "quarantined"
+	// ScanStatusFailed is scan status of a file scanner refused to scan, it's never served either.
+	ScanStatusFailed = "failed"
+)
+
+// scanClaimTimeout is how long a file claimed by a scan worker which didn't finish it waits to be claimed again.
+const scanClaimTimeout = 10 * time.Minute
+
+// scanCode returns response code of serving a file by its scan status, httpx.Success if it can be served.
+func scanCode(file *File) httpx.Code {
+	switch file.ScanStatus {
+	case ScanStatusClean:
+		return httpx.Success
+	case ScanStatusQuarantined, ScanStatusFailed:
+		return httpx.ErrUploadFileQuarantined
+	default:
+		return httpx.ErrUploadFileNotScanned
+	}
+}
+
+// ScanWorker scans content of uploaded files, recording quarantine state of each.
+type ScanWorker struct {
+	logger    *zap.SugaredLogger
+	db        database.Database
+	encryptor *Encryptor
+	scanner   scanner.Scanner
+	config    ScanOptions
+}
+
+// NewScanWorker returns a new ScanWorker.
+func NewScanWorker(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	encryptor *Encryptor,
+	scanner scanner.Scanner,
+	config ConfigOptions,
+) ScanWorker {
+	return ScanWorker{
+		logger,
+		db,
+		encryptor,
+		scanner,
+		config.Scan,
+	}
+}
+
+// Scan scans a batch of uploaded files pending scanning.
+// It's meant to run periodically as a background job, concurrent workers claim different files.
+func (s ScanWorker) Scan(ctx context.Context) error {
+	files, err := s.claimFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		result, err := s.scanContent(ctx, f)
+		status, signature := ScanStatusClean, ""
+		switch {
+		case errors.Is(err, scanner.ErrScanFailed):
+			s.logger.Errorf("failed to scan file, id=%d err=%v", f.ID, err)
+			status, signature = ScanStatusFailed, err.Error()
+		case err != nil:
+			// Scanner is unavailable, file is scanned again later.
+			s.logger.Errorf("failed to scan file, id=%d err=%v", f.ID, err)
+			status = ScanStatusPending
+		case !result.Clean:
+			s.logger.Infof("Quarantined file, id=%d signature=%s", f.ID, result.Signature)
+			status, signature = ScanStatusQuarantined, result.Signature
+		}
+
+		sql := `
+			UPDATE files
+			SET scan_status = $1, scan_signature = $2, scanned_at = NOW()
+			WHERE id = $3 AND scan_status = $4;
+		`
+		if err := s.db.InTx(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, sql, status, signature, f.ID, ScanStatusScanning)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimFiles marks a batch of uploaded files pending scanning, or files whose worker went away, scanning.
+func (s ScanWorker) claimFiles(ctx context.Context) ([]File, error) {
+	claimSQL := `
+		UPDATE files
+		SET scan_status = $1
+		WHERE id IN (
+			SELECT id FROM files
+			WHERE status = $2 AND (scan_status = $3 OR (scan_status = $1 AND updated_at < $4))
+			ORDER BY id
+			LIMIT $5
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id;
+	`
+	filesSQL := `
+		SELECT ` + fileColumns + `
+		FROM ` + fileTables + `
+		WHERE f.id = ANY($1)
+		ORDER BY f.id;
+	`
+	var files []File
+	err := s.db.InTx(ctx, func(tx pgx.Tx) error {
+		var ids []uint64
+		rows, err := tx.Query(ctx, claimSQL, ScanStatusScanning, FileStatusUploaded, ScanStatusPending, time.Now().Add(-scanClaimTimeout), s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.Query(ctx, filesSQL, ids)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			f, err := scanFile(rows)
+			if err != nil {
+				return err
+			}
+			files = append(files, *f)
+		}
+		return rows.Err()
+	})
+	return files, err
+}
+
+// scanContent streams content of a file to scanner.
+func (s ScanWorker) scanContent(ctx context.Context, f File) (scanner.Result, error) {
+	obj, err := s.encryptor.GetObject(ctx, f.Bucket, f.StorageKey(), f.KeyID)
+	if err != nil {
+		return scanner.Result{}, err
+	}
+	defer obj.Close()
+
+	return s.scanner.Scan(ctx, obj)
+}
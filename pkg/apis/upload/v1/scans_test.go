@@ -0,0 +1,22 @@
+package upload
+
+import (
+	"testing"
+
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+)
+
+func TestScanCode(t *testing.T) {
+	tests := map[string]httpx.Code{
+		ScanStatusClean:       httpx.Success,
+		ScanStatusPending:     httpx.ErrUploadFileNotScanned,
+		ScanStatusScanning:    httpx.ErrUploadFileNotScanned,
+		ScanStatusQuarantined: httpx.ErrUploadFileQuarantined,
+		ScanStatusFailed:      httpx.ErrUploadFileQuarantined,
+	}
+	for status, want := range tests {
+		if got := scanCode(&File{ScanStatus: status}); got != want {
+			t.Errorf("%s: expect code %d, got %d", status, want, got)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// maxPartCount is the most parts S3 allows in a multipart upload.
+const maxPartCount = 10000
+
+// errSessionNotFound indicates a session doesn't exist, expired or isn't owned by user.
+var errSessionNotFound = errors.New("upload session not found")
+
+// uploadSession is a multipart upload session stored in cache, it's addressed by S3 upload id.
+type uploadSession struct {
+	ID        string `json:"id"`
+	FileID    uint64 `json:"file_id"`
+	OwnerID   uint64 `json:"-"`
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	PartSize  int64  `json:"part_size"`
+	PartCount int    `json:"part_count"`
+	// Parts are completed part numbers, only filled in responses.
+	Parts []int `json:"parts"`
+}
+
+// sessionCacheKey is the cache key of an upload session,
+// it's scoped to user so that a session can only be found by its owner.
+func sessionCacheKey(userID uint64, id string) string {
+	return "upload:session:" + strconv.FormatUint(userID, 10) + ":" + id
+}
+
+// sessionPartsCacheKey is the cache key of completed parts of an upload session,
+// it's a hash from part number to part ETag.
+func sessionPartsCacheKey(id string) string {
+	return "upload:session_parts:" + id
+}
+
+// sessionRequest is request body of createSession.
+type sessionRequest struct {
+	Purpose     string `json:"purpose"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// createSession initiates a multipart upload of a large file and stores its session for resuming.
+func (u uploader) createSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reqBody sessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		purpose, ok := u.config.Purposes[reqBody.Purpose]
+		if !ok {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPurpose, nil)
+			return
+		}
+		contentType := strings.ToLower(strings.TrimSpace(reqBody.ContentType))
+		if contentType == "" || !purpose.allows(contentType) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidContentType, nil)
+			return
+		}
+		partCount := int((reqBody.Size + u.config.PartSize - 1) / u.config.PartSize)
+		if reqBody.Size <= 0 || reqBody.Size > purpose.MaxSize || partCount > maxPartCount {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidSession, nil)
+			return
+		}
+
+		userID := u.amw.GetUserID(r)
+		fits, err := u.fitsQuota(r.Context(), userID, reqBody.Size)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if !fits {
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+
+		// Multipart ETag isn't a content MD5, checksum is filled on completion.
+		fileID, key, err := u.registerFile(r.Context(), userID, reqBody.Purpose, "")
+		if err != nil {
+			u.logger.Errorf("failed to register file, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		uploadID, err := u.storage.NewMultipartUpload(r.Context(), u.config.Bucket, key, storage.PutOptions{
+			ContentType: contentType,
+		})
+		if err != nil {
+			u.logger.Errorf("failed to initiate multipart upload, key=%s err=%v", key, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		session := uploadSession{
+			ID:        uploadID,
+			FileID:    fileID,
+			OwnerID:   userID,
+			Bucket:    u.config.Bucket,
+			Key:       key,
+			Size:      reqBody.Size,
+			PartSize:  u.config.PartSize,
+			PartCount: partCount,
+			Parts:     []int{},
+		}
+		if err := u.storeSession(r.Context(), session); err != nil {
+			u.logger.Errorf("failed to store upload session, id=%s err=%v", uploadID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, session)
+	}
+}
+
+// storeSession stores session in cache, it expires together with session.
+func (u uploader) storeSession(ctx context.Context, session uploadSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return u.cache.Set(ctx, sessionCacheKey(session.OwnerID, session.ID), string(b), u.config.SessionExpiration)
+}
+
+// getSession returns user's session in cache with its completed parts.
+func (u uploader) getSession(ctx context.Context, userID uint64, id string) (*uploadSession, map[int]string, error) {
+	val, err := u.cache.Get(ctx, sessionCacheKey(userID, id))
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := u.cache.HGetAll(ctx, sessionPartsCacheKey(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var session uploadSession
+	if err := json.Unmarshal([]byte(val), &session); err != nil {
+		return nil, nil, err
+	}
+	session.OwnerID = userID
+	if err := CheckOwnership(userID, session.Key); err != nil {
+		return nil, nil, err
+	}
+
+	parts := make(map[int]string, len(fields))
+	for n, etag := range fields {
+		partNumber, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts[partNumber] = etag
+	}
+	return &session, parts, nil
+}
+
+// sessionFromRequest returns user's session addressed by request path with its completed parts.
+// If it returns false, response is already finalized.
+func (u uploader) sessionFromRequest(w http.ResponseWriter, r *http.Request) (*uploadSession, map[int]string, bool) {
+	id := mux.Vars(r)["session_id"]
+	session, parts, err := u.getSession(r.Context(), u.amw.GetUserID(r), id)
+	if errors.Is(err, errSessionNotFound) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadSessionNotFound, nil)
+		return nil, nil, false
+	}
+	if errors.Is(err, ErrObjectNotOwned) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadObjectConflict, nil)
+		return nil, nil, false
+	}
+	if err != nil {
+		u.logger.Errorf("failed to get upload session, id=%s err=%v", id, err)
+
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+		return nil, nil, false
+	}
+	return session, parts, true
+}
+
+// resumeSession returns a session with its completed parts, so that client can resume after restarting.
+// Parts uploaded to storage but not reported by client are synchronized into cache.
+func (u uploader) resumeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, parts, ok := u.sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := u.syncParts(r.Context(), session, parts); err != nil {
+			u.logger.Errorf("failed to synchronize upload parts, id=%s err=%v", session.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		session.Parts = sortedPartNumbers(parts)
+
+		httpx.FinalizeResponse(w, httpx.Success, session)
+	}
+}
+
+// syncParts lists parts of session in storage and records them into cache and parts.
+func (u uploader) syncParts(ctx context.Context, session *uploadSession, parts map[int]string) error {
+	uploaded, err := u.storage.ListParts(ctx, session.Bucket, session.Key, session.ID)
+	if err != nil {
+		return err
+	}
+	for _, p := range uploaded {
+		parts[p.PartNumber] = p.ETag
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(parts))
+	for n, etag := range parts {
+		values[strconv.Itoa(n)] = etag
+	}
+	return u.recordParts(ctx, session.ID, values)
+}
+
+// recordParts records completed parts of session in cache, they expire together with session.
+func (u uploader) recordParts(ctx context.Context, id string, values map[string]string) error {
+	return u.cache.HSet(ctx, sessionPartsCacheKey(id), values, u.config.SessionExpiration)
+}
+
+// presignParts returns presigned put urls of requested parts of a session.
+func (u uploader) presignParts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _, ok := u.sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var reqBody struct {
+			PartNumbers []int `json:"part_numbers"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		if len(reqBody.PartNumbers) == 0 {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPart, nil)
+			return
+		}
+		// Usage may have grown since session was created.
+		fits, err := u.fitsQuota(r.Context(), session.OwnerID, session.Size)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", session.OwnerID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if !fits {
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+
+		urls := make(map[string]string, len(reqBody.PartNumbers))
+		for _, n := range reqBody.PartNumbers {
+			if n < 1 || n > session.PartCount {
+				httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPart, nil)
+				return
+			}
+			presigned, err := u.storage.PresignPart(r.Context(), session.Bucket, session.Key, session.ID, n, u.config.PolicyExpiration)
+			if err != nil {
+				u.logger.Errorf("failed to presign upload part, id=%s err=%v", session.ID, err)
+
+				httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+				return
+			}
+			urls[strconv.Itoa(n)] = presigned.String()
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, urls)
+	}
+}
+
+// completePart records a part uploaded by client with its ETag.
+func (u uploader) completePart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _, ok := u.sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		n, err := strconv.Atoi(mux.Vars(r)["part_number"])
+		if err != nil || n < 1 || n > session.PartCount {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPart, nil)
+			return
+		}
+		var reqBody struct {
+			ETag string `json:"etag"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		etag := strings.Trim(strings.TrimSpace(reqBody.ETag), `"`)
+		if etag == "" {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidPart, nil)
+			return
+		}
+
+		if err := u.recordParts(r.Context(), session.ID, map[string]string{strconv.Itoa(n): etag}); err != nil {
+			u.logger.Errorf("failed to record upload part, id=%s err=%v", session.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, nil)
+	}
+}
+
+// completeSession completes multipart upload of a session once all its parts are uploaded,
+// then marks its file uploaded.
+func (u uploader) completeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, parts, ok := u.sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if missing := missingParts(session.PartCount, parts); len(missing) > 0 {
+			httpx.FinalizeResponse(w, httpx.ErrUploadIncompleteParts, map[string][]int{
+				"missing_parts": missing,
+			})
+			return
+		}
+
+		completeParts := make([]storage.Part, 0, len(parts))
+		for _, n := range sortedPartNumbers(parts) {
+			completeParts = append(completeParts, storage.Part{PartNumber: n, ETag: parts[n]})
+		}
+		if _, err := u.storage.CompleteMultipartUpload(r.Context(), session.Bucket, session.Key, session.ID, completeParts); err != nil {
+			u.logger.Errorf("failed to complete multipart upload, id=%s err=%v", session.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		info, err := u.storage.StatObject(r.Context(), session.Bucket, session.Key)
+		if err != nil {
+			u.logger.Errorf("failed to stat object, bucket=%s key=%s err=%v", session.Bucket, session.Key, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		// Presigned part urls don't constrain part sizes, reject anything but the declared size.
+		if info.Size != session.Size {
+			if err := u.discardSession(r.Context(), session, true); err != nil {
+				u.logger.Errorf("failed to discard upload session, id=%s err=%v", session.ID, err)
+			}
+
+			httpx.FinalizeResponse(w, httpx.ErrUploadSizeMismatch, nil)
+			return
+		}
+
+		err = u.commitUpload(r.Context(), session.FileID, session.Bucket, session.Key, "", info)
+		if errors.Is(err, errQuotaExceeded) {
+			if _, err := u.cache.Del(r.Context(), sessionCacheKey(session.OwnerID, session.ID), sessionPartsCacheKey(session.ID)); err != nil {
+				u.logger.Errorf("failed to delete upload session, id=%s err=%v", session.ID, err)
+			}
+
+			httpx.FinalizeResponse(w, httpx.ErrUploadQuotaExceeded, nil)
+			return
+		}
+		if err != nil {
+			u.logger.Errorf("failed to complete file upload, id=%d err=%v", session.FileID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if _, err := u.cache.Del(r.Context(), sessionCacheKey(session.OwnerID, session.ID), sessionPartsCacheKey(session.ID)); err != nil {
+			u.logger.Errorf("failed to delete upload session, id=%s err=%v", session.ID, err)
+		}
+
+		file, err := getFile(r.Context(), u.db, session.OwnerID, session.FileID)
+		if err != nil {
+			u.logger.Errorf("failed to get file, id=%d err=%v", session.FileID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, file)
+	}
+}
+
+// abortSession aborts multipart upload of a session and discards its file.
+func (u uploader) abortSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _, ok := u.sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := u.discardSession(r.Context(), session, false); err != nil {
+			u.logger.Errorf("failed to abort upload session, id=%s err=%v", session.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, nil)
+	}
+}
+
+// discardSession deletes everything of a session: its multipart upload or completed object, file and cache.
+func (u uploader) discardSession(ctx context.Context, session *uploadSession, completed bool) error {
+	if completed {
+		if err := u.storage.RemoveObject(ctx, session.Bucket, session.Key); err != nil {
+			return err
+		}
+	} else {
+		err := u.storage.AbortMultipartUpload(ctx, session.Bucket, session.Key, session.ID)
+		if err != nil && !errors.Is(err, storage.ErrUploadNotFound) {
+			return err
+		}
+	}
+
+	sql := `
+		DELETE FROM files
+		WHERE id = $1 AND status = $2;
+	`
+	if err := u.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, session.FileID, FileStatusPending)
+		return err
+	}); err != nil {
+		return err
+	}
+	_, err := u.cache.Del(ctx, sessionCacheKey(session.OwnerID, session.ID), sessionPartsCacheKey(session.ID))
+	return err
+}
+
+// missingParts returns part numbers not completed yet in order.
+func missingParts(partCount int, parts map[int]string) []int {
+	var missing []int
+	for n := 1; n <= partCount; n++ {
+		if _, ok := parts[n]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+// sortedPartNumbers returns completed part numbers in order.
+func sortedPartNumbers(parts map[int]string) []int {
+	numbers := make([]int, 0, len(parts))
+	for n := range parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// Janitor cleans up stale uploads which were never completed.
+type Janitor struct {
+	logger  *zap.SugaredLogger
+	db      database.Database
+	storage storage.ObjectStore
+	config  ConfigOptions
+}
+
+// NewJanitor returns a new Janitor.
+func NewJanitor(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	storage storage.ObjectStore,
+	config ConfigOptions,
+) Janitor {
+	return Janitor{
+		logger,
+		db,
+		storage,
+		config,
+	}
+}
+
+// AbortStaleUploads aborts incomplete multipart uploads in bucket older than session expiration
+// and deletes their pending files and tus tail objects. It's meant to run periodically as a background job.
+func (j Janitor) AbortStaleUploads(ctx context.Context) error {
+	sql := `
+		DELETE FROM files
+		WHERE bucket = $1 AND object_key = $2 AND status = $3;
+	`
+	return j.storage.ListMultipartUploads(ctx, j.config.Bucket, func(info storage.MultipartUpload) error {
+		if time.Since(info.Initiated) < j.config.SessionExpiration {
+			return nil
+		}
+
+		if err := j.storage.AbortMultipartUpload(ctx, j.config.Bucket, info.Key, info.UploadID); err != nil {
+			return err
+		}
+		if err := j.removeTusTails(ctx, info.Key); err != nil {
+			return err
+		}
+		if err := j.db.InTx(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, sql, j.config.Bucket, info.Key, FileStatusPending)
+			return err
+		}); err != nil {
+			return err
+		}
+		j.logger.Debugf("Aborted stale multipart upload, key=%s upload_id=%s", info.Key, info.UploadID)
+		return nil
+	})
+}
+
+// removeTusTails removes tail objects of an aborted tus upload.
+func (j Janitor) removeTusTails(ctx context.Context, key string) error {
+	return j.storage.RemovePrefix(ctx, j.config.Bucket, key+".part.")
+}
@@ -0,0 +1,69 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"go.uber.org/zap"
+)
+
+func TestMissingParts(t *testing.T) {
+	parts := map[int]string{3: "c", 1: "a"}
+	if missing := missingParts(4, parts); !reflect.DeepEqual(missing, []int{2, 4}) {
+		t.Fatalf("expect missing parts [2 4], got %v", missing)
+	}
+	if numbers := sortedPartNumbers(parts); !reflect.DeepEqual(numbers, []int{1, 3}) {
+		t.Fatalf("expect sorted parts [1 3], got %v", numbers)
+	}
+}
+
+func TestUploadSessionInCache(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	u := uploader{
+		logger: zap.NewNop().Sugar(),
+		cache:  &cache.Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+		config: ConfigOptions{SessionExpiration: time.Hour},
+	}
+	ctx := context.Background()
+
+	key, err := objectKey(7, PurposeAttachment, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := uploadSession{ID: "upload-id", FileID: 1, OwnerID: 7, Bucket: "all", Key: key, Size: 10, PartSize: 5, PartCount: 2}
+	if err := u.storeSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.recordParts(ctx, session.ID, map[string]string{"2": "etag2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, parts, err := u.getSession(ctx, 7, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OwnerID != 7 || got.Key != key || got.PartCount != 2 {
+		t.Fatalf("unexpected session: %+v", got)
+	}
+	if !reflect.DeepEqual(parts, map[int]string{2: "etag2"}) {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+
+	if _, _, err := u.getSession(ctx, 8, session.ID); !errors.Is(err, errSessionNotFound) {
+		t.Fatalf("expect session not found by another user, got %v", err)
+	}
+	if ttl := mr.TTL(sessionPartsCacheKey(session.ID)); ttl <= 0 {
+		t.Fatalf("expect parts expiring with session, got ttl %v", ttl)
+	}
+}
@@ -0,0 +1,354 @@
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// shareTokenBytes is the number of random bytes of a share link token.
+	shareTokenBytes = 24
+	// maxSharePasswordLength is the longest password bcrypt can hash.
+	maxSharePasswordLength = 72
+	// sharePasswordHeader is the request header carrying a share link password.
+	sharePasswordHeader = "X-Share-Password"
+)
+
+// errShareExhausted indicates a share link reached its max download count.
+var errShareExhausted = errors.New("share link download limit reached")
+
+// Share is a link sharing a file with anyone knowing its token.
+type Share struct {
+	ID           uint64    `json:"id"`
+	Token        string    `json:"token"`
+	HasPassword  bool      `json:"has_password"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// shareOptions is request body of createShare.
+type shareOptions struct {
+	// ExpiresIn is share link lifetime in seconds.
+	ExpiresIn int64  `json:"expires_in"`
+	Password  string `json:"password"`
+	// MaxDownloads limits download count, 0 means unlimited.
+	MaxDownloads int `json:"max_downloads"`
+}
+
+// validate validates share options against config.
+func (o shareOptions) validate(config ConfigOptions) bool {
+	expiresIn := time.Duration(o.ExpiresIn) * time.Second
+	return expiresIn > 0 &&
+		expiresIn <= config.ShareMaxExpiration &&
+		o.MaxDownloads >= 0 &&
+		len(o.Password) <= maxSharePasswordLength
+}
+
+// shareDownloadsCacheKey is the cache key counting downloads through a share link.
+func shareDownloadsCacheKey(token string) string {
+	return "upload:share_downloads:" + token
+}
+
+// createShare creates a share link of a file with expiry, optional password and max download count.
+func (f files) createShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if file.Status != FileStatusUploaded {
+			httpx.FinalizeResponse(w, httpx.ErrUploadFileNotUploaded, nil)
+			return
+		}
+
+		var opts shareOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		if !opts.validate(f.config) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadInvalidShare, nil)
+			return
+		}
+
+		share, err := f.insertShare(r.Context(), file.ID, opts)
+		if err != nil {
+			f.logger.Errorf("failed to create share link, file_id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, share)
+	}
+}
+
+// insertShare is an helper for createShare.
+func (f files) insertShare(ctx context.Context, fileID uint64, opts shareOptions) (*Share, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	var passwordHash string
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		passwordHash = string(hash)
+	}
+
+	share := Share{
+		Token:        hex.EncodeToString(b),
+		HasPassword:  passwordHash != "",
+		MaxDownloads: opts.MaxDownloads,
+		ExpiresAt:    time.Now().Add(time.Duration(opts.ExpiresIn) * time.Second).UTC(),
+	}
+
+	sql := `
+		INSERT INTO file_shares (token, file_id, password_hash, max_downloads, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;
+	`
+	err := f.db.InTx(ctx, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, sql, share.Token, fileID, passwordHash, share.MaxDownloads, share.ExpiresAt).
+			Scan(&share.ID, &share.CreatedAt)
+	})
+	return &share, err
+}
+
+// listShares returns all unexpired share links of a file.
+func (f files) listShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		shares, err := f.getShares(r.Context(), file.ID)
+		if err != nil {
+			f.logger.Errorf("failed to list share links, file_id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, shares)
+	}
+}
+
+// getShares is an helper for listShares, download counts are read from cache.
+func (f files) getShares(ctx context.Context, fileID uint64) ([]Share, error) {
+	conn, err := f.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT id, token, password_hash <> '', max_downloads, expires_at, created_at
+		FROM file_shares
+		WHERE file_id = $1 AND expires_at > NOW()
+		ORDER BY id;
+	`
+	rows, err := conn.Query(ctx, sql, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var s Share
+		if err := rows.Scan(&s.ID, &s.Token, &s.HasPassword, &s.MaxDownloads, &s.ExpiresAt, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range shares {
+		val, err := f.cache.Get(ctx, shareDownloadsCacheKey(shares[i].Token))
+		if errors.Is(err, cache.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if shares[i].Downloads, err = strconv.Atoi(val); err != nil {
+			return nil, err
+		}
+	}
+	return shares, nil
+}
+
+// deleteShare revokes a share link of a file.
+func (f files) deleteShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.fileFromRequest(w, r)
+		if !ok {
+			return
+		}
+		shareID, err := strconv.ParseUint(mux.Vars(r)["share_id"], 10, 64)
+		if err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrUploadShareNotFound, nil)
+			return
+		}
+
+		sql := `
+			DELETE FROM file_shares
+			WHERE id = $1 AND file_id = $2
+			RETURNING token;
+		`
+		var token string
+		err = f.db.InTx(r.Context(), func(tx pgx.Tx) error {
+			return tx.QueryRow(r.Context(), sql, shareID, file.ID).Scan(&token)
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadShareNotFound, nil)
+			return
+		}
+		if err == nil {
+			_, err = f.cache.Del(r.Context(), shareDownloadsCacheKey(token))
+		}
+		if err != nil {
+			f.logger.Errorf("failed to delete share link, id=%d err=%v", shareID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, nil)
+	}
+}
+
+// sharedFile is a file resolved from a share link.
+type sharedFile struct {
+	File
+	ownerID      uint64
+	passwordHash string
+	maxDownloads int
+	expiresAt    time.Time
+}
+
+// resolveShare returns a presigned download url of a shared file to anyone knowing the link token.
+// File owner is neither asked for password nor counted against max downloads.
+func (f files) resolveShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := mux.Vars(r)["token"]
+		shared, err := f.getSharedFile(r.Context(), token)
+		if errors.Is(err, pgx.ErrNoRows) {
+			httpx.FinalizeResponse(w, httpx.ErrUploadShareNotFound, nil)
+			return
+		}
+		if err != nil {
+			f.logger.Errorf("failed to resolve share link: %v", err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		if err := CheckOwnership(shared.ownerID, shared.Key); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrUploadObjectConflict, nil)
+			return
+		}
+		if code := scanCode(&shared.File); code != httpx.Success {
+			httpx.FinalizeResponse(w, code, nil)
+			return
+		}
+
+		if f.amw.GetUserID(r) != shared.ownerID {
+			if shared.passwordHash != "" {
+				password := r.Header.Get(sharePasswordHeader)
+				if bcrypt.CompareHashAndPassword([]byte(shared.passwordHash), []byte(password)) != nil {
+					httpx.FinalizeResponse(w, httpx.ErrUploadSharePasswordMismatch, nil)
+					return
+				}
+			}
+			if err := f.countShareDownload(r.Context(), token, shared.maxDownloads, shared.expiresAt); err != nil {
+				if errors.Is(err, errShareExhausted) {
+					httpx.FinalizeResponse(w, httpx.ErrUploadShareExhausted, nil)
+					return
+				}
+				f.logger.Errorf("failed to count share link download: %v", err)
+
+				httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+				return
+			}
+		}
+
+		// A download url never outlives its share link.
+		expiration := f.config.DownloadURLExpiration
+		if left := time.Until(shared.expiresAt); left < expiration {
+			expiration = left
+		}
+		url, err := f.presignDownload(r.Context(), &shared.File, expiration)
+		if err != nil {
+			f.logger.Errorf("failed to presign download url, id=%d err=%v", shared.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, map[string]string{
+			"url": url,
+		})
+	}
+}
+
+// getSharedFile returns the uploaded file shared by an unexpired link.
+func (f files) getSharedFile(ctx context.Context, token string) (*sharedFile, error) {
+	conn, err := f.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT ` + fileColumns + `,
+			f.owner_id, s.password_hash, s.max_downloads, s.expires_at
+		FROM file_shares s
+		JOIN files f ON f.id = s.file_id
+		LEFT JOIN blobs b ON b.id = f.blob_id
+		WHERE s.token = $1 AND s.expires_at > NOW() AND f.status = $2 AND f.deleted_at IS NULL;
+	`
+	var s sharedFile
+	err = conn.QueryRow(ctx, sql, token, FileStatusUploaded).Scan(
+		append(s.fields(), &s.ownerID, &s.passwordHash, &s.maxDownloads, &s.expiresAt)...,
+	)
+	return &s, err
+}
+
+// countShareDownload counts a download through a share link in cache,
+// it returns errShareExhausted if max downloads is reached, which isn't counted.
+func (f files) countShareDownload(ctx context.Context, token string, maxDownloads int, expiresAt time.Time) error {
+	limit := int64(math.MaxInt64)
+	if maxDownloads > 0 {
+		limit = int64(maxDownloads)
+	}
+	ok, err := f.cache.IncrIfLess(ctx, shareDownloadsCacheKey(token), limit, time.Until(expiresAt))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errShareExhausted
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"go.uber.org/zap"
+)
+
+func TestShareOptionsValidate(t *testing.T) {
+	config := ConfigOptions{ShareMaxExpiration: 24 * time.Hour}
+
+	valid := []shareOptions{
+		{ExpiresIn: 3600},
+		{ExpiresIn: 24 * 3600, Password: "secret", MaxDownloads: 3},
+	}
+	for _, opts := range valid {
+		if !opts.validate(config) {
+			t.Errorf("expect valid options: %+v", opts)
+		}
+	}
+
+	invalid := []shareOptions{
+		{ExpiresIn: 0},
+		{ExpiresIn: 24*3600 + 1},
+		{ExpiresIn: 3600, MaxDownloads: -1},
+		{ExpiresIn: 3600, Password: strings.Repeat("a", maxSharePasswordLength+1)},
+	}
+	for _, opts := range invalid {
+		if opts.validate(config) {
+			t.Errorf("expect invalid options: %+v", opts)
+		}
+	}
+}
+
+func TestCountShareDownload(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	f := files{
+		logger: zap.NewNop().Sugar(),
+		cache:  &cache.Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if err := f.countShareDownload(ctx, "limited", 2, expiresAt); err != nil {
+			t.Fatalf("download %d: %v", i+1, err)
+		}
+	}
+	if err := f.countShareDownload(ctx, "limited", 2, expiresAt); !errors.Is(err, errShareExhausted) {
+		t.Fatalf("expect download limit reached, got %v", err)
+	}
+	if n, _ := mr.Get(shareDownloadsCacheKey("limited")); n != "2" {
+		t.Fatalf("expect rejected downloads not counted, got %s", n)
+	}
+	if ttl := mr.TTL(shareDownloadsCacheKey("limited")); ttl <= 0 {
+		t.Fatalf("expect download counter expiring with share link, got ttl %v", ttl)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := f.countShareDownload(ctx, "unlimited", 0, expiresAt); err != nil {
+			t.Fatalf("unlimited download %d: %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// listTrash returns all files of user in trash.
+func (f files) listTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := f.amw.GetUserID(r)
+		list, err := listFiles(r.Context(), f.db, userID, true)
+		if err != nil {
+			f.logger.Errorf("failed to list trashed files, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, list)
+	}
+}
+
+// restoreFile moves a file of user out of trash.
+func (f files) restoreFile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.trashedFileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		sql := `
+			UPDATE files
+			SET deleted_at = NULL
+			WHERE id = $1 AND deleted_at IS NOT NULL;
+		`
+		var restored bool
+		if err := f.db.InTx(r.Context(), func(tx pgx.Tx) error {
+			tag, err := tx.Exec(r.Context(), sql, file.ID)
+			restored = tag.RowsAffected() > 0
+			return err
+		}); err != nil {
+			f.logger.Errorf("failed to restore file, id=%d err=%v", file.ID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		// File is purged or restored meanwhile.
+		if !restored {
+			httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+			return
+		}
+
+		file.DeletedAt = nil
+		httpx.FinalizeResponse(w, httpx.Success, file)
+	}
+}
+
+// deleteTrashedFile destroys a file of user in trash before it's purged.
+func (f files) deleteTrashedFile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, ok := f.trashedFileFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		f.destroyFile(w, r, file)
+	}
+}
+
+// trashedFileFromRequest returns the file in trash addressed by request path owned by user.
+// If it returns false, response is already finalized.
+func (f files) trashedFileFromRequest(w http.ResponseWriter, r *http.Request) (*File, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+		return nil, false
+	}
+
+	file, err := queryFile(r.Context(), f.db, f.amw.GetUserID(r), id, true)
+	if errors.Is(err, errFileNotFound) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadFileNotFound, nil)
+		return nil, false
+	}
+	if errors.Is(err, ErrObjectNotOwned) {
+		httpx.FinalizeResponse(w, httpx.ErrUploadObjectConflict, nil)
+		return nil, false
+	}
+	if err != nil {
+		f.logger.Errorf("failed to get trashed file, id=%d err=%v", id, err)
+
+		httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+		return nil, false
+	}
+	return file, true
+}
+
+// TrashPurger destroys files kept in trash longer than retention.
+type TrashPurger struct {
+	logger    *zap.SugaredLogger
+	db        database.Database
+	storage   storage.ObjectStore
+	retention time.Duration
+}
+
+// NewTrashPurger returns a new TrashPurger.
+func NewTrashPurger(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	storage storage.ObjectStore,
+	config ConfigOptions,
+) TrashPurger {
+	return TrashPurger{
+		logger,
+		db,
+		storage,
+		config.Trash.Retention,
+	}
+}
+
+// Purge destroys files moved to trash longer than retention ago together with their content.
+// It's meant to run periodically as a background job.
+func (p TrashPurger) Purge(ctx context.Context) error {
+	files, err := p.expiredFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range files {
+		file := &files[i]
+		err := destroyFile(ctx, p.logger, p.db, p.storage, file)
+		// File is restored meanwhile.
+		if errors.Is(err, errFileNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.logger.Debugf("Purged trashed file, id=%d bucket=%s key=%s", file.ID, file.Bucket, file.Key)
+	}
+	return nil
+}
+
+// expiredFiles returns files in trash longer than retention.
+func (p TrashPurger) expiredFiles(ctx context.Context) ([]File, error) {
+	conn, err := p.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT ` + fileColumns + `
+		FROM ` + fileTables + `
+		WHERE f.deleted_at < $1;
+	`
+	rows, err := conn.Query(ctx, sql, time.Now().Add(-p.retention))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, rows.Err()
+}
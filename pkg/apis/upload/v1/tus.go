@@ -0,0 +1,545 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/storage"
+)
+
+// tus protocol constants, see https://tus.io/protocols/resumable-upload.html.
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,termination,checksum,expiration"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+	tusContentType        = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the tus checksum extension status of a mismatched chunk.
+	statusChecksumMismatch = 460
+)
+
+// errTusUploadNotFound indicates a tus upload doesn't exist, expired or isn't owned by user.
+var errTusUploadNotFound = errors.New("tus upload not found")
+
+// tusUpload is state of a tus upload stored in cache, it's addressed by its file id.
+// Chunks are streamed into an S3 multipart upload, data shorter than a part is kept in a tail object
+// until following chunks fill a part.
+type tusUpload struct {
+	FileID      uint64         `json:"file_id"`
+	Bucket      string         `json:"bucket"`
+	Key         string         `json:"key"`
+	ContentType string         `json:"content_type"`
+	Length      int64          `json:"length"`
+	Offset      int64          `json:"offset"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	UploadID    string         `json:"upload_id"`
+	Parts       []storage.Part `json:"parts"`
+	Tail        string         `json:"tail"`
+	TailSize    int64          `json:"tail_size"`
+}
+
+// completed reports whether all data of upload is received.
+func (t tusUpload) completed() bool {
+	return t.Offset == t.Length
+}
+
+// tusCacheKey is the cache key of a tus upload, it's scoped to user.
+func tusCacheKey(userID, fileID uint64) string {
+	return fmt.Sprintf("upload:tus:%d:%d", userID, fileID)
+}
+
+// tusMiddleware checks tus protocol version and sets common tus response headers.
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tusOptions responds tus server capabilities.
+func (u uploader) tusOptions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var maxSize int64
+		for _, p := range u.config.Purposes {
+			if p.MaxSize > maxSize {
+				maxSize = p.MaxSize
+			}
+		}
+
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// tusCreate creates a tus upload, upload purpose and content type are given by metadata keys purpose and filetype.
+func (u uploader) tusCreate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+			return
+		}
+		purposeName := metadata["purpose"]
+		if purposeName == "" {
+			purposeName = PurposeAttachment
+		}
+		purpose, ok := u.config.Purposes[purposeName]
+		if !ok {
+			http.Error(w, "invalid upload purpose", http.StatusBadRequest)
+			return
+		}
+		contentType := strings.ToLower(strings.TrimSpace(metadata["filetype"]))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if !purpose.allows(contentType) {
+			http.Error(w, "content type not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if length > purpose.MaxSize {
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		userID := u.amw.GetUserID(r)
+		fits, err := u.fitsQuota(r.Context(), userID, length)
+		if err != nil {
+			u.logger.Errorf("failed to get storage usage, userid=%d, err=%v", userID, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !fits {
+			http.Error(w, "storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		fileID, key, err := u.registerFile(r.Context(), userID, purposeName, "")
+		if err != nil {
+			u.logger.Errorf("failed to register file, userid=%d, err=%v", userID, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		upload := tusUpload{
+			FileID:      fileID,
+			Bucket:      u.config.Bucket,
+			Key:         key,
+			ContentType: contentType,
+			Length:      length,
+			ExpiresAt:   time.Now().Add(u.config.SessionExpiration).UTC(),
+		}
+		if length == 0 {
+			// A multipart upload can't be empty, store an empty object right away.
+			_, err = u.storage.PutObject(r.Context(), upload.Bucket, key, bytes.NewReader(nil), 0, storage.PutOptions{
+				ContentType: contentType,
+			})
+			if err == nil {
+				err = u.finishTusUpload(r.Context(), &upload)
+			}
+		} else {
+			upload.UploadID, err = u.storage.NewMultipartUpload(r.Context(), upload.Bucket, key, storage.PutOptions{
+				ContentType: contentType,
+			})
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, "storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == nil {
+			err = u.storeTusUpload(r.Context(), userID, upload)
+		}
+		if err != nil {
+			u.logger.Errorf("failed to create tus upload, key=%s err=%v", key, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+strconv.FormatUint(fileID, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// tusHead responds offset of a tus upload, so that client can resume it.
+func (u uploader) tusHead() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, ok := u.tusUploadFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// tusPatch appends a chunk at offset of a tus upload, it completes the upload once all data is received.
+func (u uploader) tusPatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != tusContentType {
+			http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		upload, ok := u.tusUploadFromRequest(w, r)
+		if !ok {
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset {
+			http.Error(w, "mismatched Upload-Offset", http.StatusConflict)
+			return
+		}
+		if upload.completed() {
+			http.Error(w, "upload already completed", http.StatusForbidden)
+			return
+		}
+		if r.ContentLength > upload.Length-upload.Offset {
+			http.Error(w, "chunk exceeds Upload-Length", http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength == 0 {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		algorithm, sum, hasher, err := parseTusChecksum(r.Header.Get("Upload-Checksum"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next := *upload
+		staleTail, err := u.writeTusChunk(r.Context(), &next, r.Body, hasher)
+		if err != nil {
+			u.logger.Errorf("failed to write tus chunk, file_id=%d err=%v", upload.FileID, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		// Nothing is committed on mismatch, parts written by this chunk are overwritten by a retry.
+		if hasher != nil && !bytes.Equal(hasher.Sum(nil), sum) {
+			u.removeTusTail(r.Context(), next.Bucket, next.Tail, upload.Tail)
+			u.logger.Debugf("tus chunk checksum mismatch, file_id=%d algorithm=%s", upload.FileID, algorithm)
+
+			http.Error(w, "checksum mismatch", statusChecksumMismatch)
+			return
+		}
+
+		userID := u.amw.GetUserID(r)
+		if next.completed() {
+			err = u.finishTusUpload(r.Context(), &next)
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			if _, err := u.cache.Del(r.Context(), tusCacheKey(userID, upload.FileID)); err != nil {
+				u.logger.Errorf("failed to delete tus upload, file_id=%d err=%v", upload.FileID, err)
+			}
+
+			http.Error(w, "storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == nil {
+			err = u.storeTusUpload(r.Context(), userID, next)
+		}
+		if err != nil {
+			u.logger.Errorf("failed to save tus upload, file_id=%d err=%v", upload.FileID, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		u.removeTusTail(r.Context(), next.Bucket, staleTail, next.Tail)
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(next.Offset, 10))
+		w.Header().Set("Upload-Expires", next.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeTusChunk streams chunk into parts of upload, data shorter than a part is saved as a new tail object.
+// It advances upload in place and returns the tail object consumed by this chunk, if any.
+func (u uploader) writeTusChunk(ctx context.Context, upload *tusUpload, chunk io.Reader, hasher hash.Hash) (staleTail string, err error) {
+	body := &countingReader{r: io.LimitReader(chunk, upload.Length-upload.Offset)}
+	var reader io.Reader = body
+	if hasher != nil {
+		reader = io.TeeReader(body, hasher)
+	}
+
+	if upload.Tail != "" {
+		tail, err := u.storage.GetObject(ctx, upload.Bucket, upload.Tail)
+		if err != nil {
+			return "", err
+		}
+		defer tail.Close()
+
+		reader = io.MultiReader(tail, reader)
+		staleTail = upload.Tail
+	}
+	start := upload.Offset
+	upload.Tail, upload.TailSize = "", 0
+
+	buf := make([]byte, u.config.PartSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		upload.Offset = start + body.n
+
+		// Only the last part of a multipart upload may be shorter than part size.
+		if int64(n) < u.config.PartSize && !upload.completed() {
+			upload.Tail = fmt.Sprintf("%s.part.%d", upload.Key, upload.Offset)
+			upload.TailSize = int64(n)
+			if _, err := u.storage.PutObject(ctx, upload.Bucket, upload.Tail, bytes.NewReader(buf[:n]), int64(n), storage.PutOptions{}); err != nil {
+				return "", err
+			}
+			break
+		}
+
+		partNumber := len(upload.Parts) + 1
+		part, err := u.storage.PutPart(ctx, upload.Bucket, upload.Key, upload.UploadID, partNumber, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return "", err
+		}
+		upload.Parts = append(upload.Parts, part)
+
+		if int64(n) < u.config.PartSize {
+			break
+		}
+	}
+	return staleTail, nil
+}
+
+// finishTusUpload completes the multipart upload of a fully received tus upload and marks its file uploaded.
+// It returns errQuotaExceeded if the upload doesn't fit in quota of its owner anymore.
+func (u uploader) finishTusUpload(ctx context.Context, upload *tusUpload) error {
+	if upload.UploadID != "" {
+		if _, err := u.storage.CompleteMultipartUpload(ctx, upload.Bucket, upload.Key, upload.UploadID, upload.Parts); err != nil {
+			return err
+		}
+		upload.UploadID, upload.Parts = "", nil
+	}
+
+	info, err := u.storage.StatObject(ctx, upload.Bucket, upload.Key)
+	if err != nil {
+		return err
+	}
+
+	return u.commitUpload(ctx, upload.FileID, upload.Bucket, upload.Key, "", info)
+}
+
+// tusDelete terminates a tus upload, discarding its received data and file.
+func (u uploader) tusDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, ok := u.tusUploadFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := u.terminateTusUpload(r.Context(), u.amw.GetUserID(r), upload); err != nil {
+			u.logger.Errorf("failed to terminate tus upload, file_id=%d err=%v", upload.FileID, err)
+
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// terminateTusUpload is an helper for tusDelete.
+// A completed upload is kept, it's deleted through files API instead.
+func (u uploader) terminateTusUpload(ctx context.Context, userID uint64, upload *tusUpload) error {
+	if upload.UploadID != "" {
+		err := u.storage.AbortMultipartUpload(ctx, upload.Bucket, upload.Key, upload.UploadID)
+		if err != nil && !errors.Is(err, storage.ErrUploadNotFound) {
+			return err
+		}
+	}
+	if upload.Tail != "" {
+		if err := u.storage.RemoveObject(ctx, upload.Bucket, upload.Tail); err != nil {
+			return err
+		}
+	}
+
+	sql := `
+		DELETE FROM files
+		WHERE id = $1 AND status = $2;
+	`
+	if err := u.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, upload.FileID, FileStatusPending)
+		return err
+	}); err != nil {
+		return err
+	}
+	_, err := u.cache.Del(ctx, tusCacheKey(userID, upload.FileID))
+	return err
+}
+
+// removeTusTail removes a tail object unless it's still in use. Failures only leave garbage behind,
+// which janitor cleans up, so they are logged.
+func (u uploader) removeTusTail(ctx context.Context, bucket, tail, inUse string) {
+	if tail == "" || tail == inUse {
+		return
+	}
+	if err := u.storage.RemoveObject(ctx, bucket, tail); err != nil {
+		u.logger.Errorf("failed to remove tus tail object, key=%s err=%v", tail, err)
+	}
+}
+
+// storeTusUpload stores upload state in cache until it expires.
+func (u uploader) storeTusUpload(ctx context.Context, userID uint64, upload tusUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return u.cache.Set(ctx, tusCacheKey(userID, upload.FileID), string(b), time.Until(upload.ExpiresAt))
+}
+
+// getTusUpload returns user's tus upload state in cache.
+func (u uploader) getTusUpload(ctx context.Context, userID, fileID uint64) (*tusUpload, error) {
+	val, err := u.cache.Get(ctx, tusCacheKey(userID, fileID))
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, errTusUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal([]byte(val), &upload); err != nil {
+		return nil, err
+	}
+	if err := CheckOwnership(userID, upload.Key); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// tusUploadFromRequest returns user's tus upload addressed by request path.
+// If it returns false, response is already finalized.
+func (u uploader) tusUploadFromRequest(w http.ResponseWriter, r *http.Request) (*tusUpload, bool) {
+	fileID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	upload, err := u.getTusUpload(r.Context(), u.amw.GetUserID(r), fileID)
+	if errors.Is(err, errTusUploadNotFound) {
+		// Expired uploads are indistinguishable from unknown ones once cache drops them.
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if errors.Is(err, ErrObjectNotOwned) {
+		http.Error(w, "upload not owned by user", http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		u.logger.Errorf("failed to get tus upload, file_id=%d err=%v", fileID, err)
+
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return upload, true
+}
+
+// parseTusMetadata parses Upload-Metadata header, a comma separated list of keys with optional base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair: %s", pair)
+		}
+		var value []byte
+		if len(fields) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseTusChecksum parses Upload-Checksum header of algorithm and base64 encoded sum.
+// It returns a nil hasher if header is absent.
+func parseTusChecksum(header string) (algorithm string, sum []byte, hasher hash.Hash, err error) {
+	if header == "" {
+		return "", nil, nil, nil
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return "", nil, nil, errors.New("invalid Upload-Checksum")
+	}
+	algorithm = fields[0]
+	switch algorithm {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
+	default:
+		return "", nil, nil, errors.New("unsupported checksum algorithm")
+	}
+	sum, err = base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", nil, nil, errors.New("invalid Upload-Checksum")
+	}
+	return algorithm, sum, hasher, nil
+}
+
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package upload
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	metadata, err := parseTusMetadata("filename " + encode("world.png") + ", filetype " + encode("image/png") + ",is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"filename": "world.png", "filetype": "image/png", "is_confidential": ""}
+	for k, v := range expected {
+		if got, ok := metadata[k]; !ok || got != v {
+			t.Errorf("expect metadata %s=%q, got %q", k, v, got)
+		}
+	}
+
+	if _, err := parseTusMetadata("filename not-base64!"); err == nil {
+		t.Fatal("expect an error on invalid base64 value")
+	}
+}
+
+func TestParseTusChecksum(t *testing.T) {
+	if _, _, hasher, err := parseTusChecksum(""); err != nil || hasher != nil {
+		t.Fatalf("expect no checksum, got hasher=%v err=%v", hasher, err)
+	}
+
+	sum := sha1.Sum([]byte("hello"))
+	algorithm, got, hasher, err := parseTusChecksum("sha1 " + base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher.Write([]byte("hello"))
+	if algorithm != "sha1" || string(hasher.Sum(nil)) != string(got) {
+		t.Fatal("expect checksum of chunk to match")
+	}
+
+	if _, _, _, err := parseTusChecksum("crc32 AAAA"); err == nil {
+		t.Fatal("expect an error on unsupported algorithm")
+	}
+}
+
+func TestTusMiddleware(t *testing.T) {
+	h := tusMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		method, version string
+		status          int
+	}{
+		{http.MethodOptions, "", http.StatusNoContent},
+		{http.MethodHead, tusVersion, http.StatusNoContent},
+		{http.MethodPatch, "0.2.2", http.StatusPreconditionFailed},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/api/upload/tus/1", nil)
+		if c.version != "" {
+			r.Header.Set("Tus-Resumable", c.version)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s with version %q: expect status %d, got %d", c.method, c.version, c.status, w.Code)
+		}
+		if w.Header().Get("Tus-Resumable") != tusVersion {
+			t.Errorf("%s: expect Tus-Resumable header", c.method)
+		}
+	}
+}
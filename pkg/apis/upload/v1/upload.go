@@ -6,23 +6,134 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/williamlsh/orchid/pkg/apis/auth"
 	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
 	"github.com/williamlsh/orchid/pkg/storage"
 	"go.uber.org/zap"
 )
 
-// Group groups all authentication routers.
+// Group groups all upload routers.
 func Group(
 	logger *zap.SugaredLogger,
 	cache cache.Cache,
-	storage storage.S3Client,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
 	secrets auth.ConfigOptions,
 	r *mux.Router,
 ) {
 	amw := auth.New(logger, cache, secrets)
 	r.Use(amw.MiddlewareMustAuthenticate)
 
-	uploader := newUploader(logger, storage)
+	uploader := newUploader(logger, amw, cache, db, storage, encryptor, config)
 
-	r.Handle("/upload_url", uploader.getPresignedPutObjectURL()).
+	r.Handle("/policy", uploader.getPresignedPostPolicy()).
+		Methods(http.MethodPost)
+	r.Handle("/complete", uploader.completeUpload()).
+		Methods(http.MethodPost)
+	r.HandleFunc("/usage", uploader.getUsage()).
+		Methods(http.MethodGet)
+	if config.Proxy {
+		r.HandleFunc("", uploader.proxyUpload()).
+			Methods(http.MethodPost)
+	}
+
+	// Multipart upload sessions of large files.
+	r.HandleFunc("/sessions", uploader.createSession()).
+		Methods(http.MethodPost).
+		Headers("Content-Type", "application/json")
+	r.HandleFunc("/sessions/{session_id}", uploader.resumeSession()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/sessions/{session_id}", uploader.abortSession()).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/sessions/{session_id}/parts", uploader.presignParts()).
+		Methods(http.MethodPost).
+		Headers("Content-Type", "application/json")
+	r.HandleFunc("/sessions/{session_id}/parts/{part_number:[0-9]+}", uploader.completePart()).
+		Methods(http.MethodPut).
+		Headers("Content-Type", "application/json")
+	r.HandleFunc("/sessions/{session_id}/complete", uploader.completeSession()).
+		Methods(http.MethodPost)
+
+	// tus resumable upload protocol.
+	tr := r.PathPrefix("/tus").Subrouter()
+	tr.Use(tusMiddleware)
+
+	tr.HandleFunc("", uploader.tusOptions()).
+		Methods(http.MethodOptions)
+	tr.HandleFunc("", uploader.tusCreate()).
+		Methods(http.MethodPost)
+	tr.HandleFunc("/{id:[0-9]+}", uploader.tusHead()).
+		Methods(http.MethodHead)
+	tr.HandleFunc("/{id:[0-9]+}", uploader.tusPatch()).
+		Methods(http.MethodPatch)
+	tr.HandleFunc("/{id:[0-9]+}", uploader.tusDelete()).
+		Methods(http.MethodDelete)
+}
+
+// FilesGroup groups all routers of user's files.
+func FilesGroup(
+	logger *zap.SugaredLogger,
+	cache cache.Cache,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+	secrets auth.ConfigOptions,
+	r *mux.Router,
+) {
+	amw := auth.New(logger, cache, secrets)
+	r.Use(amw.MiddlewareMustAuthenticate)
+
+	files := newFiles(logger, amw, cache, db, storage, encryptor, config)
+
+	r.HandleFunc("", files.listFiles()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/{id:[0-9]+}", files.getFile()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/{id:[0-9]+}", files.deleteFile()).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/{id:[0-9]+}/download", files.downloadFile()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/{id:[0-9]+}/image", files.getImage()).
+		Methods(http.MethodGet)
+	if config.Proxy {
+		r.HandleFunc("/{id:[0-9]+}/content", files.fileContent()).
+			Methods(http.MethodGet, http.MethodHead)
+	}
+
+	r.HandleFunc("/trash", files.listTrash()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/trash/{id:[0-9]+}/restore", files.restoreFile()).
+		Methods(http.MethodPost)
+	r.HandleFunc("/trash/{id:[0-9]+}", files.deleteTrashedFile()).
+		Methods(http.MethodDelete)
+
+	r.HandleFunc("/{id:[0-9]+}/shares", files.createShare()).
+		Methods(http.MethodPost).
+		Headers("Content-Type", "application/json")
+	r.HandleFunc("/{id:[0-9]+}/shares", files.listShares()).
+		Methods(http.MethodGet)
+	r.HandleFunc("/{id:[0-9]+}/shares/{share_id:[0-9]+}", files.deleteShare()).
+		Methods(http.MethodDelete)
+}
+
+// SharesGroup groups routers resolving share links, they can be accessed anonymously.
+func SharesGroup(
+	logger *zap.SugaredLogger,
+	cache cache.Cache,
+	db database.Database,
+	storage storage.ObjectStore,
+	encryptor *Encryptor,
+	config ConfigOptions,
+	secrets auth.ConfigOptions,
+	r *mux.Router,
+) {
+	amw := auth.New(logger, cache, secrets)
+	r.Use(amw.MiddlewareOptionallyAuthenticate)
+
+	files := newFiles(logger, amw, cache, db, storage, encryptor, config)
+
+	r.HandleFunc("/{token:[0-9a-f]+}", files.resolveShare()).
 		Methods(http.MethodGet)
 }
@@ -0,0 +1,19 @@
+package users
+
+import "time"
+
+// ConfigOptions provides all config options users needs.
+type ConfigOptions struct {
+	HashIDSalt      string
+	HashIDMinLength int
+	// AnonymousPublicProfile allows unauthenticated users to read public profiles.
+	AnonymousPublicProfile bool
+	// PurgeGracePeriod is how long a deregistered user is kept before being hard deleted.
+	PurgeGracePeriod time.Duration
+	// PurgeInterval is how often deregistered users are purged.
+	PurgeInterval time.Duration
+	// ExportBucket is the bucket user data export archives are stored in.
+	ExportBucket string
+	// ExportTimeout limits how long assembling and delivering a data export may take.
+	ExportTimeout time.Duration
+}
@@ -0,0 +1,277 @@
+package users
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/email"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// exportURLExpiration is expiration time of presigned export archive download url.
+	exportURLExpiration = 24 * time.Hour
+
+	exportDataFile   = "data.json"
+	exportObjectsDir = "objects"
+)
+
+// userData is all data about a user included in an export archive.
+type userData struct {
+	Profile     userProfile      `json:"profile"`
+	Preferences Preferences      `json:"preferences"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	Objects     []exportedObject `json:"objects"`
+}
+
+// exportedObject describes an object uploaded by user.
+type exportedObject struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+	// storageKey is object key holding content, it differs from Key if content is deduplicated.
+	storageKey string
+	// keyID is id of the data key content is encrypted with.
+	keyID uint64
+}
+
+type exporter struct {
+	logger    *zap.SugaredLogger
+	amw       *auth.AuthenticationMiddleware
+	db        database.Database
+	encryptor *upload.Encryptor
+	prefs     PreferenceStore
+	mailConf  email.ConfigOptions
+	bucket    string
+	timeout   time.Duration
+	// running is the set of users whose export is in progress.
+	running *sync.Map
+}
+
+func newExporter(
+	logger *zap.SugaredLogger,
+	amw *auth.AuthenticationMiddleware,
+	db database.Database,
+	encryptor *upload.Encryptor,
+	prefs PreferenceStore,
+	mailConf email.ConfigOptions,
+	bucket string,
+	timeout time.Duration,
+) exporter {
+	return exporter{
+		logger,
+		amw,
+		db,
+		encryptor,
+		prefs,
+		mailConf,
+		bucket,
+		timeout,
+		&sync.Map{},
+	}
+}
+
+// export assembles a ZIP archive of all data about user into object storage in background
+// and emails a presigned download link to user. It responds right away, since the link is delivered by email
+// and assembling a large account may outlive the request. A user has at most one export in progress.
+func (e exporter) export() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := e.amw.GetUserID(r)
+		if _, running := e.running.LoadOrStore(userID, struct{}{}); running {
+			httpx.FinalizeResponse(w, httpx.Success, nil)
+			return
+		}
+
+		go func() {
+			defer e.running.Delete(userID)
+
+			ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+			defer cancel()
+			if err := e.deliverExport(ctx, userID); err != nil {
+				e.logger.Errorf("failed to export user data, userid=%d, err=%v", userID, err)
+			}
+		}()
+
+		httpx.FinalizeResponse(w, httpx.Success, nil)
+	}
+}
+
+// deliverExport stores an export archive of user data and emails its download link to user.
+func (e exporter) deliverExport(ctx context.Context, userID uint64) error {
+	data, err := e.collectUserData(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("could not collect user data: %w", err)
+	}
+
+	link, err := e.storeExportArchive(ctx, userID, data)
+	if err != nil {
+		return fmt.Errorf("could not store export archive: %w", err)
+	}
+
+	content, err := renderExportEmail(link)
+	if err != nil {
+		return fmt.Errorf("could not compose email: %w", err)
+	}
+
+	mail := email.New(e.logger, e.mailConf, data.Profile.Email, "Your data export on Example is ready")
+	if err := mail.Send(content); err != nil {
+		return fmt.Errorf("could not send export link in email: %w", err)
+	}
+	return nil
+}
+
+// collectUserData collects user's profile, preferences, account timestamps and uploaded objects.
+func (e exporter) collectUserData(ctx context.Context, userid uint64) (*userData, error) {
+	conn, err := e.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var data userData
+
+	sql := `
+		SELECT username, email, COALESCE(alias, ''), bio, locale, timezone, avatar, created_at, updated_at
+		FROM users
+		WHERE id = $1;
+	`
+	if err := conn.QueryRow(ctx, sql, userid).Scan(
+		&data.Profile.Username,
+		&data.Profile.Email,
+		&data.Profile.DisplayName,
+		&data.Profile.Bio,
+		&data.Profile.Locale,
+		&data.Profile.Timezone,
+		&data.Profile.Avatar,
+		&data.CreatedAt,
+		&data.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	data.Preferences, err = e.prefs.Get(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := upload.ListFiles(ctx, e.db, userid)
+	if err != nil {
+		return nil, err
+	}
+	data.Objects = []exportedObject{}
+	for _, f := range files {
+		// Content is exported only once it's scanned clean, like any download.
+		if f.Status != upload.FileStatusUploaded || f.ScanStatus != upload.ScanStatusClean {
+			continue
+		}
+		if err := upload.CheckOwnership(userid, f.Key); err != nil {
+			return nil, err
+		}
+		data.Objects = append(data.Objects, exportedObject{
+			Bucket:       f.Bucket,
+			Key:          f.Key,
+			Size:         f.Size,
+			ContentType:  f.ContentType,
+			ETag:         f.Checksum,
+			LastModified: f.CreatedAt,
+			storageKey:   f.StorageKey(),
+			keyID:        f.KeyID,
+		})
+	}
+
+	return &data, nil
+}
+
+// openObject returns a function opening object content from storage.
+func (e exporter) openObject(ctx context.Context) func(object exportedObject) (io.ReadCloser, error) {
+	return func(object exportedObject) (io.ReadCloser, error) {
+		return e.encryptor.GetObject(ctx, object.Bucket, object.storageKey, object.keyID)
+	}
+}
+
+// storeExportArchive streams a ZIP archive of data into export bucket encrypted with data key of user
+// and returns a presigned download url. Archive is written as it's uploaded, so it's never held in memory.
+func (e exporter) storeExportArchive(ctx context.Context, userid uint64, data *userData) (string, error) {
+	prefix, err := upload.UserPrefix(userid)
+	if err != nil {
+		return "", err
+	}
+	dk, err := e.encryptor.DataKey(ctx, userid)
+	if err != nil {
+		return "", err
+	}
+
+	key := path.Join(prefix, time.Now().UTC().Format("20060102T150405Z")+".zip")
+	pr, pw := io.Pipe()
+	go func() {
+		// Failing to write archive fails the upload reading it.
+		pw.CloseWithError(writeExportArchive(pw, data, e.openObject(ctx)))
+	}()
+	err = e.encryptor.PutObject(ctx, e.bucket, key, dk, pr, -1, storage.PutOptions{
+		ContentType: "application/zip",
+	})
+	// Unblocks writing archive if upload stopped reading it early.
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", err
+	}
+
+	reqParams := make(url.Values)
+	reqParams.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+	u, err := e.encryptor.PresignGet(ctx, e.bucket, key, dk.ID, exportURLExpiration, reqParams)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// writeExportArchive writes a ZIP archive of user data to w,
+// object contents are read through open and stored under objects directory.
+func writeExportArchive(w io.Writer, data *userData, open func(object exportedObject) (io.ReadCloser, error)) error {
+	zw := zip.NewWriter(w)
+
+	f, err := zw.Create(exportDataFile)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		return err
+	}
+
+	for _, object := range data.Objects {
+		f, err := zw.Create(path.Join(exportObjectsDir, object.Bucket, object.Key))
+		if err != nil {
+			return err
+		}
+		rc, err := open(object)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,134 @@
+package users
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+func TestWriteExportArchive(t *testing.T) {
+	data := &userData{
+		Profile: userProfile{
+			Username: "example",
+			Email:    "example@outlook.com",
+			Avatar:   "checksum",
+		},
+		Objects: []exportedObject{
+			{Bucket: "all", Key: "checksum", Size: 6},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeExportArchive(&buf, data, func(object exportedObject) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("avatar")), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+
+	var got userData
+	if err := json.Unmarshal([]byte(files[exportDataFile]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Profile != data.Profile {
+		t.Fatalf("expect profile %+v, got %+v", data.Profile, got.Profile)
+	}
+	if content := files["objects/all/checksum"]; content != "avatar" {
+		t.Fatalf("expect object content %q, got %q", "avatar", content)
+	}
+}
+
+func TestStoreExportArchive(t *testing.T) {
+	ctx := context.Background()
+	objects, err := storage.NewMemory(ctx, storage.ConfigOptions{
+		PublicURL:     "http://127.0.0.1/storage",
+		SigningSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := objects.PrepareBuckets(ctx, "all", "exports"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := objects.PutObject(ctx, "all", "avatar", strings.NewReader("avatar"), -1, storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Encryption is disabled, so database is never reached.
+	encryptor, err := upload.NewEncryptor(zap.NewNop().Sugar(), database.Database{}, objects, upload.ConfigOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := exporter{encryptor: encryptor, bucket: "exports"}
+
+	data := &userData{Objects: []exportedObject{
+		{Bucket: "all", Key: "avatar", Size: 6, storageKey: "avatar"},
+	}}
+	if _, err := e.storeExportArchive(ctx, 1, data); err != nil {
+		t.Fatal(err)
+	}
+	var archives []storage.ObjectInfo
+	if err := objects.ListObjects(ctx, "exports", "", func(info storage.ObjectInfo) error {
+		archives = append(archives, info)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 {
+		t.Fatalf("expect one archive stored, got %d", len(archives))
+	}
+	rc, err := objects.GetObject(ctx, "exports", archives[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatalf("expect a valid archive: %v", err)
+	}
+
+	// An archive failing to be written midway isn't stored.
+	if err := objects.RemoveObject(ctx, "exports", archives[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	data.Objects = append(data.Objects, exportedObject{Bucket: "all", Key: "missing", storageKey: "missing"})
+	if _, err := e.storeExportArchive(ctx, 1, data); err == nil {
+		t.Fatal("expect an error")
+	}
+	if err := objects.ListObjects(ctx, "exports", "", func(info storage.ObjectInfo) error {
+		t.Fatalf("expect no archive stored, got %s", info.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
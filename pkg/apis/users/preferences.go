@@ -0,0 +1,281 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"go.uber.org/zap"
+)
+
+const (
+	// cachePreferencesKeyPrefix is a users cache key prefix to set user preferences.
+	cachePreferencesKeyPrefix = "users:preferences"
+
+	preferencesCacheExpiration = time.Hour
+)
+
+// Known preference keys.
+const (
+	// PreferenceEmailNotifications opts user in or out of notification emails.
+	PreferenceEmailNotifications = "email_notifications"
+	// PreferenceEmailMarketing opts user in or out of marketing emails.
+	PreferenceEmailMarketing = "email_marketing"
+	// PreferenceTheme is user's UI theme.
+	PreferenceTheme = "theme"
+)
+
+// preferenceSchema describes a known preference key.
+type preferenceSchema struct {
+	defaultValue interface{}
+	// validate returns an error message if value is invalid.
+	validate func(value interface{}) string
+}
+
+var preferenceSchemas = map[string]preferenceSchema{
+	PreferenceEmailNotifications: {true, isBool},
+	PreferenceEmailMarketing:     {false, isBool},
+	PreferenceTheme:              {"system", isOneOf("system", "light", "dark")},
+}
+
+func isBool(value interface{}) string {
+	if _, ok := value.(bool); !ok {
+		return "must be a boolean"
+	}
+	return ""
+}
+
+func isOneOf(options ...string) func(value interface{}) string {
+	return func(value interface{}) string {
+		if s, ok := value.(string); ok {
+			for _, option := range options {
+				if s == option {
+					return ""
+				}
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	}
+}
+
+// Preferences is user's preferences keyed by preference key.
+type Preferences map[string]interface{}
+
+// Bool returns a boolean preference, it's false if key is unknown.
+func (p Preferences) Bool(key string) bool {
+	b, _ := p[key].(bool)
+	return b
+}
+
+// String returns a string preference, it's empty if key is unknown.
+func (p Preferences) String(key string) string {
+	s, _ := p[key].(string)
+	return s
+}
+
+// validatePreferences validates preferences against known keys schemas.
+// It returns a key to error message map, which is empty if all preferences are valid.
+func validatePreferences(prefs Preferences) map[string]string {
+	fieldErrors := make(map[string]string)
+	for key, value := range prefs {
+		schema, ok := preferenceSchemas[key]
+		if !ok {
+			fieldErrors[key] = "unknown preference"
+			continue
+		}
+		if msg := schema.validate(value); msg != "" {
+			fieldErrors[key] = msg
+		}
+	}
+	return fieldErrors
+}
+
+// withDefaults returns preferences of all known keys,
+// keys not set in stored preferences have default values.
+func withDefaults(stored Preferences) Preferences {
+	prefs := make(Preferences, len(preferenceSchemas))
+	for key, schema := range preferenceSchemas {
+		if value, ok := stored[key]; ok && schema.validate(value) == "" {
+			prefs[key] = value
+		} else {
+			prefs[key] = schema.defaultValue
+		}
+	}
+	return prefs
+}
+
+// PreferenceStore stores user preferences in database with a read-through cache.
+type PreferenceStore struct {
+	logger *zap.SugaredLogger
+	cache  cache.Cache
+	db     database.Database
+}
+
+// NewPreferenceStore returns a new PreferenceStore.
+func NewPreferenceStore(logger *zap.SugaredLogger, cache cache.Cache, db database.Database) PreferenceStore {
+	return PreferenceStore{
+		logger,
+		cache,
+		db,
+	}
+}
+
+// Get returns all preferences of user including defaults.
+func (s PreferenceStore) Get(ctx context.Context, userid uint64) (Preferences, error) {
+	key := preferencesCacheKey(userid)
+
+	cached, err := s.cache.Get(ctx, key)
+	if err == nil {
+		var stored Preferences
+		if err := json.Unmarshal([]byte(cached), &stored); err == nil {
+			return withDefaults(stored), nil
+		}
+		s.logger.Errorf("could not decode cached preferences, userid=%d, err=%v", userid, err)
+	} else if !errors.Is(err, cache.ErrNotFound) {
+		// Cache is only an optimization, fall back to database.
+		s.logger.Errorf("could not get cached preferences, userid=%d, err=%v", userid, err)
+	}
+
+	stored, raw, err := s.getStoredPreferences(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.Set(ctx, key, string(raw), preferencesCacheExpiration); err != nil {
+		s.logger.Errorf("could not cache preferences, userid=%d, err=%v", userid, err)
+	}
+
+	return withDefaults(stored), nil
+}
+
+// Set replaces all stored preferences of user, absent keys fall back to defaults.
+// Preferences must be validated before.
+func (s PreferenceStore) Set(ctx context.Context, userid uint64, prefs Preferences) error {
+	raw, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+
+	sql := `
+		INSERT INTO user_preferences (user_id, preferences)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id)
+		DO
+			UPDATE SET preferences = EXCLUDED.preferences;
+	`
+	if err := s.db.InTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, userid, raw)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// Invalidate cache after database is updated, the next Get reads through.
+	_, err = s.cache.Del(ctx, preferencesCacheKey(userid))
+	return err
+}
+
+// getStoredPreferences returns user's stored preferences and its raw JSON.
+func (s PreferenceStore) getStoredPreferences(ctx context.Context, userid uint64) (Preferences, []byte, error) {
+	conn, err := s.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Release()
+
+	var raw []byte
+
+	sql := `
+		SELECT preferences
+		FROM user_preferences
+		WHERE user_id = $1;
+	`
+	err = conn.QueryRow(ctx, sql, userid).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		raw = []byte("{}")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var stored Preferences
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, nil, err
+	}
+	return stored, raw, nil
+}
+
+func preferencesCacheKey(userid uint64) string {
+	return cachePreferencesKeyPrefix + ":" + strconv.FormatUint(userid, 10)
+}
+
+type preference struct {
+	logger *zap.SugaredLogger
+	amw    *auth.AuthenticationMiddleware
+	store  PreferenceStore
+}
+
+func newPreference(
+	logger *zap.SugaredLogger,
+	amw *auth.AuthenticationMiddleware,
+	store PreferenceStore,
+) preference {
+	return preference{
+		logger,
+		amw,
+		store,
+	}
+}
+
+// getPreferences returns user's preferences.
+func (p preference) getPreferences() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := p.amw.GetUserID(r)
+		prefs, err := p.store.Get(r.Context(), userID)
+		if err != nil {
+			p.logger.Errorf("failed to get preferences, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, prefs)
+	}
+}
+
+// putPreferences replaces user's preferences.
+func (p preference) putPreferences() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var prefs Preferences
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
+			return
+		}
+		if prefs == nil {
+			prefs = Preferences{}
+		}
+
+		if fieldErrors := validatePreferences(prefs); len(fieldErrors) > 0 {
+			httpx.FinalizeResponse(w, httpx.ErrUserInvalidPreferences, fieldErrors)
+			return
+		}
+
+		userID := p.amw.GetUserID(r)
+		if err := p.store.Set(r.Context(), userID, prefs); err != nil {
+			p.logger.Errorf("failed to set preferences, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
+		httpx.FinalizeResponse(w, httpx.Success, withDefaults(prefs))
+	}
+}
@@ -0,0 +1,69 @@
+package users
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/williamlsh/orchid/pkg/cache"
+	"github.com/williamlsh/orchid/pkg/database"
+	"go.uber.org/zap"
+)
+
+func TestValidatePreferences(t *testing.T) {
+	fieldErrors := validatePreferences(Preferences{
+		PreferenceEmailNotifications: false,
+		PreferenceTheme:              "dark",
+	})
+	if len(fieldErrors) != 0 {
+		t.Fatalf("unexpected field errors: %v", fieldErrors)
+	}
+
+	fieldErrors = validatePreferences(Preferences{
+		PreferenceEmailMarketing: "yes",
+		PreferenceTheme:          "pink",
+		"unknown":                1,
+	})
+	for _, key := range []string{PreferenceEmailMarketing, PreferenceTheme, "unknown"} {
+		if fieldErrors[key] == "" {
+			t.Errorf("expect an error on key %s", key)
+		}
+	}
+}
+
+func TestPreferenceStoreReadThrough(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	t.Cleanup(func() {
+		client.Close()
+		mr.Close()
+	})
+
+	// A cached user never reaches database, so a zero database is enough.
+	store := NewPreferenceStore(zap.NewExample().Sugar(), &cache.Redis{Client: client}, database.Database{})
+	if err := mr.Set(preferencesCacheKey(1), `{"theme":"dark","unknown":true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	prefs, err := store.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prefs.String(PreferenceTheme); got != "dark" {
+		t.Fatalf("expect cached theme dark, got %s", got)
+	}
+	if !prefs.Bool(PreferenceEmailNotifications) {
+		t.Fatal("expect default email notifications on")
+	}
+	if _, ok := prefs["unknown"]; ok {
+		t.Fatal("expect unknown key dropped")
+	}
+}
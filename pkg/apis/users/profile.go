@@ -3,54 +3,120 @@ package users
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/hashidsx"
 	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
 	"github.com/williamlsh/orchid/pkg/database"
 	"go.uber.org/zap"
+	"golang.org/x/text/language"
 )
 
+const (
+	maxUsernameLength    = 50
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxLocaleLength      = 35
+	maxTimezoneLength    = 64
+	maxAvatarLength      = 300
+
+	// pgUniqueViolation is the postgreSQL error code of unique constraint violation.
+	pgUniqueViolation = "23505"
+)
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
 type userProfile struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	HashID      string `json:"hashid"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Locale      string `json:"locale"`
+	Timezone    string `json:"timezone"`
+	Avatar      string `json:"avatar"`
+}
+
+// profilePatch is a partial update of user's profile.
+// A nil field is absent from request and is left untouched,
+// an empty string clears the field except for username and display name.
+type profilePatch struct {
+	Username    *string `json:"username"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	Locale      *string `json:"locale"`
+	Timezone    *string `json:"timezone"`
+	Avatar      *string `json:"avatar"`
 }
 
 type profile struct {
 	logger *zap.SugaredLogger
 	amw    *auth.AuthenticationMiddleware
 	db     database.Database
+	hd     hashidsx.HashID
 }
 
 func newProfile(
 	logger *zap.SugaredLogger,
 	amw *auth.AuthenticationMiddleware,
 	db database.Database,
+	hd hashidsx.HashID,
 ) profile {
 	return profile{
 		logger,
 		amw,
 		db,
+		hd,
 	}
 }
 
-// updateProfile updates user's profile.
+// updateProfile updates user's profile with PATCH semantics,
+// only fields present in request body are updated.
 func (p profile) updateProfile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: more user info can be added here later.
-		var reqBody struct {
-			Username string
-		}
-		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		var patch profilePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
 			httpx.FinalizeResponse(w, httpx.ErrRequestDecodeJSON, nil)
 			return
 		}
 
-		if err := p.updateUsername(r.Context(), p.amw.GetUserID(), reqBody.Username); err != nil {
+		fieldErrors := patch.validate()
+		if patch.Avatar != nil && *patch.Avatar != "" && fieldErrors["avatar"] == "" {
+			exists, err := p.isAvatarUploaded(r.Context(), p.amw.GetUserID(r), *patch.Avatar)
+			if err != nil {
+				p.logger.Errorf("failed to check avatar object: %v", err)
+
+				httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+				return
+			}
+			if !exists {
+				fieldErrors["avatar"] = "object not uploaded"
+			}
+		}
+		if len(fieldErrors) > 0 {
+			httpx.FinalizeResponse(w, httpx.ErrUserInvalidProfile, fieldErrors)
+			return
+		}
+
+		if err := p.patchProfile(r.Context(), p.amw.GetUserID(r), patch); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+				httpx.FinalizeResponse(w, httpx.ErrUsernameAlreadyInUse, nil)
+				return
+			}
 			p.logger.Errorf("failed to update profile: %v", err)
 
-			httpx.FinalizeResponse(w, httpx.ErrUsernameAlreadyInUse, nil)
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
 			return
 		}
 
@@ -61,8 +127,8 @@ func (p profile) updateProfile() http.HandlerFunc {
 // getProfile returns user's profile.
 func (p profile) getProfile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := p.amw.GetUserID()
-		userProfile, err := p.getUsername(r.Context(), userID)
+		userID := p.amw.GetUserID(r)
+		userProfile, err := p.getUserProfile(r.Context(), userID)
 		if err != nil {
 			p.logger.Errorf("failed to get profile, userid=%d, err=%v", userID, err)
 
@@ -70,37 +136,163 @@ func (p profile) getProfile() http.HandlerFunc {
 			return
 		}
 
+		userProfile.HashID, err = p.hd.Encode(int(userID))
+		if err != nil {
+			p.logger.Errorf("failed to encode hashid, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+
 		httpx.FinalizeResponse(w, httpx.Success, userProfile)
 	}
 }
 
-// updateUsername is an helper for updateProfile.
-func (p profile) updateUsername(ctx context.Context, userid uint64, new string) error {
+// validate validates every present field of patch and normalizes them in place.
+// It returns a field name to error message map, which is empty if all fields are valid.
+func (patch *profilePatch) validate() map[string]string {
+	fieldErrors := make(map[string]string)
+
+	if patch.Username != nil {
+		username := strings.TrimSpace(*patch.Username)
+		switch {
+		case username == "":
+			fieldErrors["username"] = "must not be empty"
+		case utf8.RuneCountInString(username) > maxUsernameLength:
+			fieldErrors["username"] = fmt.Sprintf("must be at most %d characters", maxUsernameLength)
+		case !usernameRegex.MatchString(username):
+			fieldErrors["username"] = "may only contain letters, digits, '_', '.' and '-'"
+		}
+		patch.Username = &username
+	}
+
+	if patch.DisplayName != nil {
+		displayName := strings.TrimSpace(*patch.DisplayName)
+		switch {
+		case displayName == "":
+			fieldErrors["display_name"] = "must not be empty"
+		case utf8.RuneCountInString(displayName) > maxDisplayNameLength:
+			fieldErrors["display_name"] = fmt.Sprintf("must be at most %d characters", maxDisplayNameLength)
+		}
+		patch.DisplayName = &displayName
+	}
+
+	if patch.Bio != nil && utf8.RuneCountInString(*patch.Bio) > maxBioLength {
+		fieldErrors["bio"] = fmt.Sprintf("must be at most %d characters", maxBioLength)
+	}
+
+	if patch.Locale != nil && *patch.Locale != "" {
+		tag, err := language.Parse(*patch.Locale)
+		if err != nil || len(tag.String()) > maxLocaleLength {
+			fieldErrors["locale"] = "must be a valid BCP 47 language tag"
+		} else {
+			locale := tag.String()
+			patch.Locale = &locale
+		}
+	}
+
+	if patch.Timezone != nil && *patch.Timezone != "" {
+		if len(*patch.Timezone) > maxTimezoneLength || *patch.Timezone == "Local" {
+			fieldErrors["timezone"] = "must be a valid IANA time zone"
+		} else if _, err := time.LoadLocation(*patch.Timezone); err != nil {
+			fieldErrors["timezone"] = "must be a valid IANA time zone"
+		}
+	}
+
+	if patch.Avatar != nil && len(*patch.Avatar) > maxAvatarLength {
+		fieldErrors["avatar"] = fmt.Sprintf("must be at most %d characters", maxAvatarLength)
+	}
+
+	return fieldErrors
+}
+
+// columns returns column names and values of present fields in patch.
+func (patch profilePatch) columns() (columns []string, values []interface{}) {
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"username", patch.Username},
+		{"alias", patch.DisplayName},
+		{"bio", patch.Bio},
+		{"locale", patch.Locale},
+		{"timezone", patch.Timezone},
+		{"avatar", patch.Avatar},
+	} {
+		if field.value != nil {
+			columns = append(columns, field.column)
+			values = append(values, *field.value)
+		}
+	}
+	return
+}
+
+// isAvatarUploaded checks whether an avatar object was uploaded by user through upload API for avatar purpose.
+func (p profile) isAvatarUploaded(ctx context.Context, userid uint64, avatar string) (bool, error) {
+	conn, err := p.db.Pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
 	sql := `
-		UPDATE users
-		SET username = $1
-		WHERE id = $2;
+		SELECT EXISTS (
+			SELECT 1 FROM files
+			WHERE owner_id = $1 AND purpose = $2 AND object_key = $3 AND status = $4
+		);
 	`
+	var exists bool
+	err = conn.QueryRow(ctx, sql, userid, upload.PurposeAvatar, avatar, upload.FileStatusUploaded).Scan(&exists)
+	return exists, err
+}
+
+// patchProfile is an helper for updateProfile.
+func (p profile) patchProfile(ctx context.Context, userid uint64, patch profilePatch) error {
+	columns, values := patch.columns()
+	if len(columns) == 0 {
+		return nil
+	}
+
+	// Column names come from a fixed set, only values are user input.
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = fmt.Sprintf("%s = $%d", column, i+1)
+	}
+	sql := fmt.Sprintf(`
+		UPDATE users
+		SET %s
+		WHERE id = $%d;
+	`, strings.Join(assignments, ", "), len(columns)+1)
+
 	return p.db.InTx(ctx, func(tx pgx.Tx) error {
-		_, err := tx.Exec(ctx, sql, new, userid)
+		_, err := tx.Exec(ctx, sql, append(values, userid)...)
 		return err
 	})
 }
 
-// getUsername is an helper for getProfile.
-func (p profile) getUsername(ctx context.Context, userid uint64) (*userProfile, error) {
+// getUserProfile is an helper for getProfile.
+func (p profile) getUserProfile(ctx context.Context, userid uint64) (*userProfile, error) {
 	conn, err := p.db.Pool.Acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Release()
 
 	var profile userProfile
 
 	sql := `
-		SELECT username, email
+		SELECT username, email, COALESCE(alias, ''), bio, locale, timezone, avatar
 		FROM users
 		WHERE id = $1;
 	`
-	err = conn.QueryRow(ctx, sql, userid).Scan(&profile.Username, &profile.Email)
+	err = conn.QueryRow(ctx, sql, userid).Scan(
+		&profile.Username,
+		&profile.Email,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.Locale,
+		&profile.Timezone,
+		&profile.Avatar,
+	)
 	return &profile, err
 }
@@ -0,0 +1,57 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfilePatchValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	t.Run("valid fields", func(t *testing.T) {
+		patch := profilePatch{
+			Username:    str(" william "),
+			DisplayName: str("William"),
+			Bio:         str("Hello"),
+			Locale:      str("en-us"),
+			Timezone:    str("Asia/Shanghai"),
+			Avatar:      str(""),
+		}
+		if fieldErrors := patch.validate(); len(fieldErrors) != 0 {
+			t.Fatalf("unexpected field errors: %v", fieldErrors)
+		}
+		if *patch.Username != "william" {
+			t.Fatalf("expect trimmed username, got %q", *patch.Username)
+		}
+		if *patch.Locale != "en-US" {
+			t.Fatalf("expect canonical locale, got %q", *patch.Locale)
+		}
+	})
+
+	t.Run("invalid fields", func(t *testing.T) {
+		patch := profilePatch{
+			Username:    str("wil liam"),
+			DisplayName: str("  "),
+			Bio:         str(strings.Repeat("a", maxBioLength+1)),
+			Locale:      str("not a locale"),
+			Timezone:    str("Mars/Olympus"),
+			Avatar:      str(strings.Repeat("a", maxAvatarLength+1)),
+		}
+		fieldErrors := patch.validate()
+		for _, field := range []string{"username", "display_name", "bio", "locale", "timezone", "avatar"} {
+			if fieldErrors[field] == "" {
+				t.Errorf("expect an error on field %s", field)
+			}
+		}
+	})
+
+	t.Run("absent fields", func(t *testing.T) {
+		var patch profilePatch
+		if fieldErrors := patch.validate(); len(fieldErrors) != 0 {
+			t.Fatalf("unexpected field errors: %v", fieldErrors)
+		}
+		if columns, _ := patch.columns(); len(columns) != 0 {
+			t.Fatalf("expect no columns, got %v", columns)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/internal/hashidsx"
+	"github.com/williamlsh/orchid/pkg/apis/internal/httpx"
+	"github.com/williamlsh/orchid/pkg/database"
+	"go.uber.org/zap"
+)
+
+// publicUserProfile is the subset of user's profile visible to everyone.
+type publicUserProfile struct {
+	HashID      string `json:"hashid"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Avatar      string `json:"avatar"`
+}
+
+type publicProfile struct {
+	logger *zap.SugaredLogger
+	db     database.Database
+	hd     hashidsx.HashID
+}
+
+func newPublicProfile(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	hd hashidsx.HashID,
+) publicProfile {
+	return publicProfile{
+		logger,
+		db,
+		hd,
+	}
+}
+
+// getPublicProfile returns public profile of any user addressed by hashid.
+func (p publicProfile) getPublicProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hashid := mux.Vars(r)["hashid"]
+		userID, err := p.hd.Decode(hashid)
+		if err != nil {
+			p.logger.Debugf("invalid hashid=%s, err=%v", hashid, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrUserNotFound, nil)
+			return
+		}
+
+		profile, err := p.getPublicUserProfile(r.Context(), uint64(userID))
+		if errors.Is(err, pgx.ErrNoRows) {
+			httpx.FinalizeResponse(w, httpx.ErrUserNotFound, nil)
+			return
+		}
+		if err != nil {
+			p.logger.Errorf("failed to get public profile, userid=%d, err=%v", userID, err)
+
+			httpx.FinalizeResponse(w, httpx.ErrServiceUnavailable, nil)
+			return
+		}
+		profile.HashID = hashid
+
+		httpx.FinalizeResponse(w, httpx.Success, profile)
+	}
+}
+
+// getPublicUserProfile is an helper for getPublicProfile.
+// Deregistered users are not visible.
+func (p publicProfile) getPublicUserProfile(ctx context.Context, userid uint64) (*publicUserProfile, error) {
+	conn, err := p.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var profile publicUserProfile
+
+	sql := `
+		SELECT username, COALESCE(alias, ''), bio, avatar
+		FROM users
+		WHERE id = $1 AND deregistered = $2;
+	`
+	err = conn.QueryRow(ctx, sql, userid, false).Scan(
+		&profile.Username,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.Avatar,
+	)
+	return &profile, err
+}
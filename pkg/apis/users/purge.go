@@ -0,0 +1,184 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
+	"github.com/williamlsh/orchid/pkg/database"
+	"github.com/williamlsh/orchid/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// Purger hard deletes deregistered users after a grace period.
+type Purger struct {
+	logger       *zap.SugaredLogger
+	db           database.Database
+	storage      storage.ObjectStore
+	gracePeriod  time.Duration
+	exportBucket string
+}
+
+// NewPurger returns a new Purger.
+func NewPurger(
+	logger *zap.SugaredLogger,
+	db database.Database,
+	storage storage.ObjectStore,
+	config ConfigOptions,
+) Purger {
+	return Purger{
+		logger,
+		db,
+		storage,
+		config.PurgeGracePeriod,
+		config.ExportBucket,
+	}
+}
+
+// purgedObject is an uploaded object of a purged user.
+type purgedObject struct {
+	bucket, key string
+	// inBlob reports whether content is in a blob rather than at key.
+	inBlob bool
+}
+
+// Purge deletes users deregistered longer than grace period ago together with their uploaded files and export archives.
+// It's meant to run periodically as a background job.
+// A user failing to be purged is logged and left for the next run, the others are still purged.
+func (p Purger) Purge(ctx context.Context) error {
+	before := time.Now().Add(-p.gracePeriod)
+	userids, err := p.expiredUsers(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, id := range userids {
+		if err := p.purgeUser(ctx, id, before); err != nil {
+			p.logger.Errorf("failed to purge deregistered user, userid=%d err=%v", id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.logger.Debugf("Purged deregistered user: %d", id)
+	}
+	return firstErr
+}
+
+// expiredUsers returns ids of users deregistered before a time.
+func (p Purger) expiredUsers(ctx context.Context, before time.Time) ([]uint64, error) {
+	conn, err := p.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	sql := `
+		SELECT id FROM users
+		WHERE deregistered = $1 AND deregistered_at < $2;
+	`
+	rows, err := conn.Query(ctx, sql, true, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userids []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userids = append(userids, id)
+	}
+	return userids, rows.Err()
+}
+
+// purgeUser deletes a user deregistered before a time together with its files, their objects and export archives.
+// Objects are removed before rows are committed, so that a failed removal rolls back and is retried by the next run.
+// Removing objects is idempotent, objects removed by a failed run are simply missing next time.
+func (p Purger) purgeUser(ctx context.Context, userid uint64, before time.Time) error {
+	// The user may be restored meanwhile, locking its row keeps it deregistered till purged.
+	userSQL := `
+		SELECT id FROM users
+		WHERE id = $1 AND deregistered = $2 AND deregistered_at < $3
+		FOR UPDATE;
+	`
+	// Files are deleted explicitly rather than by cascade, so that their objects and blobs are known.
+	filesSQL := `
+		DELETE FROM files
+		WHERE owner_id = $1
+		RETURNING bucket, object_key, blob_id;
+	`
+
+	return p.db.InTx(ctx, func(tx pgx.Tx) error {
+		var id uint64
+		err := tx.QueryRow(ctx, userSQL, userid, true, before).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var (
+			objects []purgedObject
+			blobIDs []uint64
+		)
+		rows, err := tx.Query(ctx, filesSQL, userid)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var (
+				o      purgedObject
+				blobID *uint64
+			)
+			if err := rows.Scan(&o.bucket, &o.key, &blobID); err != nil {
+				rows.Close()
+				return err
+			}
+			// Content of an uploaded file is in a blob possibly shared with other users.
+			if blobID != nil {
+				blobIDs = append(blobIDs, *blobID)
+				o.inBlob = true
+			}
+			objects = append(objects, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := upload.ReleaseBlobs(ctx, tx, blobIDs); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1;`, userid); err != nil {
+			return err
+		}
+
+		for _, o := range objects {
+			if !o.inBlob {
+				if err := p.storage.RemoveObject(ctx, o.bucket, o.key); err != nil {
+					return err
+				}
+			}
+			if err := upload.RemoveThumbnails(ctx, p.storage, o.bucket, o.key); err != nil {
+				return err
+			}
+		}
+		return p.removeExportArchives(ctx, userid)
+	})
+}
+
+// removeExportArchives removes all export archives of user.
+func (p Purger) removeExportArchives(ctx context.Context, userid uint64) error {
+	prefix, err := upload.UserPrefix(userid)
+	if err != nil {
+		return err
+	}
+
+	return p.storage.RemovePrefix(ctx, p.exportBucket, prefix)
+}
@@ -0,0 +1,43 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+)
+
+var exportTpl = template.Must(template.New("export").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+
+<head>
+    <meta charset="UTF-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <title>Your data export</title>
+</head>
+
+<body>
+    <h2>Your data export is ready</h2>
+    <p>Click the link below to download an archive of all data we store about you.</p>
+    <p>This link will expire in {{.Expiration}}.</p>
+    <p><a href="{{.URL}}">{{.URL}}</a></p>
+    <hr />
+    <p>If you did not make this request, please secure your account.</p>
+</body>
+
+</html>
+`))
+
+func renderExportEmail(link string) (string, error) {
+	var buf bytes.Buffer
+	if err := exportTpl.Execute(&buf, struct {
+		URL        template.URL
+		Expiration string
+	}{
+		URL:        template.URL(link),
+		Expiration: fmt.Sprintf("%.0f hours", exportURLExpiration.Hours()),
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
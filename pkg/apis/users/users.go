@@ -5,6 +5,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/williamlsh/orchid/pkg/apis/auth"
+	"github.com/williamlsh/orchid/pkg/apis/internal/hashidsx"
+	"github.com/williamlsh/orchid/pkg/apis/upload/v1"
 	"github.com/williamlsh/orchid/pkg/cache"
 	"github.com/williamlsh/orchid/pkg/database"
 	"github.com/williamlsh/orchid/pkg/email"
@@ -16,7 +18,9 @@ func Group(
 	logger *zap.SugaredLogger,
 	cache cache.Cache,
 	db database.Database,
+	encryptor *upload.Encryptor,
 	email email.ConfigOptions,
+	config ConfigOptions,
 	secrets auth.ConfigOptions,
 	r *mux.Router,
 ) {
@@ -24,12 +28,60 @@ func Group(
 	r.Use(amw.MiddlewareMustAuthenticate)
 
 	// The user profile handlers.
-	p := newProfile(logger, amw, db)
+	p := newProfile(logger, amw, db, newHashID(config))
 
+	// POST is kept for compatibility, both methods do partial updates.
 	r.HandleFunc("/profile", p.updateProfile()).
-		Methods(http.MethodPost).
+		Methods(http.MethodPatch, http.MethodPost).
 		Headers("Content-Type", "application/json")
 
 	r.HandleFunc("/profile", p.getProfile()).
 		Methods(http.MethodGet)
+
+	// The user preferences handlers.
+	prefs := NewPreferenceStore(logger, cache, db)
+	pref := newPreference(logger, amw, prefs)
+
+	r.HandleFunc("/preferences", pref.putPreferences()).
+		Methods(http.MethodPut).
+		Headers("Content-Type", "application/json")
+
+	r.HandleFunc("/preferences", pref.getPreferences()).
+		Methods(http.MethodGet)
+
+	// The user data export handler.
+	e := newExporter(logger, amw, db, encryptor, prefs, email, config.ExportBucket, config.ExportTimeout)
+
+	r.HandleFunc("/export", e.export()).
+		Methods(http.MethodPost)
+}
+
+// PublicGroup groups all routers of users' public data.
+// They can be accessed anonymously if config allows.
+func PublicGroup(
+	logger *zap.SugaredLogger,
+	cache cache.Cache,
+	db database.Database,
+	config ConfigOptions,
+	secrets auth.ConfigOptions,
+	r *mux.Router,
+) {
+	amw := auth.New(logger, cache, secrets)
+	if config.AnonymousPublicProfile {
+		r.Use(amw.MiddlewareOptionallyAuthenticate)
+	} else {
+		r.Use(amw.MiddlewareMustAuthenticate)
+	}
+
+	pp := newPublicProfile(logger, db, newHashID(config))
+
+	r.HandleFunc("/{hashid}", pp.getPublicProfile()).
+		Methods(http.MethodGet)
+}
+
+func newHashID(config ConfigOptions) hashidsx.HashID {
+	return hashidsx.New(hashidsx.ConfigOptions{
+		Salt:      config.HashIDSalt,
+		MinLength: config.HashIDMinLength,
+	})
 }
@@ -2,62 +2,80 @@ package cache
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
-
-	"github.com/go-redis/redis/v8"
-	"github.com/williamlsh/orchid/pkg/logging"
-	"go.uber.org/zap"
 )
 
 const (
-	commonDb    = 0
-	maxRetry    = 5
-	idleTimeOut = 5 * time.Minute
+	// BackendRedis caches in redis, which instances of a service share.
+	BackendRedis = "redis"
+	// BackendMemory caches in process, which only fits a single instance of a service.
+	BackendMemory = "memory"
 )
 
-// Cache is a redis cache.
-type Cache struct {
-	Client *redis.Client
-}
-
-// ConfigOptions includes redis config options.
-type ConfigOptions struct {
-	Addr   string
-	Passwd string
-}
-
-// New returns a new redis cache.
-func New(ctx context.Context, config *ConfigOptions) Cache {
-	logger := logging.FromContext(ctx)
-	redis.SetLogger(redisLoggerAdapter{logger})
-
-	opts := &redis.Options{
-		Addr:        config.Addr,
-		Password:    config.Passwd,
-		DB:          commonDb,
-		MaxRetries:  maxRetry,
-		IdleTimeout: idleTimeOut,
-	}
-
-	client := redis.NewClient(opts)
-	if _, err := client.Ping(ctx).Result(); err != nil {
-		logger.Panic(err)
-	}
-	logger.Debugf("Successfully connected to Redis: %s", config.Addr)
+// ErrNotFound is returned when a key doesn't exist or is expired.
+var ErrNotFound = errors.New("cache: key not found")
 
-	return Cache{client}
-}
-
-// Compile time interface check.
-var _ interface {
-	Printf(ctx context.Context, format string, v ...interface{})
-} = (*redisLoggerAdapter)(nil)
+// ErrWrongType is returned when a key holds a value of another kind, e.g. a set is read as a string.
+var ErrWrongType = errors.New("cache: key holds a value of wrong type")
 
-// redisLoggerAdapter implements redis internal Logging interface.
-type redisLoggerAdapter struct {
-	logger *zap.SugaredLogger
+// Cache is a key-value cache. Values are strings, sets of strings or hashes of string fields.
+// A zero ttl means a key never expires.
+type Cache interface {
+	// Get returns value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) (string, error)
+	// Set sets value of key with ttl, replacing any value and ttl of key.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// SetNX sets value of key with ttl only if key doesn't exist, it reports whether key is set.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// SetNXIncr atomically sets value of key with ttl only if key doesn't exist, and then increments integer value
+	// of counter, which never expires. It returns the incremented counter, or zero if key isn't set.
+	// In a cluster, key and counter must be in a slot, e.g. by a common hash tag.
+	SetNXIncr(ctx context.Context, key, counter, value string, ttl time.Duration) (int64, error)
+	// DelIfEqual atomically deletes key only if its value equals value, it reports whether key is deleted.
+	DelIfEqual(ctx context.Context, key, value string) (bool, error)
+	// DelIfEqualLimited atomically deletes key only if its value equals value, it reports whether key is deleted
+	// and returns number of failed attempts, or ErrNotFound. Failed attempts are counted in counter for current value
+	// of key, which a new value resets, and key is deleted once limit attempts failed, a zero limit means no limit.
+	// In a cluster, key and counter must be in a slot.
+	DelIfEqualLimited(ctx context.Context, key, counter, value string, limit int64) (bool, int64, error)
+	// Del deletes keys, it returns number of keys deleted.
+	Del(ctx context.Context, keys ...string) (int64, error)
+	// Exists returns number of keys existing.
+	Exists(ctx context.Context, keys ...string) (int64, error)
+	// ExpireIfEqual atomically sets ttl of key only if its value equals value, it reports whether ttl is set.
+	ExpireIfEqual(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// Expire sets ttl of an existing key, a zero ttl makes it never expire.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// Incr increments integer value of key by one, a missing key counts from zero and never expires.
+	Incr(ctx context.Context, key string) (int64, error)
+	// IncrIfLess atomically increments integer value of key by one only if it's less than limit,
+	// it reports whether key is incremented. A missing key counts from zero and expires in ttl.
+	IncrIfLess(ctx context.Context, key string, limit int64, ttl time.Duration) (bool, error)
+	// SAdd adds members to set of key.
+	SAdd(ctx context.Context, key string, members ...string) error
+	// SMembers returns all members of set of key, a missing key is an empty set.
+	SMembers(ctx context.Context, key string) ([]string, error)
+	// HSet atomically sets fields of hash of key and sets ttl of key.
+	HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error
+	// HGetAll returns all fields of hash of key, a missing key is an empty hash.
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	// Close releases resources of cache.
+	Close() error
 }
 
-func (l redisLoggerAdapter) Printf(_ context.Context, format string, v ...interface{}) {
-	l.logger.Infof(format, v)
+// Open returns a new cache of backend of config.
+func Open(ctx context.Context, config *ConfigOptions) (Cache, error) {
+	switch config.Backend {
+	case "", BackendRedis:
+		c, err := New(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case BackendMemory:
+		return NewMemory(config.MaxEntries), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", config.Backend)
 }
@@ -2,29 +2,258 @@ package cache
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
-	"github.com/williamlsh/orchid/pkg/logging"
-	"go.uber.org/zap"
 )
 
-type TestCase struct {
-	Exist int64
+func TestCache(t *testing.T) {
+	mr := runMiniredis(t)
+	// Miniredis serves all slots of a cluster.
+	cluster := runMiniredis(t)
+
+	memory := NewMemory(0)
+	caches := map[string]struct {
+		cache Cache
+		// elapse fast forwards time of cache.
+		elapse func(time.Duration)
+	}{
+		"redis":         {&Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}, mr.FastForward},
+		"redis cluster": {&Redis{Client: redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{cluster.Addr()}})}, cluster.FastForward},
+		"memory":        {memory, shiftMemory(memory)},
+	}
+
+	for name, c := range caches {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := c.cache
+			defer cache.Close()
+
+			_, err := cache.Get(ctx, "missing")
+			assert.True(t, errors.Is(err, ErrNotFound))
+
+			assert.NoError(t, cache.Set(ctx, "key", "value", time.Minute))
+			val, err := cache.Get(ctx, "key")
+			assert.NoError(t, err)
+			assert.Equal(t, "value", val)
+
+			ok, err := cache.SetNX(ctx, "key", "other", 0)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = cache.SetNX(ctx, "lock", "owner", time.Second)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			n, err := cache.Exists(ctx, "key", "lock", "missing")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), n)
+
+			c.elapse(2 * time.Second)
+			n, err = cache.Exists(ctx, "key", "lock")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), n, "lock should expire")
+
+			assert.NoError(t, cache.Expire(ctx, "key", time.Second))
+			c.elapse(2 * time.Second)
+			_, err = cache.Get(ctx, "key")
+			assert.True(t, errors.Is(err, ErrNotFound), "key should expire")
+
+			assert.NoError(t, cache.Set(ctx, "equal", "a", 0))
+			ok, err = cache.DelIfEqual(ctx, "equal", "b")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = cache.DelIfEqual(ctx, "equal", "a")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = cache.DelIfEqual(ctx, "equal", "a")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			_, _, err = cache.DelIfEqualLimited(ctx, "secret", "attempts", "a", 2)
+			assert.True(t, errors.Is(err, ErrNotFound))
+			assert.NoError(t, cache.Set(ctx, "secret", "a", time.Minute))
+			ok, failed, err := cache.DelIfEqualLimited(ctx, "secret", "attempts", "b", 2)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			assert.Equal(t, int64(1), failed)
+			// A new value is attempted from zero.
+			assert.NoError(t, cache.Set(ctx, "secret", "c", time.Minute))
+			ok, failed, err = cache.DelIfEqualLimited(ctx, "secret", "attempts", "b", 2)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			assert.Equal(t, int64(1), failed)
+			ok, failed, err = cache.DelIfEqualLimited(ctx, "secret", "attempts", "c", 2)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, int64(0), failed)
+			n, err = cache.Exists(ctx, "secret", "attempts")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), n, "redeemed key and counter should be deleted")
+			// Key is deleted once limit attempts failed.
+			assert.NoError(t, cache.Set(ctx, "secret", "a", time.Minute))
+			for i := int64(1); i <= 2; i++ {
+				ok, failed, err = cache.DelIfEqualLimited(ctx, "secret", "attempts", "b", 2)
+				assert.NoError(t, err)
+				assert.False(t, ok)
+				assert.Equal(t, i, failed)
+			}
+			_, _, err = cache.DelIfEqualLimited(ctx, "secret", "attempts", "a", 2)
+			assert.True(t, errors.Is(err, ErrNotFound), "key should be deleted after limit attempts")
+
+			for i := int64(1); i <= 3; i++ {
+				n, err := cache.Incr(ctx, "counter")
+				assert.NoError(t, err)
+				assert.Equal(t, i, n)
+			}
+
+			for i := 0; i < 2; i++ {
+				ok, err := cache.IncrIfLess(ctx, "capped", 2, time.Minute)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+			}
+			ok, err = cache.IncrIfLess(ctx, "capped", 2, time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, ok, "counter shouldn't exceed limit")
+			val, err = cache.Get(ctx, "capped")
+			assert.NoError(t, err)
+			assert.Equal(t, "2", val)
+			c.elapse(2 * time.Minute)
+			ok, err = cache.IncrIfLess(ctx, "capped", 2, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, ok, "counter should expire")
+
+			members, err := cache.SMembers(ctx, "set")
+			assert.NoError(t, err)
+			assert.Empty(t, members)
+			assert.NoError(t, cache.SAdd(ctx, "set", "a", "b"))
+			assert.NoError(t, cache.SAdd(ctx, "set", "b", "c"))
+			members, err = cache.SMembers(ctx, "set")
+			assert.NoError(t, err)
+			sort.Strings(members)
+			assert.Equal(t, []string{"a", "b", "c"}, members)
+
+			fields, err := cache.HGetAll(ctx, "hash")
+			assert.NoError(t, err)
+			assert.Empty(t, fields)
+			assert.NoError(t, cache.HSet(ctx, "hash", map[string]string{"a": "1", "b": "2"}, time.Minute))
+			assert.NoError(t, cache.HSet(ctx, "hash", map[string]string{"b": "3"}, time.Minute))
+			fields, err = cache.HGetAll(ctx, "hash")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{"a": "1", "b": "3"}, fields)
+			assert.True(t, errors.Is(cache.HSet(ctx, "set", map[string]string{"a": "1"}, 0), ErrWrongType))
+
+			// A zero ttl makes a key never expire.
+			assert.NoError(t, cache.Expire(ctx, "hash", 0))
+			c.elapse(2 * time.Minute)
+			fields, err = cache.HGetAll(ctx, "hash")
+			assert.NoError(t, err)
+			assert.Len(t, fields, 2, "persisted key shouldn't expire")
+
+			_, err = cache.Get(ctx, "set")
+			assert.True(t, errors.Is(err, ErrWrongType))
+			_, err = cache.Get(ctx, "hash")
+			assert.True(t, errors.Is(err, ErrWrongType))
+			_, err = cache.Incr(ctx, "set")
+			assert.True(t, errors.Is(err, ErrWrongType))
+
+			n, err = cache.Del(ctx, "counter", "set", "hash", "missing")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3), n)
+		})
+	}
 }
 
-func TestCache(t *testing.T) {
-	ctx := logging.WithLogger(context.Background(), zap.NewExample().Sugar())
-	config := &ConfigOptions{
-		Addr:   "localhost:6379",
-		Passwd: "",
-	}
-	cache := New(ctx, config)
-	testKey := "test:key"
-	testCase := &TestCase{
-		Exist: 0,
-	}
-	cache.Client.Del(context.Background(), testKey)
-	exist := cache.Client.Exists(context.Background(), testKey).Val()
-	assert.Equal(t, exist, testCase.Exist)
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	mr := runMiniredis(t)
+	mr.RequireUserAuth("orchid", "secret")
+
+	cache, err := New(ctx, &ConfigOptions{Addrs: []string{mr.Addr()}, Username: "orchid", Passwd: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	assert.NoError(t, cache.Set(ctx, "key", "value", 0))
+
+	cases := map[string]ConfigOptions{
+		"wrong password":        {Addrs: []string{mr.Addr()}, Username: "orchid", Passwd: "wrong"},
+		"no address":            {},
+		"sentinel with cluster": {Addrs: []string{mr.Addr()}, MasterName: "master", Cluster: true},
+		"cluster with db":       {Addrs: []string{mr.Addr()}, Cluster: true, DB: 1},
+		"ambiguous addresses":   {Addrs: []string{mr.Addr(), mr.Addr()}},
+		"missing ca file":       {Addrs: []string{mr.Addr()}, TLS: TLSOptions{Enabled: true, CAFile: "testdata/missing.pem"}},
+	}
+	for name, config := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(ctx, &config); err == nil {
+				t.Fatal("expect an error")
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	mr := runMiniredis(t)
+
+	c, err := Open(ctx, &ConfigOptions{Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.IsType(t, &Redis{}, c)
+
+	c, err = Open(ctx, &ConfigOptions{Backend: BackendMemory, MaxEntries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &Memory{}, c)
+
+	_, err = Open(ctx, &ConfigOptions{Backend: "memcached"})
+	assert.Error(t, err)
+	c, err = Open(ctx, &ConfigOptions{})
+	assert.Error(t, err)
+	assert.Nil(t, c, "failed cache should be nil")
+}
+
+func TestMemoryEviction(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemory(2)
+
+	assert.NoError(t, cache.Set(ctx, "a", "1", 0))
+	assert.NoError(t, cache.Set(ctx, "b", "2", 0))
+	// Reading a makes b the least recently used.
+	_, err := cache.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Set(ctx, "c", "3", 0))
+
+	assert.Equal(t, 2, cache.Len())
+	_, err = cache.Get(ctx, "b")
+	assert.True(t, errors.Is(err, ErrNotFound), "least recently used key should be evicted")
+	for _, key := range []string{"a", "c"} {
+		_, err := cache.Get(ctx, key)
+		assert.NoError(t, err)
+	}
+}
+
+func runMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	return mr
+}
+
+// shiftMemory returns a func fast forwarding time of cache.
+func shiftMemory(cache *Memory) func(time.Duration) {
+	var shift time.Duration
+	cache.now = func() time.Time { return time.Now().Add(shift) }
+	return func(d time.Duration) { shift += d }
 }
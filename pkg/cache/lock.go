@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/logging"
+)
+
+const (
+	lockKeyPrefix      = "lock"
+	lockTokenKeyPrefix = "lock_token"
+
+	// resignTimeout bounds releasing leadership after election is stopped.
+	resignTimeout = 5 * time.Second
+)
+
+var (
+	// ErrLockHeld is returned when a lock is held by another owner.
+	ErrLockHeld = errors.New("cache: lock is held by another owner")
+	// ErrLockLost is returned when lease of a lock expired and it may be held by another owner.
+	ErrLockLost = errors.New("cache: lock is lost")
+)
+
+// Lock is a lease of a named lock in a cache, it expires unless it's refreshed within its ttl.
+// As for any lease, an owner may lose a lock without noticing, e.g. while it's paused, so leases may overlap.
+// A resource which must not be written under overlapping leases has to reject writes with a Token lower
+// than one it has seen.
+type Lock struct {
+	cache Cache
+	key   string
+	// value is unique to this lease, so that only its owner refreshes or releases it.
+	value string
+	ttl   time.Duration
+	// Token numbers leases of the lock, it's greater than tokens of earlier leases.
+	Token int64
+
+	mu sync.Mutex
+	// deadline is when lease expires at the latest, measured from before it's acquired or refreshed.
+	deadline time.Time
+}
+
+// lockKey and lockTokenKey share a hash tag, so that they are in a slot of a cluster.
+func lockKey(name string) string {
+	return lockKeyPrefix + ":{" + name + "}"
+}
+
+func lockTokenKey(name string) string {
+	return lockTokenKeyPrefix + ":{" + name + "}"
+}
+
+// Acquire acquires lock of name with a lease of ttl, it returns ErrLockHeld if lock is held by another owner.
+func Acquire(ctx context.Context, c Cache, name string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, errors.New("cache: lock ttl must be positive")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	l := &Lock{
+		cache: c,
+		key:   lockKey(name),
+		value: hex.EncodeToString(id),
+		ttl:   ttl,
+	}
+	start := time.Now()
+	// Lease is numbered once it's acquired, in the same step, so that a later lease always has a greater token.
+	token, err := c.SetNXIncr(ctx, l.key, lockTokenKey(name), l.value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, ErrLockHeld
+	}
+	l.Token = token
+	l.deadline = start.Add(ttl)
+	return l, nil
+}
+
+// Held reports whether lease of l hasn't expired yet, as far as its owner can tell.
+func (l *Lock) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return time.Now().Before(l.deadline)
+}
+
+// Refresh renews lease of l for another ttl, it returns ErrLockLost if lease expired.
+func (l *Lock) Refresh(ctx context.Context) error {
+	start := time.Now()
+	ok, err := l.cache.ExpireIfEqual(ctx, l.key, l.value, l.ttl)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !ok {
+		l.deadline = time.Time{}
+		return ErrLockLost
+	}
+	l.deadline = start.Add(l.ttl)
+	return nil
+}
+
+// Release releases l, so that others acquire it without waiting for lease to expire.
+// It returns ErrLockLost if lease expired before.
+func (l *Lock) Release(ctx context.Context) error {
+	ok, err := l.cache.DelIfEqual(ctx, l.key, l.value)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deadline = time.Time{}
+	if !ok {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Election elects a leader among instances sharing a cache, the leader holds a lock of name.
+// Leadership is renewed every third of ttl, an instance failing to renew steps down once its lease
+// expires, then another instance is elected.
+type Election struct {
+	cache Cache
+	name  string
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	lock *Lock
+}
+
+// NewElection returns a new Election of leader of name with a lease of ttl.
+func NewElection(c Cache, name string, ttl time.Duration) *Election {
+	return &Election{
+		cache: c,
+		name:  name,
+		ttl:   ttl,
+	}
+}
+
+// Run campaigns for leadership until ctx is done, then it resigns if leading.
+func (e *Election) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Campaign(ctx); err != nil {
+			logger.Errorf("election %s failed: %v", e.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := e.resign(); err != nil {
+				logger.Errorf("could not resign from election %s: %v", e.name, err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Leading reports whether this instance is leader.
+func (e *Election) Leading() bool {
+	_, ok := e.Token()
+	return ok
+}
+
+// Token returns token of lease of current term of leadership, if this instance is leader.
+func (e *Election) Token() (int64, bool) {
+	e.mu.Lock()
+	lock := e.lock
+	e.mu.Unlock()
+
+	if lock == nil || !lock.Held() {
+		return 0, false
+	}
+	return lock.Token, true
+}
+
+// Campaign renews leadership of a leader, or tries to be leader, once.
+func (e *Election) Campaign(ctx context.Context) error {
+	e.mu.Lock()
+	lock := e.lock
+	e.mu.Unlock()
+
+	if lock != nil {
+		// A failed renewal is retried, leader steps down when its lease expires.
+		err := lock.Refresh(ctx)
+		if !errors.Is(err, ErrLockLost) {
+			return err
+		}
+	}
+
+	lock, err := Acquire(ctx, e.cache, e.name, e.ttl)
+	if errors.Is(err, ErrLockHeld) {
+		lock, err = nil, nil
+	}
+	e.mu.Lock()
+	e.lock = lock
+	e.mu.Unlock()
+	return err
+}
+
+// resign releases leadership if leading.
+func (e *Election) resign() error {
+	e.mu.Lock()
+	lock := e.lock
+	e.lock = nil
+	e.mu.Unlock()
+
+	if lock == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+	if err := lock.Release(ctx); err != nil && !errors.Is(err, ErrLockLost) {
+		return err
+	}
+	return nil
+}
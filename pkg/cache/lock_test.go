@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	mr := runMiniredis(t)
+	cluster := runMiniredis(t)
+	memory := NewMemory(0)
+	caches := map[string]struct {
+		cache  Cache
+		elapse func(time.Duration)
+	}{
+		"redis":         {&Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}, mr.FastForward},
+		"redis cluster": {&Redis{Client: redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{cluster.Addr()}})}, cluster.FastForward},
+		"memory":        {memory, shiftMemory(memory)},
+	}
+
+	for name, c := range caches {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			defer c.cache.Close()
+
+			l1, err := Acquire(ctx, c.cache, "job", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, l1.Held())
+			_, err = Acquire(ctx, c.cache, "job", time.Minute)
+			assert.True(t, errors.Is(err, ErrLockHeld))
+			assert.NoError(t, l1.Refresh(ctx))
+
+			// Once lease expires, lock is acquired by another owner with a greater token.
+			c.elapse(2 * time.Minute)
+			l2, err := Acquire(ctx, c.cache, "job", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, l1.Token+1, l2.Token, "failed attempts shouldn't number leases")
+			assert.True(t, errors.Is(l1.Refresh(ctx), ErrLockLost))
+			assert.False(t, l1.Held())
+			assert.True(t, errors.Is(l1.Release(ctx), ErrLockLost))
+			_, err = Acquire(ctx, c.cache, "job", time.Minute)
+			assert.True(t, errors.Is(err, ErrLockHeld), "lost lease shouldn't release lock of another owner")
+
+			assert.NoError(t, l2.Release(ctx))
+			assert.False(t, l2.Held())
+			l3, err := Acquire(ctx, c.cache, "job", time.Minute)
+			assert.NoError(t, err)
+			assert.Greater(t, l3.Token, l2.Token)
+		})
+	}
+}
+
+func TestElection(t *testing.T) {
+	cache := NewMemory(0)
+	const ttl = 60 * time.Millisecond
+
+	type candidate struct {
+		election *Election
+		cancel   context.CancelFunc
+		done     chan struct{}
+	}
+	candidates := make([]*candidate, 2)
+	for i := range candidates {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &candidate{NewElection(cache, "jobs", ttl), cancel, make(chan struct{})}
+		go func() {
+			c.election.Run(ctx)
+			close(c.done)
+		}()
+		candidates[i] = c
+	}
+	defer func() {
+		for _, c := range candidates {
+			c.cancel()
+			<-c.done
+		}
+	}()
+
+	// leader waits until exactly one of candidates leads.
+	leader := func(candidates ...*candidate) *candidate {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			var leaders []*candidate
+			for _, c := range candidates {
+				if c.election.Leading() {
+					leaders = append(leaders, c)
+				}
+			}
+			if len(leaders) > 1 {
+				t.Fatal("expect a single leader")
+			}
+			if len(leaders) == 1 {
+				return leaders[0]
+			}
+			time.Sleep(ttl / 10)
+		}
+		t.Fatal("expect a leader elected")
+		return nil
+	}
+
+	first := leader(candidates...)
+	token, _ := first.election.Token()
+	// Leadership is renewed beyond ttl.
+	time.Sleep(2 * ttl)
+	assert.Same(t, first, leader(candidates...))
+
+	// A resigned leader is succeeded by another candidate.
+	first.cancel()
+	<-first.done
+	assert.False(t, first.election.Leading())
+	var rest []*candidate
+	for _, c := range candidates {
+		if c != first {
+			rest = append(rest, c)
+		}
+	}
+	next := leader(rest...)
+	nextToken, _ := next.election.Token()
+	assert.Greater(t, nextToken, token)
+}
@@ -0,0 +1,405 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compile time interface check.
+var _ Cache = (*Memory)(nil)
+
+// Memory is an in-process cache of a single node, it holds at most a number of keys
+// and evicts the least recently used key to hold a new one. Expired keys are removed lazily.
+type Memory struct {
+	mu         sync.Mutex
+	maxEntries int
+	// lru holds *memoryEntry, the most recently used at front.
+	lru     *list.List
+	entries map[string]*list.Element
+	// now returns current time, which tests may shift.
+	now func() time.Time
+}
+
+// memoryEntry is a key of Memory, it holds either a string value, a set or a hash.
+type memoryEntry struct {
+	key       string
+	value     string
+	set       map[string]struct{}
+	hash      map[string]string
+	expiresAt time.Time
+}
+
+// isString reports whether e holds a string value.
+func (e *memoryEntry) isString() bool {
+	return e.set == nil && e.hash == nil
+}
+
+// NewMemory returns a new in-process cache holding at most maxEntries keys, a non-positive maxEntries means no limit.
+func NewMemory(maxEntries int) *Memory {
+	return &Memory{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// Get implements Cache.
+func (c *Memory) Get(_ context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	if !e.isString() {
+		return "", ErrWrongType
+	}
+	return e.value, nil
+}
+
+// Set implements Cache.
+func (c *Memory) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store(&memoryEntry{key: key, value: value, expiresAt: c.expiresAt(ttl)})
+	return nil
+}
+
+// SetNX implements Cache.
+func (c *Memory) SetNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lookup(key) != nil {
+		return false, nil
+	}
+	c.store(&memoryEntry{key: key, value: value, expiresAt: c.expiresAt(ttl)})
+	return true, nil
+}
+
+// SetNXIncr implements Cache.
+func (c *Memory) SetNXIncr(_ context.Context, key, counter, value string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lookup(key) != nil {
+		return 0, nil
+	}
+	var n int64
+	if e := c.lookup(counter); e != nil {
+		if !e.isString() {
+			return 0, ErrWrongType
+		}
+		var err error
+		if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, ErrWrongType
+		}
+	}
+	n++
+	c.store(&memoryEntry{key: counter, value: strconv.FormatInt(n, 10)})
+	c.store(&memoryEntry{key: key, value: value, expiresAt: c.expiresAt(ttl)})
+	return n, nil
+}
+
+// DelIfEqual implements Cache.
+func (c *Memory) DelIfEqual(_ context.Context, key, value string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil || !e.isString() || e.value != value {
+		return false, nil
+	}
+	c.remove(c.entries[key])
+	return true, nil
+}
+
+// DelIfEqualLimited implements Cache.
+func (c *Memory) DelIfEqualLimited(_ context.Context, key, counter, value string, limit int64) (bool, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		return false, 0, ErrNotFound
+	}
+	if !e.isString() {
+		return false, 0, ErrWrongType
+	}
+	if e.value == value {
+		c.remove(c.entries[key])
+		if c.lookup(counter) != nil {
+			c.remove(c.entries[counter])
+		}
+		return true, 0, nil
+	}
+
+	// Counter is kept as redis does, so that it's reset by a new value.
+	sum := sha1.Sum([]byte(e.value))
+	digest := hex.EncodeToString(sum[:])
+	n := int64(1)
+	if counted := c.lookup(counter); counted != nil && counted.isString() && strings.HasPrefix(counted.value, digest+":") {
+		prev, err := strconv.ParseInt(strings.TrimPrefix(counted.value, digest+":"), 10, 64)
+		if err != nil {
+			return false, 0, ErrWrongType
+		}
+		n = prev + 1
+	}
+	if limit > 0 && n >= limit {
+		c.remove(c.entries[key])
+		if c.lookup(counter) != nil {
+			c.remove(c.entries[counter])
+		}
+		return false, n, nil
+	}
+	c.store(&memoryEntry{key: counter, value: digest + ":" + strconv.FormatInt(n, 10), expiresAt: e.expiresAt})
+	return false, n, nil
+}
+
+// ExpireIfEqual implements Cache.
+func (c *Memory) ExpireIfEqual(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil || !e.isString() || e.value != value {
+		return false, nil
+	}
+	e.expiresAt = c.expiresAt(ttl)
+	return true, nil
+}
+
+// Del implements Cache.
+func (c *Memory) Del(_ context.Context, keys ...string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for _, key := range keys {
+		if c.lookup(key) != nil {
+			c.remove(c.entries[key])
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Exists implements Cache.
+func (c *Memory) Exists(_ context.Context, keys ...string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for _, key := range keys {
+		if c.lookup(key) != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Expire implements Cache.
+func (c *Memory) Expire(_ context.Context, key string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.lookup(key); e != nil {
+		e.expiresAt = c.expiresAt(ttl)
+	}
+	return nil
+}
+
+// Incr implements Cache.
+func (c *Memory) Incr(_ context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		c.store(&memoryEntry{key: key, value: "1"})
+		return 1, nil
+	}
+	if !e.isString() {
+		return 0, ErrWrongType
+	}
+	n, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, ErrWrongType
+	}
+	n++
+	e.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+// IncrIfLess implements Cache.
+func (c *Memory) IncrIfLess(_ context.Context, key string, limit int64, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		if limit <= 0 {
+			return false, nil
+		}
+		c.store(&memoryEntry{key: key, value: "1", expiresAt: c.expiresAt(ttl)})
+		return true, nil
+	}
+	if !e.isString() {
+		return false, ErrWrongType
+	}
+	n, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return false, ErrWrongType
+	}
+	if n >= limit {
+		return false, nil
+	}
+	e.value = strconv.FormatInt(n+1, 10)
+	return true, nil
+}
+
+// SAdd implements Cache.
+func (c *Memory) SAdd(_ context.Context, key string, members ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		e = &memoryEntry{key: key, set: make(map[string]struct{}, len(members))}
+		c.store(e)
+	}
+	if e.set == nil {
+		return ErrWrongType
+	}
+	for _, m := range members {
+		e.set[m] = struct{}{}
+	}
+	return nil
+}
+
+// SMembers implements Cache.
+func (c *Memory) SMembers(_ context.Context, key string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		return []string{}, nil
+	}
+	if e.set == nil {
+		return nil, ErrWrongType
+	}
+	members := make([]string, 0, len(e.set))
+	for m := range e.set {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// HSet implements Cache.
+func (c *Memory) HSet(_ context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		if len(fields) == 0 {
+			return nil
+		}
+		e = &memoryEntry{key: key, hash: make(map[string]string, len(fields))}
+		c.store(e)
+	}
+	if e.hash == nil {
+		return ErrWrongType
+	}
+	for field, value := range fields {
+		e.hash[field] = value
+	}
+	e.expiresAt = c.expiresAt(ttl)
+	return nil
+}
+
+// HGetAll implements Cache.
+func (c *Memory) HGetAll(_ context.Context, key string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.lookup(key)
+	if e == nil {
+		return map[string]string{}, nil
+	}
+	if e.hash == nil {
+		return nil, ErrWrongType
+	}
+	fields := make(map[string]string, len(e.hash))
+	for field, value := range e.hash {
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+// Close implements Cache.
+func (c *Memory) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// Len returns number of keys held, including expired keys not removed yet.
+func (c *Memory) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// lookup returns live entry of key and marks it as recently used, an expired entry is removed.
+func (c *Memory) lookup(key string) *memoryEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*memoryEntry)
+	if !e.expiresAt.IsZero() && !c.now().Before(e.expiresAt) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// store replaces entry of its key, evicting the least recently used keys beyond limit.
+func (c *Memory) store(e *memoryEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Memory) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*memoryEntry).key)
+}
+
+// expiresAt returns expiration time of a key with ttl, zero if it never expires.
+func (c *Memory) expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(ttl)
+}
@@ -0,0 +1,431 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/williamlsh/orchid/pkg/logging"
+	"go.uber.org/zap"
+)
+
+// Compile time interface check.
+var _ Cache = (*Redis)(nil)
+
+// Scripts run atomically on a single key or keys in a slot, so that they work in a cluster as well.
+var (
+	// setNXIncrScript sets KEYS[1] to ARGV[1] with ttl of ARGV[2] milliseconds, 0 for none, if it doesn't exist,
+	// and then increments KEYS[2].
+	setNXIncrScript = redis.NewScript(`
+local ok
+if tonumber(ARGV[2]) > 0 then
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])
+else
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+end
+if ok then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+	// delIfEqualScript deletes KEYS[1] if its value is ARGV[1].
+	delIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+	// delIfEqualLimitedScript deletes KEYS[1] if its value is ARGV[1] and returns 0, otherwise it counts a failed
+	// attempt in KEYS[2] as "<sha1 of value>:<count>", which expires with KEYS[1], and returns count.
+	// KEYS[1] is deleted once ARGV[2] attempts failed, 0 for no limit. It returns -1 if KEYS[1] doesn't exist.
+	delIfEqualLimitedScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return -1
+end
+if v == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return 0
+end
+local digest = redis.sha1hex(v)
+local counted = redis.call('GET', KEYS[2])
+local n = 1
+if counted and string.sub(counted, 1, 40) == digest then
+	n = tonumber(string.sub(counted, 42)) + 1
+end
+local limit = tonumber(ARGV[2])
+if limit > 0 and n >= limit then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return n
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[2], digest .. ':' .. n, 'PX', ttl)
+else
+	redis.call('SET', KEYS[2], digest .. ':' .. n)
+end
+return n
+`)
+	// expireIfEqualScript sets ttl of KEYS[1] to ARGV[2] milliseconds, 0 for none, if its value is ARGV[1].
+	expireIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	else
+		redis.call('PERSIST', KEYS[1])
+	end
+	return 1
+end
+return 0
+`)
+	// incrIfLessScript increments KEYS[1] if it's less than ARGV[1], a new key expires in ARGV[2] milliseconds, 0 for none.
+	incrIfLessScript = redis.NewScript(`
+local n = tonumber(redis.call('GET', KEYS[1]) or 0)
+if n and n >= tonumber(ARGV[1]) then
+	return 0
+end
+if redis.call('INCR', KEYS[1]) == 1 and tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+)
+
+// Redis is a redis cache of a single server, a sentinel monitored master or a cluster.
+type Redis struct {
+	Client redis.UniversalClient
+}
+
+// ConfigOptions includes cache config options, all options but Backend and MaxEntries are of redis.
+type ConfigOptions struct {
+	// Backend is BackendRedis or BackendMemory, redis if empty.
+	Backend string
+	// MaxEntries limits number of keys of memory backend, 0 means no limit.
+	MaxEntries int
+
+	// Addrs are addresses of a redis server, of sentinels if MasterName is set,
+	// or of some cluster nodes if Cluster is set.
+	Addrs      []string
+	MasterName string
+	Cluster    bool
+
+	// Username is set for redis ACL, otherwise Passwd authenticates the default user.
+	Username       string
+	Passwd         string
+	SentinelPasswd string
+	// DB is not supported by cluster.
+	DB  int
+	TLS TLSOptions
+
+	// Zero options are defaults of go-redis.
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+}
+
+// TLSOptions includes TLS config options of redis connections.
+type TLSOptions struct {
+	Enabled bool
+	// CAFile verifies server certificates instead of system roots.
+	CAFile string
+	// CertFile and KeyFile are client certificate, if server requires one.
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// New returns a new redis cache, it fails if redis is unreachable.
+func New(ctx context.Context, config *ConfigOptions) (*Redis, error) {
+	logger := logging.FromContext(ctx)
+	redis.SetLogger(redisLoggerAdapter{logger})
+
+	client, err := newUniversalClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Ping(ctx).Result(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	logger.Debugf("Successfully connected to Redis: %s", strings.Join(config.Addrs, ","))
+
+	return &Redis{client}, nil
+}
+
+// newUniversalClient returns a client of the kind of redis config describes.
+func newUniversalClient(config *ConfigOptions) (redis.UniversalClient, error) {
+	if len(config.Addrs) == 0 {
+		return nil, errors.New("no redis address")
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:            config.Addrs,
+		DB:               config.DB,
+		Username:         config.Username,
+		Password:         config.Passwd,
+		SentinelPassword: config.SentinelPasswd,
+		MaxRetries:       config.MaxRetries,
+		DialTimeout:      config.DialTimeout,
+		ReadTimeout:      config.ReadTimeout,
+		WriteTimeout:     config.WriteTimeout,
+		PoolSize:         config.PoolSize,
+		MinIdleConns:     config.MinIdleConns,
+		PoolTimeout:      config.PoolTimeout,
+		IdleTimeout:      config.IdleTimeout,
+	}
+	if config.TLS.Enabled {
+		tlsConfig, err := config.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	switch {
+	case config.MasterName != "" && config.Cluster:
+		return nil, errors.New("redis sentinel and cluster are exclusive")
+	case config.MasterName != "":
+		opts.MasterName = config.MasterName
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case config.Cluster:
+		if config.DB != 0 {
+			return nil, errors.New("redis cluster supports db 0 only")
+		}
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case len(config.Addrs) > 1:
+		return nil, errors.New("multiple redis addresses require sentinel or cluster")
+	}
+	return redis.NewClient(opts.Simple()), nil
+}
+
+// tlsConfig returns TLS config of options.
+func (o TLSOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in redis CA file %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Get implements Cache.
+func (c *Redis) Get(ctx context.Context, key string) (string, error) {
+	val, err := c.Client.Get(ctx, key).Result()
+	return val, redisError(err)
+}
+
+// Set implements Cache.
+func (c *Redis) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return redisError(c.Client.Set(ctx, key, value, ttl).Err())
+}
+
+// SetNX implements Cache.
+func (c *Redis) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	ok, err := c.Client.SetNX(ctx, key, value, ttl).Result()
+	return ok, redisError(err)
+}
+
+// SetNXIncr implements Cache.
+func (c *Redis) SetNXIncr(ctx context.Context, key, counter, value string, ttl time.Duration) (int64, error) {
+	n, err := setNXIncrScript.Run(ctx, c.Client, []string{key, counter}, value, milliseconds(ttl)).Int64()
+	return n, redisError(err)
+}
+
+// DelIfEqual implements Cache.
+func (c *Redis) DelIfEqual(ctx context.Context, key, value string) (bool, error) {
+	n, err := delIfEqualScript.Run(ctx, c.Client, []string{key}, value).Int()
+	return n > 0, redisError(err)
+}
+
+// DelIfEqualLimited implements Cache.
+func (c *Redis) DelIfEqualLimited(ctx context.Context, key, counter, value string, limit int64) (bool, int64, error) {
+	n, err := delIfEqualLimitedScript.Run(ctx, c.Client, []string{key, counter}, value, limit).Int64()
+	if err != nil {
+		return false, 0, redisError(err)
+	}
+	if n < 0 {
+		return false, 0, ErrNotFound
+	}
+	return n == 0, n, nil
+}
+
+// ExpireIfEqual implements Cache.
+func (c *Redis) ExpireIfEqual(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	n, err := expireIfEqualScript.Run(ctx, c.Client, []string{key}, value, milliseconds(ttl)).Int()
+	return n > 0, redisError(err)
+}
+
+// Del implements Cache.
+func (c *Redis) Del(ctx context.Context, keys ...string) (int64, error) {
+	if c.crossSlot(keys) {
+		return c.countPerKey(ctx, keys, func(pipe redis.Pipeliner, key string) *redis.IntCmd {
+			return pipe.Del(ctx, key)
+		})
+	}
+	return c.Client.Del(ctx, keys...).Result()
+}
+
+// Exists implements Cache.
+func (c *Redis) Exists(ctx context.Context, keys ...string) (int64, error) {
+	if c.crossSlot(keys) {
+		return c.countPerKey(ctx, keys, func(pipe redis.Pipeliner, key string) *redis.IntCmd {
+			return pipe.Exists(ctx, key)
+		})
+	}
+	return c.Client.Exists(ctx, keys...).Result()
+}
+
+// Expire implements Cache.
+func (c *Redis) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	// Unlike Cache, redis deletes a key expiring in a non-positive ttl.
+	if ttl <= 0 {
+		return redisError(c.Client.Persist(ctx, key).Err())
+	}
+	return redisError(c.Client.PExpire(ctx, key, ttl).Err())
+}
+
+// Incr implements Cache.
+func (c *Redis) Incr(ctx context.Context, key string) (int64, error) {
+	n, err := c.Client.Incr(ctx, key).Result()
+	return n, redisError(err)
+}
+
+// IncrIfLess implements Cache.
+func (c *Redis) IncrIfLess(ctx context.Context, key string, limit int64, ttl time.Duration) (bool, error) {
+	n, err := incrIfLessScript.Run(ctx, c.Client, []string{key}, limit, milliseconds(ttl)).Int()
+	return n > 0, redisError(err)
+}
+
+// SAdd implements Cache.
+func (c *Redis) SAdd(ctx context.Context, key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return redisError(c.Client.SAdd(ctx, key, values...).Err())
+}
+
+// SMembers implements Cache.
+func (c *Redis) SMembers(ctx context.Context, key string) ([]string, error) {
+	members, err := c.Client.SMembers(ctx, key).Result()
+	return members, redisError(err)
+}
+
+// HSet implements Cache.
+func (c *Redis) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	if len(fields) == 0 {
+		return c.Expire(ctx, key, ttl)
+	}
+	values := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		values[field] = value
+	}
+	pipe := c.Client.TxPipeline()
+	pipe.HSet(ctx, key, values)
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return redisError(err)
+}
+
+// HGetAll implements Cache.
+func (c *Redis) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	fields, err := c.Client.HGetAll(ctx, key).Result()
+	return fields, redisError(err)
+}
+
+// Close implements Cache.
+func (c *Redis) Close() error {
+	return c.Client.Close()
+}
+
+// crossSlot reports whether keys may be in different slots of a cluster, which a single command can't address.
+func (c *Redis) crossSlot(keys []string) bool {
+	_, ok := c.Client.(*redis.ClusterClient)
+	return ok && len(keys) > 1
+}
+
+// countPerKey sums counts of a command on each key, commands are pipelined to nodes of keys.
+func (c *Redis) countPerKey(ctx context.Context, keys []string, cmd func(pipe redis.Pipeliner, key string) *redis.IntCmd) (int64, error) {
+	pipe := c.Client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = cmd(pipe, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, cmd := range cmds {
+		n += cmd.Val()
+	}
+	return n, nil
+}
+
+// milliseconds returns ttl in milliseconds for scripts, a positive ttl is at least a millisecond.
+func milliseconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl < time.Millisecond {
+		return 1
+	}
+	return ttl.Milliseconds()
+}
+
+// redisError translates errors of redis into errors of Cache.
+func redisError(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return ErrWrongType
+	}
+	return err
+}
+
+// Compile time interface check.
+var _ interface {
+	Printf(ctx context.Context, format string, v ...interface{})
+} = (*redisLoggerAdapter)(nil)
+
+// redisLoggerAdapter implements redis internal Logging interface.
+type redisLoggerAdapter struct {
+	logger *zap.SugaredLogger
+}
+
+func (l redisLoggerAdapter) Printf(_ context.Context, format string, v ...interface{}) {
+	l.logger.Infof(format, v)
+}
@@ -52,4 +52,233 @@ var migrations = []func(ctx context.Context, tx pgx.Tx) error{
 		_, err = tx.Exec(ctx, sql)
 		return err
 	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			ALTER TABLE users
+			ADD COLUMN bio VARCHAR (500) NOT NULL DEFAULT '',
+			ADD COLUMN locale VARCHAR (35) NOT NULL DEFAULT '',
+			ADD COLUMN timezone VARCHAR (64) NOT NULL DEFAULT '',
+			ADD COLUMN avatar VARCHAR (300) NOT NULL DEFAULT '';
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			ALTER TABLE users
+			ADD COLUMN deregistered_at TIMESTAMPTZ;
+
+			UPDATE users
+			SET deregistered_at = NOW()
+			WHERE deregistered = true;
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS user_preferences(
+				user_id integer PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+				preferences JSONB NOT NULL DEFAULT '{}',
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE TRIGGER set_timestamp
+			BEFORE UPDATE ON user_preferences
+			FOR EACH ROW
+			EXECUTE PROCEDURE trigger_set_timestamp();
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			ALTER TABLE users
+			ADD COLUMN status VARCHAR (20) NOT NULL DEFAULT 'active',
+			ADD COLUMN status_reason VARCHAR (300) NOT NULL DEFAULT '',
+			ADD COLUMN status_expires_at TIMESTAMPTZ;
+
+			UPDATE users
+			SET status = 'pending_deletion'
+			WHERE deregistered = true;
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS files(
+				id serial PRIMARY KEY,
+				owner_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				bucket VARCHAR (63) NOT NULL,
+				object_key VARCHAR (1024) NOT NULL,
+				size BIGINT NOT NULL DEFAULT 0,
+				content_type VARCHAR (255) NOT NULL DEFAULT '',
+				checksum VARCHAR (128) NOT NULL,
+				status VARCHAR (20) NOT NULL DEFAULT 'pending',
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				UNIQUE (bucket, object_key)
+			);
+
+			CREATE INDEX IF NOT EXISTS files_owner_id_idx ON files (owner_id);
+
+			CREATE TRIGGER set_timestamp
+			BEFORE UPDATE ON files
+			FOR EACH ROW
+			EXECUTE PROCEDURE trigger_set_timestamp();
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			ALTER TABLE files
+			ADD COLUMN IF NOT EXISTS purpose VARCHAR (50) NOT NULL DEFAULT '';
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS file_shares(
+				id serial PRIMARY KEY,
+				token VARCHAR (64) UNIQUE NOT NULL,
+				file_id integer NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+				password_hash VARCHAR (60) NOT NULL DEFAULT '',
+				max_downloads integer NOT NULL DEFAULT 0,
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS file_shares_file_id_idx ON file_shares (file_id);
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS blobs(
+				id serial PRIMARY KEY,
+				bucket VARCHAR (63) NOT NULL,
+				object_key VARCHAR (1024) NOT NULL,
+				sha256 CHAR (64) NOT NULL,
+				size BIGINT NOT NULL,
+				ref_count integer NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+				unreferenced_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				UNIQUE (bucket, sha256)
+			);
+
+			CREATE INDEX IF NOT EXISTS blobs_unreferenced_at_idx ON blobs (unreferenced_at) WHERE ref_count = 0;
+
+			ALTER TABLE files
+			ADD COLUMN IF NOT EXISTS blob_id integer REFERENCES blobs (id);
+
+			CREATE INDEX IF NOT EXISTS files_blob_id_idx ON files (blob_id);
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS storage_usage(
+				user_id integer PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+				bytes BIGINT NOT NULL DEFAULT 0,
+				objects BIGINT NOT NULL DEFAULT 0,
+				max_bytes BIGINT,
+				max_objects BIGINT,
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE TRIGGER set_timestamp
+			BEFORE UPDATE ON storage_usage
+			FOR EACH ROW
+			EXECUTE PROCEDURE trigger_set_timestamp();
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			CREATE TABLE IF NOT EXISTS file_images(
+				file_id integer PRIMARY KEY REFERENCES files (id) ON DELETE CASCADE,
+				status VARCHAR (20) NOT NULL DEFAULT 'pending',
+				width integer NOT NULL DEFAULT 0,
+				height integer NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS file_images_status_idx ON file_images (status) WHERE status IN ('pending', 'processing');
+
+			CREATE TRIGGER set_timestamp
+			BEFORE UPDATE ON file_images
+			FOR EACH ROW
+			EXECUTE PROCEDURE trigger_set_timestamp();
+
+			CREATE TABLE IF NOT EXISTS file_thumbnails(
+				file_id integer NOT NULL REFERENCES file_images (file_id) ON DELETE CASCADE,
+				size integer NOT NULL,
+				width integer NOT NULL,
+				height integer NOT NULL,
+				content_type VARCHAR (255) NOT NULL,
+				object_key VARCHAR (1024) NOT NULL,
+				PRIMARY KEY (file_id, size)
+			);
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		sql := `
+			ALTER TABLE files
+			ADD COLUMN IF NOT EXISTS scan_status VARCHAR (20) NOT NULL DEFAULT 'pending',
+			ADD COLUMN IF NOT EXISTS scan_signature TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMPTZ;
+
+			CREATE INDEX IF NOT EXISTS files_scan_status_idx ON files (scan_status) WHERE scan_status IN ('pending', 'scanning');
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		// Key id 0 of blobs and thumbnails means plaintext, so it doesn't reference data_keys.
+		// Blobs are deduplicated among content encrypted with the same data key only.
+		sql := `
+			CREATE TABLE IF NOT EXISTS data_keys(
+				id serial PRIMARY KEY,
+				user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				master_key_id VARCHAR (16) NOT NULL,
+				wrapped_key BYTEA NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				retired_at TIMESTAMPTZ
+			);
+
+			CREATE UNIQUE INDEX IF NOT EXISTS data_keys_user_id_active_idx ON data_keys (user_id) WHERE retired_at IS NULL;
+
+			ALTER TABLE blobs
+			ADD COLUMN IF NOT EXISTS key_id integer NOT NULL DEFAULT 0,
+			DROP CONSTRAINT IF EXISTS blobs_bucket_sha256_key,
+			ADD CONSTRAINT blobs_bucket_sha256_key_id_key UNIQUE (bucket, sha256, key_id);
+
+			ALTER TABLE file_thumbnails
+			ADD COLUMN IF NOT EXISTS key_id integer NOT NULL DEFAULT 0;
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
+	func(ctx context.Context, tx pgx.Tx) (err error) {
+		// Trashed files keep their content and count toward quota until they are purged.
+		sql := `
+			ALTER TABLE files
+			ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+			CREATE INDEX IF NOT EXISTS files_deleted_at_idx ON files (deleted_at) WHERE deleted_at IS NOT NULL;
+		`
+		_, err = tx.Exec(ctx, sql)
+		return err
+	},
 }
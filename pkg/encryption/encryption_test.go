@@ -0,0 +1,204 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, plain, dataKey []byte) []byte {
+	t.Helper()
+	r, err := NewEncryptReader(bytes.NewReader(plain), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestStream(t *testing.T) {
+	dataKey := newKey(t)
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealed := encrypt(t, plain, dataKey)
+		if got := int64(len(sealed)); got != EncryptedSize(int64(size)) {
+			t.Fatalf("size %d: expect encrypted size %d, got %d", size, EncryptedSize(int64(size)), got)
+		}
+		if got := DecryptedSize(int64(len(sealed))); got != int64(size) {
+			t.Fatalf("size %d: expect decrypted size %d, got %d", size, size, got)
+		}
+
+		got, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(sealed), dataKey))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	dataKey := newKey(t)
+	plain := make([]byte, 3*segmentSize+7)
+	rand.Read(plain)
+	sealed := encrypt(t, plain, dataKey)
+	size := int64(len(sealed))
+
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 1},
+		{0, int64(len(plain))},
+		{10, 100},
+		{segmentSize - 1, 2},
+		{segmentSize, segmentSize},
+		{2*segmentSize + 5, segmentSize + 2},
+		{int64(len(plain)) - 1, 1},
+	} {
+		start, end := EncryptedRange(size, r.offset, r.length)
+		got, err := ioutil.ReadAll(NewDecryptRangeReader(
+			bytes.NewReader(sealed[:HeaderSize]), bytes.NewReader(sealed[start:end]), dataKey, r.offset, r.length,
+		))
+		if err != nil {
+			t.Fatalf("range %d+%d: %v", r.offset, r.length, err)
+		}
+		if !bytes.Equal(got, plain[r.offset:r.offset+r.length]) {
+			t.Fatalf("range %d+%d: decrypted content differs", r.offset, r.length)
+		}
+	}
+}
+
+func TestStreamUniqueCiphertext(t *testing.T) {
+	dataKey := newKey(t)
+	plain := []byte("same content")
+	if bytes.Equal(encrypt(t, plain, dataKey), encrypt(t, plain, dataKey)) {
+		t.Fatal("expect same content encrypted differently each time")
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	dataKey := newKey(t)
+	plain := make([]byte, 2*segmentSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, plain, dataKey)
+	segment := segmentSize + tagSize
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[HeaderSize+segment+10] ^= 1
+
+	swapped := append([]byte(nil), sealed[:HeaderSize]...)
+	swapped = append(swapped, sealed[HeaderSize+segment:HeaderSize+2*segment]...)
+	swapped = append(swapped, sealed[HeaderSize:HeaderSize+segment]...)
+	swapped = append(swapped, sealed[HeaderSize+2*segment:]...)
+
+	tests := []struct {
+		name    string
+		content []byte
+		dataKey []byte
+		err     error
+	}{
+		{"flipped bit", flipped, dataKey, ErrInvalidKey},
+		{"swapped segments", swapped, dataKey, ErrInvalidKey},
+		{"truncated at segment", sealed[:HeaderSize+2*segment], dataKey, ErrInvalidKey},
+		{"truncated in segment", sealed[:len(sealed)-1], dataKey, ErrInvalidKey},
+		{"extended", append(append([]byte(nil), sealed...), 0), dataKey, ErrInvalidKey},
+		{"other key", sealed, newKey(t), ErrInvalidKey},
+		{"plaintext", plain, dataKey, ErrUnsupportedFormat},
+		{"short", sealed[:HeaderSize-1], dataKey, ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.Copy(ioutil.Discard, NewDecryptReader(bytes.NewReader(tt.content), tt.dataKey))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expect %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	oldKey, newKey := newKey(t), newKey(t)
+	old, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, wrapped, err := old.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != old.ActiveID() {
+		t.Fatalf("expect data key wrapped by active master key %s, got %s", old.ActiveID(), id)
+	}
+
+	// After a rotation the old master key still unwraps.
+	rotated, err := NewKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ActiveID() == id {
+		t.Fatal("expect the new master key active")
+	}
+	got, err := rotated.Unwrap(id, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("unwrapped data key differs")
+	}
+
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := rotated.Unwrap(id, wrapped); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expect %v, got %v", ErrInvalidKey, err)
+	}
+	if _, err := rotated.Unwrap("unknown", wrapped); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Fatalf("expect %v, got %v", ErrUnknownMasterKey, err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key := newKey(t)
+	dir := t.TempDir()
+	hexFile := filepath.Join(dir, "hex")
+	base64File := filepath.Join(dir, "base64")
+	shortFile := filepath.Join(dir, "short")
+	ioutil.WriteFile(hexFile, []byte(hex.EncodeToString(key)+"\n"), 0o600)
+	ioutil.WriteFile(base64File, []byte(base64.StdEncoding.EncodeToString(key)), 0o600)
+	ioutil.WriteFile(shortFile, []byte("deadbeef"), 0o600)
+
+	k, err := LoadKeyring([]string{hexFile, base64File})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.keys) != 1 || k.ActiveID() != masterKeyID(key) {
+		t.Fatal("expect both files decoded to the same key")
+	}
+	if _, err := LoadKeyring([]string{shortFile}); err == nil {
+		t.Fatal("expect a short key rejected")
+	}
+	if _, err := LoadKeyring(nil); err == nil {
+		t.Fatal("expect an empty keyring rejected")
+	}
+}
@@ -0,0 +1,152 @@
+// Package encryption implements envelope encryption of stored content:
+// content is encrypted with data keys, which are wrapped by master keys kept out of database.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// KeySize is size in bytes of master keys and data keys, they are AES-256 keys.
+const KeySize = 32
+
+var (
+	// ErrUnknownMasterKey indicates a data key is wrapped by a master key not in keyring.
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	// ErrInvalidKey indicates a wrapped key or encrypted content fails authentication.
+	ErrInvalidKey = errors.New("invalid key or corrupted content")
+)
+
+// Keyring holds master keys. The active one wraps new data keys, the others only unwrap data keys
+// wrapped before a master key rotation.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// NewKeyring returns a Keyring of master keys, the first of which is active.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no master key")
+	}
+	k := &Keyring{keys: make(map[string][]byte, len(keys))}
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("master key %d is %d bytes, expect %d", i, len(key), KeySize)
+		}
+		id := masterKeyID(key)
+		if i == 0 {
+			k.active = id
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+// LoadKeyring returns a Keyring of master keys read from files, the first of which is active.
+// A file holds 32 bytes hex or base64 encoded, e.g. generated by `openssl rand -hex 32`.
+func LoadKeyring(paths []string) (*Keyring, error) {
+	keys := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeKey(bytes.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("master key file %s: %w", p, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// decodeKey decodes a hex or base64 encoded key.
+func decodeKey(b []byte) ([]byte, error) {
+	if key, err := hex.DecodeString(string(b)); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(b)); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("expect %d bytes hex or base64 encoded", KeySize)
+}
+
+// masterKeyID identifies a master key without revealing it.
+func masterKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("orchid master key id"))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// ActiveID returns id of the active master key.
+func (k *Keyring) ActiveID() string {
+	return k.active
+}
+
+// Wrap encrypts a data key with the active master key, returning id of the master key and wrapped key.
+func (k *Keyring) Wrap(dataKey []byte) (string, []byte, error) {
+	aead, err := newGCM(k.keys[k.active])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.active, aead.Seal(nonce, nonce, dataKey, []byte(k.active)), nil
+}
+
+// Unwrap decrypts a data key wrapped by master key of id.
+func (k *Keyring) Unwrap(id string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidKey
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return dataKey, nil
+}
+
+// Derive returns a secret derived from the active master key for purpose, e.g. to sign urls with.
+func (k *Keyring) Derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.keys[k.active])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// GenerateKey returns a new random data key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,275 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted content is a header followed by segments of content sealed by AES-256-GCM.
+// Header holds a random salt, from which and a data key the content key is derived, so
+// that nonces never repeat under a key however much content a data key encrypts.
+// Segments are numbered in their nonces and the last one is flagged, so that reordered,
+// truncated or extended content fails authentication.
+const (
+	magic    = "ORC"
+	version  = 1
+	saltSize = 32
+	// HeaderSize is size of header of encrypted content.
+	HeaderSize  = len(magic) + 1 + saltSize
+	segmentSize = 64 << 10
+	tagSize     = 16
+)
+
+// ErrUnsupportedFormat indicates content isn't encrypted by this package.
+var ErrUnsupportedFormat = errors.New("unsupported encrypted content format")
+
+// EncryptedSize returns size of encrypted content of size bytes.
+func EncryptedSize(size int64) int64 {
+	segments := (size + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		// Empty content still has the last segment.
+		segments = 1
+	}
+	return int64(HeaderSize) + size + segments*tagSize
+}
+
+// DecryptedSize returns size of content encrypted in size bytes, which is negative if size is invalid.
+func DecryptedSize(size int64) int64 {
+	size -= int64(HeaderSize)
+	if size < tagSize {
+		return -1
+	}
+	segments := (size + segmentSize + tagSize - 1) / (segmentSize + tagSize)
+	return size - segments*tagSize
+}
+
+// contentCipher returns cipher of content whose header holds salt.
+func contentCipher(dataKey, salt []byte) (cipher.AEAD, error) {
+	if len(dataKey) != KeySize {
+		return nil, errors.New("invalid data key size")
+	}
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write(salt)
+	return newGCM(mac.Sum(nil))
+}
+
+// segmentNonce returns nonce of segment n.
+func segmentNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader reads content of r encrypted.
+type encryptReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	// plain buffers a segment and one more byte, which tells whether the segment is the last.
+	plain []byte
+	// out is encrypted content not read yet.
+	out  []byte
+	n    uint64
+	done bool
+}
+
+// NewEncryptReader returns a reader of content of r encrypted with dataKey.
+func NewEncryptReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	header := make([]byte, HeaderSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	salt := header[len(magic)+1:]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := contentCipher(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		r:     r,
+		aead:  aead,
+		plain: make([]byte, 0, segmentSize+1),
+		out:   header,
+	}, nil
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// seal reads and seals the next segment.
+func (er *encryptReader) seal() error {
+	n, err := io.ReadFull(er.r, er.plain[len(er.plain):cap(er.plain)])
+	er.plain = er.plain[:len(er.plain)+n]
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	last := len(er.plain) <= segmentSize
+	segment := er.plain
+	if !last {
+		segment = er.plain[:segmentSize]
+	}
+	er.out = er.aead.Seal(er.out[:0], segmentNonce(er.n, last), segment, nil)
+	er.n++
+
+	if last {
+		er.done = true
+		er.plain = er.plain[:0]
+	} else {
+		er.plain = append(er.plain[:0], er.plain[segmentSize])
+	}
+	return nil
+}
+
+// decryptReader reads content of r decrypted.
+type decryptReader struct {
+	r io.Reader
+	// header is read from r if it's nil.
+	header  io.Reader
+	dataKey []byte
+	aead    cipher.AEAD
+	// sealed buffers a segment and one more byte, which tells whether the segment is the last.
+	sealed []byte
+	// out is decrypted content not read yet.
+	out  []byte
+	n    uint64
+	done bool
+}
+
+// NewDecryptReader returns a reader of content of r decrypted with dataKey.
+// Reading fails with ErrInvalidKey if content has been tampered with or isn't encrypted with dataKey.
+func NewDecryptReader(r io.Reader, dataKey []byte) io.Reader {
+	return &decryptReader{r: r, dataKey: dataKey}
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	if dr.aead == nil {
+		if err := dr.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// readHeader reads header of content and derives its cipher.
+func (dr *decryptReader) readHeader() error {
+	src := dr.header
+	if src == nil {
+		src = dr.r
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrUnsupportedFormat
+		}
+		return err
+	}
+	if string(header[:len(magic)]) != magic || header[len(magic)] != version {
+		return ErrUnsupportedFormat
+	}
+	aead, err := contentCipher(dr.dataKey, header[len(magic)+1:])
+	if err != nil {
+		return err
+	}
+	dr.aead = aead
+	dr.sealed = make([]byte, 0, segmentSize+tagSize+1)
+	return nil
+}
+
+// EncryptedRange returns range [start, end) of encrypted content of size bytes holding plaintext range
+// [offset, offset+length). It covers whole segments and a byte of the next segment if any, which tells
+// the last segment from others.
+func EncryptedRange(size, offset, length int64) (start, end int64) {
+	first, last := offset/segmentSize, (offset+length-1)/segmentSize
+	start = int64(HeaderSize) + first*(segmentSize+tagSize)
+	end = int64(HeaderSize) + (last+1)*(segmentSize+tagSize) + 1
+	if end > size {
+		end = size
+	}
+	return start, end
+}
+
+// NewDecryptRangeReader returns a reader of plaintext range [offset, offset+length) of encrypted content,
+// whose header is read from header and range EncryptedRange(size, offset, length) is read from r.
+func NewDecryptRangeReader(header, r io.Reader, dataKey []byte, offset, length int64) io.Reader {
+	dr := &decryptReader{r: r, header: header, dataKey: dataKey, n: uint64(offset / segmentSize)}
+	return io.LimitReader(&skipReader{r: dr, skip: offset % segmentSize}, length)
+}
+
+// skipReader reads r but its first skip bytes.
+type skipReader struct {
+	r    io.Reader
+	skip int64
+}
+
+func (sr *skipReader) Read(p []byte) (int, error) {
+	if sr.skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, sr.r, sr.skip); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		sr.skip = 0
+	}
+	return sr.r.Read(p)
+}
+
+// open reads and opens the next segment.
+func (dr *decryptReader) open() error {
+	n, err := io.ReadFull(dr.r, dr.sealed[len(dr.sealed):cap(dr.sealed)])
+	dr.sealed = dr.sealed[:len(dr.sealed)+n]
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	last := len(dr.sealed) <= segmentSize+tagSize
+	segment := dr.sealed
+	if !last {
+		segment = dr.sealed[:segmentSize+tagSize]
+	}
+	out, err := dr.aead.Open(dr.out[:0], segmentNonce(dr.n, last), segment, nil)
+	if err != nil {
+		return ErrInvalidKey
+	}
+	dr.out = out
+	dr.n++
+
+	if last {
+		dr.done = true
+		dr.sealed = dr.sealed[:0]
+	} else {
+		dr.sealed = append(dr.sealed[:0], dr.sealed[segmentSize+tagSize])
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package imaging inspects, sanitizes and scales uploaded images in pure Go.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Register WebP decoder.
+)
+
+// Supported image formats, named as image.DecodeConfig reports them.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+// thumbnailJPEGQuality is quality of JPEG encoded thumbnails.
+const thumbnailJPEGQuality = 85
+
+var (
+	// ErrUnsupportedFormat indicates data isn't an image of a supported format.
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	// ErrTooLarge indicates an image has more pixels than allowed.
+	ErrTooLarge = errors.New("image dimensions too large")
+)
+
+// Info is header information of an image.
+type Info struct {
+	Format string
+	Width  int
+	Height int
+}
+
+// Inspect decodes image header of data without decoding pixels,
+// so that images with more pixels than maxPixels are rejected before they take up memory.
+func Inspect(data []byte, maxPixels int64) (Info, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Info{}, ErrUnsupportedFormat
+	}
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+	default:
+		return Info{}, ErrUnsupportedFormat
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return Info{}, ErrTooLarge
+	}
+	return Info{format, config.Width, config.Height}, nil
+}
+
+// Decode decodes image data upright, i.e. with its EXIF orientation applied.
+// Only the first frame of an animated image is decoded.
+func Decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return orient(img, Orientation(data)), nil
+}
+
+// Thumbnail scales img down to fit in a size x size square keeping its aspect ratio.
+// An image already fitting in is returned as is.
+func Thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// EncodeThumbnail encodes a thumbnail of an image of source format and returns its content type.
+// Thumbnails of JPEG images are JPEG, others are PNG to keep transparency.
+func EncodeThumbnail(w io.Writer, img image.Image, format string) (string, error) {
+	if format == FormatJPEG {
+		return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	}
+	return "image/png", png.Encode(w, img)
+}
+
+// ContentType returns MIME type of an image format.
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// reencodeGIF decodes and encodes all frames of a GIF, dropping all extensions but animation control.
+func reencodeGIF(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,174 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 0xff})
+		}
+	}
+	return img
+}
+
+// jpegWithMetadata returns a JPEG with an EXIF segment of orientation and a comment right after SOI.
+func jpegWithMetadata(t *testing.T, w, h, orientation int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	comment := []byte{0xff, jpegCOM, 0x00, 0x0a, 'l', 'a', 't', ' ', '4', '2', '.', '0'}
+	exif := orientationSegment(orientation)
+	// Pad EXIF with GPS data stand-in, which must not survive stripping.
+	exif = append(exif, []byte("GPS")...)
+	binary.BigEndian.PutUint16(exif[2:], uint16(len(exif)-2))
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, exif...)
+	out = append(out, comment...)
+	return append(out, data[2:]...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := jpegWithMetadata(t, 40, 20, 6)
+	if got := Orientation(data); got != 6 {
+		t.Fatalf("expect orientation 6, got %d", got)
+	}
+
+	stripped, err := StripMetadata(FormatJPEG, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) || bytes.Contains(stripped, []byte("lat 42.0")) {
+		t.Fatal("expect metadata stripped")
+	}
+	if got := Orientation(stripped); got != 6 {
+		t.Fatalf("expect orientation kept, got %d", got)
+	}
+
+	img, err := Decode(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("expect decoded image upright 20x40, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+// pngChunk returns an encoded PNG chunk.
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func TestStripPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(8, 8)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Insert a text chunk before IEND, the last 12 bytes.
+	iend := len(data) - 12
+	data = append(append(append([]byte{}, data[:iend]...), pngChunk("tEXt", []byte("Author\x00someone"))...), data[iend:]...)
+
+	stripped, err := StripMetadata(FormatPNG, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("tEXt")) {
+		t.Fatal("expect text chunk stripped")
+	}
+	if !bytes.Equal(stripped, buf.Bytes()) {
+		t.Fatal("expect other chunks untouched")
+	}
+}
+
+// webpChunk returns an encoded WebP chunk.
+func webpChunk(fourCC string, data []byte) []byte {
+	chunk := make([]byte, 8, 9+len(data))
+	copy(chunk, fourCC)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP
+	var body []byte
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2f, 1, 2})...)
+	body = append(body, webpChunk("EXIF", []byte("GPS"))...)
+	body = append(body, webpChunk("XMP ", []byte("<x/>"))...)
+	data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+
+	stripped, err := StripMetadata(FormatWebP, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) || bytes.Contains(stripped, []byte("XMP ")) {
+		t.Fatal("expect metadata chunks stripped")
+	}
+	if got := binary.LittleEndian.Uint32(stripped[4:]); int(got) != len(stripped)-8 {
+		t.Fatalf("expect RIFF size %d, got %d", len(stripped)-8, got)
+	}
+	if flags := stripped[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Fatalf("expect metadata flags cleared, got %#x", flags)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	data := jpegWithMetadata(t, 40, 20, 1)
+	info, err := Inspect(data, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatJPEG || info.Width != 40 || info.Height != 20 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if _, err := Inspect(data, 799); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expect ErrTooLarge, got %v", err)
+	}
+	if _, err := Inspect([]byte("not an image"), 800); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expect ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		w, h, size   int
+		wantW, wantH int
+	}{
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{50, 20, 100, 50, 20},
+	}
+	for _, tt := range tests {
+		b := Thumbnail(testImage(tt.w, tt.h), tt.size).Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("thumbnail %d of %dx%d: expect %dx%d, got %dx%d", tt.size, tt.w, tt.h, tt.wantW, tt.wantH, b.Dx(), b.Dy())
+		}
+	}
+}
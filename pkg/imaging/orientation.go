@@ -0,0 +1,129 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// exifHeader precedes TIFF structured EXIF data in a JPEG APP1 segment.
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientationTag is EXIF tag of image orientation.
+const exifOrientationTag = 0x0112
+
+// Orientation returns EXIF orientation of JPEG data from 1 to 8, 1 means upright.
+// It returns 1 for other formats or if orientation is absent.
+func Orientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == jpegSOS {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+		if marker == jpegAPP1 && bytes.HasPrefix(data[i+4:end], exifHeader) {
+			if o := tiffOrientation(data[i+4+len(exifHeader) : end]); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+		i = end
+	}
+	return 1
+}
+
+// tiffOrientation returns orientation entry of the first IFD of TIFF data, or 0 if absent.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientationSegment returns a JPEG APP1 segment of minimal EXIF data holding nothing but orientation.
+func orientationSegment(o int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, // Big endian TIFF header.
+		0x00, 0x00, 0x00, 0x08, // Offset of the first IFD.
+		0x00, 0x01, // One entry.
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // Orientation, SHORT, count 1.
+		0x00, byte(o), 0x00, 0x00, // Value padded to 4 bytes.
+		0x00, 0x00, 0x00, 0x00, // No next IFD.
+	}
+	seg := []byte{0xff, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len(exifHeader)+len(tiff)))
+	seg = append(seg, exifHeader...)
+	return append(seg, tiff...)
+}
+
+// orient transforms img as EXIF orientation o describes, so that it becomes upright.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations from 5 on swap width and height.
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // Mirrored horizontally.
+				sx, sy = w-1-x, y
+			case 3: // Rotated 180°.
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically.
+				sx, sy = x, h-1-y
+			case 5: // Transposed.
+				sx, sy = y, x
+			case 6: // Rotated 90° counterclockwise, turn it clockwise.
+				sx, sy = y, h-1-x
+			case 7: // Transversed.
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotated 90° clockwise, turn it counterclockwise.
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
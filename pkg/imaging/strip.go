@@ -0,0 +1,184 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errMalformed indicates image data can't be parsed while stripping metadata.
+var errMalformed = errors.New("malformed image data")
+
+// StripMetadata returns image data without metadata such as EXIF (GPS included), XMP, IPTC and comments.
+// JPEG, PNG and WebP are rewritten at container level, so pixels are kept untouched.
+// EXIF orientation of a JPEG survives in a minimal EXIF segment, so that the image is displayed upright.
+// GIF is re-encoded, which is lossless since its frames are paletted.
+func StripMetadata(format string, data []byte) ([]byte, error) {
+	switch format {
+	case FormatJPEG:
+		return stripJPEG(data)
+	case FormatPNG:
+		return stripPNG(data)
+	case FormatWebP:
+		return stripWebP(data)
+	case FormatGIF:
+		return reencodeGIF(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// JPEG markers.
+const (
+	jpegSOI   = 0xd8
+	jpegSOS   = 0xda
+	jpegAPP0  = 0xe0
+	jpegAPP1  = 0xe1
+	jpegAPP2  = 0xe2
+	jpegAPP14 = 0xee
+	jpegCOM   = 0xfe
+)
+
+// keepJPEGSegment reports whether a JPEG segment is kept by stripJPEG.
+// JFIF, ICC profile and Adobe segments affect how pixels are decoded, other application segments and comments are metadata.
+func keepJPEGSegment(marker byte) bool {
+	if marker == jpegCOM {
+		return false
+	}
+	if marker >= jpegAPP0 && marker <= 0xef {
+		return marker == jpegAPP0 || marker == jpegAPP2 || marker == jpegAPP14
+	}
+	return true
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, errMalformed
+	}
+	var out bytes.Buffer
+	out.Write(data[:2])
+	if o := Orientation(data); o != 1 {
+		out.Write(orientationSegment(o))
+	}
+
+	for i := 2; ; {
+		if i+1 >= len(data) || data[i] != 0xff {
+			return nil, errMalformed
+		}
+		marker := data[i+1]
+		// Fill bytes may precede a marker.
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// Standalone markers have no length.
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+		// Entropy coded data follows scan header, everything from there on is image data.
+		if marker == jpegSOS {
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		if i+4 > len(data) {
+			return nil, errMalformed
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, errMalformed
+		}
+		if keepJPEGSegment(marker) {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+// pngSignature is the first 8 bytes of every PNG.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are ancillary PNG chunks carrying metadata.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errMalformed
+	}
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		// A chunk is length, type, data and CRC.
+		if i+8 > len(data) {
+			return nil, errMalformed
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, errMalformed
+		}
+		typ := string(data[i+4 : i+8])
+		if !pngMetadataChunks[typ] {
+			out.Write(data[i:end])
+		}
+		i = end
+		if typ == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// VP8X flags of metadata chunks present in a WebP.
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformed
+	}
+	var chunks bytes.Buffer
+	for i := 12; i < len(data); {
+		// A chunk is FourCC, little endian size and data padded to an even size.
+		if i+8 > len(data) {
+			return nil, errMalformed
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size&1
+		if end > len(data) || end < i {
+			// The last chunk may lack its padding byte.
+			if end-1 != len(data) {
+				return nil, errMalformed
+			}
+			end = len(data)
+		}
+		chunk := data[i:end]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if size < 1 {
+				return nil, errMalformed
+			}
+			vp8x := append([]byte(nil), chunk...)
+			vp8x[8] &^= webpFlagEXIF | webpFlagXMP
+			chunks.Write(vp8x)
+		default:
+			chunks.Write(chunk)
+		}
+		i = end
+	}
+
+	out := make([]byte, 12, 12+chunks.Len())
+	copy(out, data[:12])
+	binary.LittleEndian.PutUint32(out[4:], uint32(4+chunks.Len()))
+	return append(out, chunks.Bytes()...), nil
+}
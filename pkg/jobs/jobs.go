@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/logging"
+)
+
+// Job is a unit of background work.
+type Job func(ctx context.Context) error
+
+// Every runs job immediately and then every interval until ctx is done.
+// An error returned from job is logged and doesn't stop next runs.
+func Every(ctx context.Context, name string, interval time.Duration, job Job) {
+	logger := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		logger.Debugf("Running job: %s", name)
+		if err := job(ctx); err != nil {
+			logger.Errorf("job %s failed: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Leader reports whether this instance leads instances sharing jobs, e.g. a cache.Election.
+type Leader interface {
+	Leading() bool
+}
+
+// WhenLeading returns a job running job only while leader leads, so that only one of instances runs it.
+// Leadership may be lost during a run, so a run may briefly overlap a run of a new leader, job has to be idempotent.
+func WhenLeading(leader Leader, job Job) Job {
+	return func(ctx context.Context) error {
+		if !leader.Leading() {
+			return nil
+		}
+		return job(ctx)
+	}
+}
@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/williamlsh/orchid/pkg/logging"
+	"go.uber.org/zap"
+)
+
+func TestEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(logging.WithLogger(context.Background(), zap.NewExample().Sugar()))
+	defer cancel()
+
+	runs := make(chan struct{}, 3)
+	done := make(chan struct{})
+	go func() {
+		Every(ctx, "test", 10*time.Millisecond, func(ctx context.Context) error {
+			runs <- struct{}{}
+			if len(runs) == cap(runs) {
+				cancel()
+			}
+			// A failed run doesn't stop the job.
+			return errors.New("failed")
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job is not stopped after context is canceled")
+	}
+	if len(runs) != cap(runs) {
+		t.Fatalf("expect %d runs, got %d", cap(runs), len(runs))
+	}
+}
+
+type leader bool
+
+func (l leader) Leading() bool { return bool(l) }
+
+func TestWhenLeading(t *testing.T) {
+	var runs int
+	job := func(ctx context.Context) error {
+		runs++
+		return nil
+	}
+	for _, l := range []leader{true, false} {
+		if err := WhenLeading(l, job)(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("expect job run by leader only, got %d runs", runs)
+	}
+}
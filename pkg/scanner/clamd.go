@@ -0,0 +1,124 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is size of chunks content is streamed to clamd in,
+// it must stay below StreamMaxLength of clamd.
+const clamdChunkSize = 64 << 10
+
+// Clamd is a Scanner speaking ClamAV clamd INSTREAM protocol.
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd returns a Clamd scanner of clamd at address, like tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl.
+func NewClamd(address string, timeout time.Duration) (Clamd, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return Clamd{}, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return Clamd{"tcp", u.Host, timeout}, nil
+	case "unix":
+		return Clamd{"unix", u.Path, timeout}, nil
+	default:
+		return Clamd{}, fmt.Errorf("unsupported clamd address: %s", address)
+	}
+}
+
+// Scan implements Scanner by streaming content to clamd.
+func (c Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if err := writeInstream(conn, r); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// writeInstream writes INSTREAM command followed by content in length prefixed chunks and a zero length terminator.
+func writeInstream(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("zINSTREAM\x00"); err != nil {
+		return err
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := bw.Write(size); err != nil {
+				return err
+			}
+			if _, err := bw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.Write(make([]byte, 4)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// parseReply parses clamd reply of a stream scan, e.g.
+//
+//	stream: OK
+//	stream: Eicar-Test-Signature FOUND
+//	INSTREAM size limit exceeded. ERROR
+func parseReply(reply string) (Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, fmt.Errorf("%w: %s", ErrScanFailed, reply)
+	case reply == "stream: OK":
+		return Result{Clean: true}, nil
+	case strings.HasPrefix(reply, "stream: ") && strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return Result{Clean: false, Signature: signature}, nil
+	default:
+		return Result{}, fmt.Errorf("unexpected clamd reply: %q", reply)
+	}
+}
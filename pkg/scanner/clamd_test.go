@@ -0,0 +1,141 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// readInstream reads content streamed by an INSTREAM command.
+func readInstream(r io.Reader) ([]byte, error) {
+	var content bytes.Buffer
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			return content.Bytes(), nil
+		}
+		if _, err := io.CopyN(&content, r, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fakeClamd serves INSTREAM commands on l, finding EICAR test signature and rejecting content larger than maxSize.
+func fakeClamd(t *testing.T, l net.Listener, maxSize int) {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				content, err := readInstream(r)
+				switch {
+				case err != nil:
+					return
+				case len(content) > maxSize:
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				case bytes.Contains(content, []byte(eicar)):
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				default:
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+}
+
+func TestClamd(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeClamd(t, tcp, 1<<20)
+
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "clamd.ctl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeClamd(t, unix, 1<<20)
+
+	for _, address := range []string{"tcp://" + tcp.Addr().String(), "unix://" + unix.Addr().String()} {
+		c, err := NewClamd(address, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Content spanning several chunks.
+		clean := strings.Repeat("a", 3*clamdChunkSize+1)
+		result, err := c.Scan(context.Background(), strings.NewReader(clean))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Clean {
+			t.Fatalf("%s: expect clean content, got %+v", address, result)
+		}
+
+		result, err = c.Scan(context.Background(), strings.NewReader(clean+eicar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Clean || result.Signature != "Eicar-Test-Signature" {
+			t.Fatalf("%s: expect EICAR found, got %+v", address, result)
+		}
+
+		_, err = c.Scan(context.Background(), strings.NewReader(strings.Repeat("a", 1<<20+1)))
+		if !errors.Is(err, ErrScanFailed) {
+			t.Fatalf("%s: expect ErrScanFailed, got %v", address, err)
+		}
+	}
+}
+
+func TestNewClamdAddress(t *testing.T) {
+	if _, err := NewClamd("127.0.0.1:3310", time.Second); err == nil {
+		t.Fatal("expect address without scheme rejected")
+	}
+	c, err := NewClamd("unix:///var/run/clamav/clamd.ctl", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.network != "unix" || c.address != "/var/run/clamav/clamd.ctl" {
+		t.Fatalf("unexpected clamd: %+v", c)
+	}
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(ConfigOptions{Backend: BackendNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Scan(context.Background(), strings.NewReader(eicar))
+	if err != nil || !result.Clean {
+		t.Fatalf("expect no-op scanner accept everything, got %+v %v", result, err)
+	}
+	if _, err := New(ConfigOptions{Backend: "unknown"}); err == nil {
+		t.Fatal("expect unknown backend rejected")
+	}
+}
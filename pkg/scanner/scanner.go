@@ -0,0 +1,66 @@
+// Package scanner scans uploaded content for malware and disallowed content.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Scanner backends.
+const (
+	// BackendNone accepts all content without scanning.
+	BackendNone = "none"
+	// BackendClamd scans content with a ClamAV daemon.
+	BackendClamd = "clamd"
+)
+
+// ErrScanFailed indicates scanner refused to scan content, e.g. because it exceeds a size limit.
+// Scanning the same content again fails the same way.
+var ErrScanFailed = errors.New("scan failed")
+
+// ConfigOptions configures scanner.
+type ConfigOptions struct {
+	// Backend is one of BackendNone and BackendClamd.
+	Backend string
+	// ClamdAddress is address of clamd, like tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl.
+	ClamdAddress string
+	// Timeout limits a single scan.
+	Timeout time.Duration
+}
+
+// Result is verdict of a scan.
+type Result struct {
+	// Clean reports whether no threat is found.
+	Clean bool
+	// Signature names the threat found.
+	Signature string
+}
+
+// Scanner scans content.
+type Scanner interface {
+	// Scan reads content from r until EOF and returns its verdict.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// New returns a Scanner of configured backend.
+func New(config ConfigOptions) (Scanner, error) {
+	switch config.Backend {
+	case BackendNone, "":
+		return Nop{}, nil
+	case BackendClamd:
+		return NewClamd(config.ClamdAddress, config.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown scanner backend: %s", config.Backend)
+	}
+}
+
+// Nop is a Scanner accepting all content.
+type Nop struct{}
+
+// Scan implements Scanner, it doesn't read content.
+func (Nop) Scan(context.Context, io.Reader) (Result, error) {
+	return Result{Clean: true}, nil
+}
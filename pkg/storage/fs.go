@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewFilesystem returns a Local keeping objects in directory config.Root.
+func NewFilesystem(ctx context.Context, config ConfigOptions) (*Local, error) {
+	if config.Root == "" {
+		return nil, errors.New("root directory of filesystem storage is empty")
+	}
+	if err := os.MkdirAll(config.Root, 0o750); err != nil {
+		return nil, err
+	}
+	return newLocal(&fsBackend{root: config.Root}, config)
+}
+
+// Layout of a bucket directory. Content of an object is a file in dataDir named randomly,
+// a metadata file in metaDir named after object key points to it. Replacing metadata file is atomic,
+// so readers never see a partially written object.
+const (
+	dataDir = "data"
+	metaDir = "meta"
+	tmpDir  = "tmp"
+)
+
+// fsMeta is content of a metadata file.
+type fsMeta struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+	Data         string    `json:"data"`
+}
+
+func (m fsMeta) info() ObjectInfo {
+	return ObjectInfo{m.Key, m.Size, m.ETag, m.ContentType, m.LastModified}
+}
+
+// fsBackend keeps objects in a directory per bucket.
+type fsBackend struct {
+	root string
+	// mu serializes replacing metadata files, so that no data file is left unreferenced.
+	mu sync.Mutex
+}
+
+// encodeKey returns name of metadata file of an object key.
+// Slashes are escaped, so that keys map to a flat directory and "a" and "a/b" may coexist.
+func encodeKey(key string) string {
+	name := url.PathEscape(key)
+	// Names "." and ".." refer to directories.
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+func (f *fsBackend) path(bucket string, elem ...string) string {
+	return filepath.Join(append([]string{f.root, bucket}, elem...)...)
+}
+
+func (f *fsBackend) makeBucket(bucket string) error {
+	for _, dir := range []string{dataDir, metaDir, tmpDir} {
+		if err := os.MkdirAll(f.path(bucket, dir), 0o750); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBucket returns errBucketNotFound if bucket doesn't exist.
+func (f *fsBackend) checkBucket(bucket string) error {
+	if _, err := os.Stat(f.path(bucket, metaDir)); errors.Is(err, os.ErrNotExist) {
+		return errBucketNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fsBackend) put(bucket, key string, r io.Reader, info func() ObjectInfo) error {
+	if key == "" {
+		return errors.New("empty object key")
+	}
+	if err := f.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	data := hex.EncodeToString(b)
+	if err := writeFile(f.path(bucket, tmpDir), f.path(bucket, dataDir, data), r); err != nil {
+		return err
+	}
+
+	i := info()
+	meta, err := json.Marshal(fsMeta{i.Key, i.Size, i.ETag, i.ContentType, i.LastModified, data})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old, err := f.meta(bucket, key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		f.mu.Unlock()
+		return err
+	}
+	err = writeFile(f.path(bucket, tmpDir), f.path(bucket, metaDir, encodeKey(key)), bytes.NewReader(meta))
+	f.mu.Unlock()
+	if err != nil {
+		os.Remove(f.path(bucket, dataDir, data))
+		return err
+	}
+
+	if old.Data != "" {
+		return removeFile(f.path(bucket, dataDir, old.Data))
+	}
+	return nil
+}
+
+// writeFile writes content of r into a temporary file in dir, then renames it to path.
+func writeFile(dir, path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(dir, "put-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeFile removes a file, a missing file isn't an error.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// meta reads metadata of an object, or returns ErrObjectNotFound.
+func (f *fsBackend) meta(bucket, key string) (fsMeta, error) {
+	var meta fsMeta
+	b, err := ioutil.ReadFile(f.path(bucket, metaDir, encodeKey(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		if err := f.checkBucket(bucket); err != nil {
+			return meta, err
+		}
+		return meta, ErrObjectNotFound
+	}
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(b, &meta)
+}
+
+func (f *fsBackend) get(bucket, key string) (ObjectInfo, io.ReadCloser, error) {
+	// A data file is removed once its object is replaced, in which case metadata is read again.
+	for retried := false; ; retried = true {
+		meta, err := f.meta(bucket, key)
+		if err != nil {
+			return ObjectInfo{}, nil, err
+		}
+		file, err := os.Open(f.path(bucket, dataDir, meta.Data))
+		if errors.Is(err, os.ErrNotExist) && !retried {
+			continue
+		}
+		if err != nil {
+			return ObjectInfo{}, nil, err
+		}
+		return meta.info(), file, nil
+	}
+}
+
+func (f *fsBackend) stat(bucket, key string) (ObjectInfo, error) {
+	meta, err := f.meta(bucket, key)
+	return meta.info(), err
+}
+
+func (f *fsBackend) remove(bucket, key string) error {
+	f.mu.Lock()
+	meta, err := f.meta(bucket, key)
+	if err == nil {
+		err = os.Remove(f.path(bucket, metaDir, encodeKey(key)))
+	}
+	f.mu.Unlock()
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return removeFile(f.path(bucket, dataDir, meta.Data))
+}
+
+func (f *fsBackend) list(bucket, prefix string, fn func(ObjectInfo) error) error {
+	entries, err := ioutil.ReadDir(f.path(bucket, metaDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return errBucketNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, e := range entries {
+		key, err := url.PathUnescape(e.Name())
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		meta, err := f.meta(bucket, k)
+		if errors.Is(err, ErrObjectNotFound) {
+			// Removed meanwhile.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(meta.info()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxFormFieldSize limits size of a form field other than file of a post policy upload.
+const maxFormFieldSize = 64 << 10
+
+var (
+	// errEntityTooLarge indicates content of a post policy upload exceeds its maximum size.
+	errEntityTooLarge = errors.New("entity too large")
+	// errEntityTooSmall indicates content of a post policy upload is less than its minimum size.
+	errEntityTooSmall = errors.New("entity too small")
+)
+
+// ServeHTTP serves presigned urls of l: GET of objects, PUT of multipart upload parts
+// and POST of HTTP multipart forms under post policies.
+// Failures are reported as plain text, status codes follow S3.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, ok := l.signer.SplitPath(r.URL.Path)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key != "":
+		l.serveGet(w, r, bucket, key)
+	case r.Method == http.MethodPut && key != "":
+		l.servePutPart(w, r, bucket, key)
+	case r.Method == http.MethodPost && key == "":
+		l.servePost(w, r, bucket)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyURL reports whether request r to object is signed, or reports failure to w.
+func (l *Local) verifyURL(w http.ResponseWriter, r *http.Request, bucket, key string) bool {
+	if err := l.signer.Verify(r, bucket, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serveGet serves a presigned download of an object.
+func (l *Local) serveGet(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !l.verifyURL(w, r, bucket, key) {
+		return
+	}
+
+	info, rc, err := l.backend.get(bucket, key)
+	if errors.Is(err, ErrObjectNotFound) || errors.Is(err, errBucketNotFound) {
+		http.Error(w, "the specified key does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	query := r.URL.Query()
+	header := w.Header()
+	header.Set("Content-Type", info.ContentType)
+	if v := query.Get("response-content-type"); v != "" {
+		header.Set("Content-Type", v)
+	}
+	if v := query.Get("response-content-disposition"); v != "" {
+		header.Set("Content-Disposition", v)
+	}
+	header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	header.Set("ETag", `"`+info.ETag+`"`)
+	header.Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, rc)
+}
+
+// servePutPart serves a presigned upload of a multipart upload part.
+func (l *Local) servePutPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !l.verifyURL(w, r, bucket, key) {
+		return
+	}
+
+	query := r.URL.Query()
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		http.Error(w, "invalid part number", http.StatusBadRequest)
+		return
+	}
+	part, err := l.PutPart(r.Context(), bucket, key, query.Get("uploadId"), partNumber, r.Body, r.ContentLength)
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		http.Error(w, "the specified multipart upload does not exist", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidPart), errors.Is(err, errSizeMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		w.Header().Set("ETag", `"`+part.ETag+`"`)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// servePost serves an upload of HTTP multipart form under a presigned post policy.
+// As in S3, form fields precede the file, which is the last field.
+func (l *Local) servePost(w http.ResponseWriter, r *http.Request, bucket string) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "malformed post request", http.StatusBadRequest)
+		return
+	}
+
+	form := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			http.Error(w, "malformed post request", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			b, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				http.Error(w, "malformed post request", http.StatusBadRequest)
+				return
+			}
+			form[part.FormName()] = string(b)
+			continue
+		}
+
+		policy, ok := l.verifyPolicy(bucket, form)
+		if !ok {
+			http.Error(w, "signature does not match", http.StatusForbidden)
+			return
+		}
+		if l.now().Unix() > policy.Expires {
+			http.Error(w, "policy has expired", http.StatusForbidden)
+			return
+		}
+		key := form["key"]
+		if key == "" || (policy.Key != "" && key != policy.Key) || !strings.HasPrefix(key, policy.KeyPrefix) {
+			http.Error(w, "policy condition failed: key", http.StatusForbidden)
+			return
+		}
+		contentType := form["Content-Type"]
+		if policy.ContentType != "" && contentType != policy.ContentType {
+			http.Error(w, "policy condition failed: content type", http.StatusForbidden)
+			return
+		}
+
+		l.storePostedFile(w, r, bucket, key, contentType, policy, part)
+		return
+	}
+}
+
+// storePostedFile is an helper for servePost, it stores file of a post request within size range of policy.
+func (l *Local) storePostedFile(w http.ResponseWriter, r *http.Request, bucket, key, contentType string, policy localPolicy, file io.Reader) {
+	// Backends store nothing if reading content fails, so an existing object is kept.
+	_, err := l.PutObject(r.Context(), bucket, key, &rangeReader{r: file, min: policy.MinSize, max: policy.MaxSize}, -1, PutOptions{contentType})
+	switch {
+	case errors.Is(err, errEntityTooLarge):
+		http.Error(w, "your proposed upload exceeds the maximum allowed size", http.StatusBadRequest)
+	case errors.Is(err, errEntityTooSmall):
+		http.Error(w, "your proposed upload is smaller than the minimum allowed size", http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rangeReader reads r whose size must be within min and max, or fails with errEntityTooSmall or errEntityTooLarge.
+type rangeReader struct {
+	r        io.Reader
+	min, max int64
+	n        int64
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if rr.n > rr.max {
+		return n, errEntityTooLarge
+	}
+	if errors.Is(err, io.EOF) && rr.n < rr.min {
+		return n, errEntityTooSmall
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Retention modes of object lock.
+const (
+	// RetentionGovernance protects objects from deletion except by users with special permission.
+	RetentionGovernance = "GOVERNANCE"
+	// RetentionCompliance protects objects from deletion by anyone, root included, until retention ends.
+	RetentionCompliance = "COMPLIANCE"
+)
+
+// ErrNotSupported indicates a storage backend doesn't support a bucket feature.
+var ErrNotSupported = errors.New("not supported by storage backend")
+
+// BucketConfig is declarative configuration of a bucket, it's applied by ConfigureBuckets.
+type BucketConfig struct {
+	Name string `json:"name"`
+	// ObjectLock enables object lock, which implies versioning.
+	// It can only be enabled when a bucket is created and can't be disabled.
+	ObjectLock bool `json:"object_lock"`
+	// Retention is default retention of new objects of a bucket with object lock, there is none if it's nil.
+	Retention *Retention `json:"retention"`
+	// Lifecycle rules replace existing rules of bucket, a bucket without rules has its rules removed.
+	Lifecycle []LifecycleRule `json:"lifecycle"`
+}
+
+// Retention is default retention of objects under object lock.
+type Retention struct {
+	Mode string `json:"mode"`
+	Days uint   `json:"days"`
+}
+
+// LifecycleRule expires objects under a key prefix, zero days disable an action.
+type LifecycleRule struct {
+	ID     string `json:"id"`
+	Prefix string `json:"prefix"`
+	// ExpirationDays is how many days after creation objects are deleted.
+	ExpirationDays int `json:"expiration_days"`
+	// NoncurrentExpirationDays is how many days after becoming noncurrent object versions are deleted.
+	// It only applies to versioned buckets, i.e. buckets with object lock.
+	NoncurrentExpirationDays int `json:"noncurrent_expiration_days"`
+	// AbortIncompleteUploadDays is how many days after initiation incomplete multipart uploads are aborted.
+	AbortIncompleteUploadDays int `json:"abort_incomplete_upload_days"`
+}
+
+// Validate checks that c is a valid bucket configuration.
+func (c BucketConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("bucket name is empty")
+	}
+	if r := c.Retention; r != nil {
+		if !c.ObjectLock {
+			return fmt.Errorf("bucket %s: retention requires object lock", c.Name)
+		}
+		if r.Mode != RetentionGovernance && r.Mode != RetentionCompliance {
+			return fmt.Errorf("bucket %s: invalid retention mode %q", c.Name, r.Mode)
+		}
+		if r.Days == 0 {
+			return fmt.Errorf("bucket %s: retention days must be positive", c.Name)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range c.Lifecycle {
+		if rule.ID == "" || ids[rule.ID] {
+			return fmt.Errorf("bucket %s: lifecycle rule id %q is empty or duplicate", c.Name, rule.ID)
+		}
+		ids[rule.ID] = true
+		if rule.ExpirationDays < 0 || rule.NoncurrentExpirationDays < 0 || rule.AbortIncompleteUploadDays < 0 {
+			return fmt.Errorf("bucket %s: lifecycle rule %s has negative days", c.Name, rule.ID)
+		}
+		if rule.ExpirationDays == 0 && rule.NoncurrentExpirationDays == 0 && rule.AbortIncompleteUploadDays == 0 {
+			return fmt.Errorf("bucket %s: lifecycle rule %s has no action", c.Name, rule.ID)
+		}
+	}
+	return nil
+}
+
+// LoadBucketConfigs reads and validates bucket configurations from a JSON file holding an array of them.
+func LoadBucketConfigs(path string) ([]BucketConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var configs []BucketConfig
+	if err := dec.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("bucket config %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("bucket config %s: %w", path, err)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("bucket config %s: bucket %s is configured twice", path, c.Name)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
@@ -0,0 +1,625 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multipartBucket is the internal bucket of multipart uploads and their parts.
+// S3 bucket names can't start with a dot, so it never clashes with a user bucket.
+const multipartBucket = ".multipart"
+
+// Form fields of presigned post policies of local backends.
+const (
+	fieldPolicy    = "policy"
+	fieldSignature = "x-orchid-signature"
+)
+
+var (
+	// errBucketNotFound indicates a bucket doesn't exist.
+	errBucketNotFound = errors.New("bucket not found")
+	// errSizeMismatch indicates content read isn't as long as declared.
+	errSizeMismatch = errors.New("object size mismatch")
+)
+
+// backend stores whole objects of Local.
+type backend interface {
+	makeBucket(bucket string) error
+	// put stores content read from r, info is called once r is drained.
+	// Readers never see a partially written object.
+	put(bucket, key string, r io.Reader, info func() ObjectInfo) error
+	get(bucket, key string) (ObjectInfo, io.ReadCloser, error)
+	stat(bucket, key string) (ObjectInfo, error)
+	remove(bucket, key string) error
+	// list calls fn with objects whose keys start with prefix in order of keys.
+	list(bucket, prefix string, fn func(ObjectInfo) error) error
+}
+
+// Local is an ObjectStore keeping objects in a backend of this process, i.e. filesystem or memory.
+// Its presigned urls are signed with HMAC and served by Local itself as an http.Handler under PublicURL.
+type Local struct {
+	backend backend
+	signer  *Signer
+
+	mu sync.Mutex
+	// lifecycle are lifecycle rules keyed by bucket, applied by ApplyLifecycle.
+	lifecycle map[string][]LifecycleRule
+}
+
+// newLocal returns a new Local of backend.
+func newLocal(backend backend, config ConfigOptions) (*Local, error) {
+	signer, err := NewSigner(config.PublicURL, []byte(config.SigningSecret))
+	if err != nil {
+		return nil, fmt.Errorf("local storage: %w", err)
+	}
+	return &Local{backend: backend, signer: signer, lifecycle: make(map[string][]LifecycleRule)}, nil
+}
+
+// PathPrefix returns url path under which l serves presigned urls.
+func (l *Local) PathPrefix() string {
+	return l.signer.PathPrefix()
+}
+
+// now returns current time of l, which tests may shift.
+func (l *Local) now() time.Time {
+	return l.signer.now()
+}
+
+// PrepareBuckets implements ObjectStore.
+func (l *Local) PrepareBuckets(ctx context.Context, buckets ...string) error {
+	for _, b := range append(buckets, multipartBucket) {
+		if err := l.backend.makeBucket(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutObject implements ObjectStore.
+func (l *Local) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	if size >= 0 {
+		r = &exactReader{r: r, n: size}
+	}
+	h := md5.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+
+	var info ObjectInfo
+	err := l.backend.put(bucket, key, counter, func() ObjectInfo {
+		info = ObjectInfo{
+			Key:          key,
+			Size:         counter.n,
+			ETag:         hex.EncodeToString(h.Sum(nil)),
+			ContentType:  opts.ContentType,
+			LastModified: l.now().UTC(),
+		}
+		return info
+	})
+	return info, err
+}
+
+// GetObject implements ObjectStore.
+func (l *Local) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	_, rc, err := l.backend.get(bucket, key)
+	return rc, err
+}
+
+// rangeObject is a range of object content.
+type rangeObject struct {
+	io.Reader
+	io.Closer
+}
+
+// GetObjectRange implements ObjectStore.
+func (l *Local) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	_, rc, err := l.backend.get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := rc.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, rc, offset)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rangeObject{io.LimitReader(rc, length), rc}, nil
+}
+
+// StatObject implements ObjectStore.
+func (l *Local) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	return l.backend.stat(bucket, key)
+}
+
+// CopyObject implements ObjectStore.
+func (l *Local) CopyObject(ctx context.Context, bucket, dst, src string) (ObjectInfo, error) {
+	info, rc, err := l.backend.get(bucket, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer rc.Close()
+
+	return l.PutObject(ctx, bucket, dst, rc, info.Size, PutOptions{info.ContentType})
+}
+
+// RemoveObject implements ObjectStore.
+func (l *Local) RemoveObject(ctx context.Context, bucket, key string) error {
+	return l.backend.remove(bucket, key)
+}
+
+// RemovePrefix implements ObjectStore.
+func (l *Local) RemovePrefix(ctx context.Context, bucket, prefix string) error {
+	var keys []string
+	if err := l.backend.list(bucket, prefix, func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := l.backend.remove(bucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListObjects implements ObjectStore.
+func (l *Local) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	return l.backend.list(bucket, prefix, fn)
+}
+
+// PresignGet implements ObjectStore.
+func (l *Local) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	return l.signer.Sign("GET", bucket, key, expiry, query), nil
+}
+
+// PresignPart implements ObjectStore.
+func (l *Local) PresignPart(ctx context.Context, bucket, key, uploadID string, partNumber int, expiry time.Duration) (*url.URL, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	return l.signer.Sign("PUT", bucket, key, expiry, query), nil
+}
+
+// localPolicy is post policy of local backends encoded in form data.
+type localPolicy struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key,omitempty"`
+	KeyPrefix   string `json:"key_prefix,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	MinSize     int64  `json:"min_size"`
+	MaxSize     int64  `json:"max_size"`
+	Expires     int64  `json:"expires"`
+}
+
+// PresignPost implements ObjectStore.
+func (l *Local) PresignPost(ctx context.Context, p PostPolicy) (*url.URL, map[string]string, error) {
+	b, err := json.Marshal(localPolicy{
+		Bucket:      p.Bucket,
+		Key:         p.Key,
+		KeyPrefix:   p.KeyPrefix,
+		ContentType: p.ContentType,
+		MinSize:     p.MinSize,
+		MaxSize:     p.MaxSize,
+		Expires:     p.Expires.Unix(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := base64.StdEncoding.EncodeToString(b)
+
+	formData := map[string]string{
+		fieldPolicy:    policy,
+		fieldSignature: l.signer.sign("POST", p.Bucket, "", url.Values{fieldPolicy: {policy}}),
+	}
+	if p.Key != "" {
+		formData["key"] = p.Key
+	}
+	if p.ContentType != "" {
+		formData["Content-Type"] = p.ContentType
+	}
+
+	return l.signer.URL(p.Bucket, ""), formData, nil
+}
+
+// verifyPolicy returns post policy of a bucket in form data if its signature is valid.
+func (l *Local) verifyPolicy(bucket string, form map[string]string) (localPolicy, bool) {
+	policy := form[fieldPolicy]
+	want := l.signer.sign("POST", bucket, "", url.Values{fieldPolicy: {policy}})
+	if !hmac.Equal([]byte(want), []byte(form[fieldSignature])) {
+		return localPolicy{}, false
+	}
+	b, err := base64.StdEncoding.DecodeString(policy)
+	if err != nil {
+		return localPolicy{}, false
+	}
+	var p localPolicy
+	if err := json.Unmarshal(b, &p); err != nil || p.Bucket != bucket {
+		return localPolicy{}, false
+	}
+	return p, true
+}
+
+// multipartRecord is content of the object recording a multipart upload in multipartBucket.
+type multipartRecord struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Initiated   time.Time `json:"initiated"`
+}
+
+// partKey returns key of a part of a multipart upload in multipartBucket.
+func partKey(uploadID string, partNumber int) string {
+	// Zero padding keeps parts listed in order of part numbers.
+	return fmt.Sprintf("%s/%05d", uploadID, partNumber)
+}
+
+// NewMultipartUpload implements ObjectStore.
+func (l *Local) NewMultipartUpload(ctx context.Context, bucket, key string, opts PutOptions) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(b)
+
+	record, err := json.Marshal(multipartRecord{bucket, key, opts.ContentType, l.now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	if _, err := l.PutObject(ctx, multipartBucket, uploadID, bytes.NewReader(record), int64(len(record)), PutOptions{}); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// multipartRecord returns record of a multipart upload of object, or ErrUploadNotFound.
+func (l *Local) multipartRecord(bucket, key, uploadID string) (multipartRecord, error) {
+	var record multipartRecord
+	// Upload ids are hex, anything else would address parts of an upload.
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return record, ErrUploadNotFound
+	}
+	_, rc, err := l.backend.get(multipartBucket, uploadID)
+	if errors.Is(err, ErrObjectNotFound) {
+		return record, ErrUploadNotFound
+	}
+	if err != nil {
+		return record, err
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(rc).Decode(&record); err != nil {
+		return record, err
+	}
+	if record.Bucket != bucket || record.Key != key {
+		return record, ErrUploadNotFound
+	}
+	return record, nil
+}
+
+// PutPart implements ObjectStore.
+func (l *Local) PutPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader, size int64) (Part, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return Part{}, ErrInvalidPart
+	}
+	if _, err := l.multipartRecord(bucket, key, uploadID); err != nil {
+		return Part{}, err
+	}
+	info, err := l.PutObject(ctx, multipartBucket, partKey(uploadID, partNumber), r, size, PutOptions{})
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{partNumber, info.ETag}, nil
+}
+
+// ListParts implements ObjectStore.
+func (l *Local) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	if _, err := l.multipartRecord(bucket, key, uploadID); err != nil {
+		return nil, err
+	}
+	var parts []Part
+	err := l.backend.list(multipartBucket, uploadID+"/", func(info ObjectInfo) error {
+		n, err := strconv.Atoi(strings.TrimPrefix(info.Key, uploadID+"/"))
+		if err != nil {
+			return err
+		}
+		parts = append(parts, Part{n, info.ETag})
+		return nil
+	})
+	return parts, err
+}
+
+// CompleteMultipartUpload implements ObjectStore.
+// ETag of the assembled object is MD5 of part MD5s followed by part count, as S3 computes it.
+func (l *Local) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []Part) (ObjectInfo, error) {
+	record, err := l.multipartRecord(bucket, key, uploadID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	uploaded, err := l.ListParts(ctx, bucket, key, uploadID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	etags := make(map[int]string, len(uploaded))
+	for _, p := range uploaded {
+		etags[p.PartNumber] = p.ETag
+	}
+
+	if len(parts) == 0 || !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber }) {
+		return ObjectInfo{}, ErrInvalidPart
+	}
+	sums := md5.New()
+	for i, p := range parts {
+		etag := strings.Trim(p.ETag, `"`)
+		if etags[p.PartNumber] != etag || (i > 0 && parts[i-1].PartNumber == p.PartNumber) {
+			return ObjectInfo{}, ErrInvalidPart
+		}
+		sum, err := hex.DecodeString(etag)
+		if err != nil {
+			return ObjectInfo{}, ErrInvalidPart
+		}
+		sums.Write(sum)
+	}
+
+	r := &partsReader{backend: l.backend, uploadID: uploadID, parts: parts}
+	defer r.Close()
+	counter := &countingReader{r: r}
+
+	var info ObjectInfo
+	if err := l.backend.put(bucket, key, counter, func() ObjectInfo {
+		info = ObjectInfo{
+			Key:          key,
+			Size:         counter.n,
+			ETag:         fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(parts)),
+			ContentType:  record.ContentType,
+			LastModified: l.now().UTC(),
+		}
+		return info
+	}); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, l.discardMultipartUpload(uploadID)
+}
+
+// AbortMultipartUpload implements ObjectStore.
+func (l *Local) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	if _, err := l.multipartRecord(bucket, key, uploadID); err != nil {
+		return err
+	}
+	return l.discardMultipartUpload(uploadID)
+}
+
+// discardMultipartUpload removes parts and record of a multipart upload.
+func (l *Local) discardMultipartUpload(uploadID string) error {
+	if err := l.RemovePrefix(context.Background(), multipartBucket, uploadID+"/"); err != nil {
+		return err
+	}
+	return l.backend.remove(multipartBucket, uploadID)
+}
+
+// ListMultipartUploads implements ObjectStore.
+func (l *Local) ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error {
+	var uploadIDs []string
+	if err := l.backend.list(multipartBucket, "", func(info ObjectInfo) error {
+		if !strings.Contains(info.Key, "/") {
+			uploadIDs = append(uploadIDs, info.Key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range uploadIDs {
+		_, rc, err := l.backend.get(multipartBucket, id)
+		if errors.Is(err, ErrObjectNotFound) {
+			// Completed or aborted meanwhile.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var record multipartRecord
+		err = json.NewDecoder(rc).Decode(&record)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if record.Bucket != bucket {
+			continue
+		}
+		if err := fn(MultipartUpload{record.Key, id, record.Initiated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partsReader reads parts of a multipart upload one after another, opening each when it's reached.
+type partsReader struct {
+	backend  backend
+	uploadID string
+	parts    []Part
+	current  io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			_, rc, err := r.backend.get(multipartBucket, partKey(r.uploadID, r.parts[0].PartNumber))
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.parts = rc, r.parts[1:]
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exactReader reads exactly n bytes of r, or fails with errSizeMismatch.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		// Content longer than declared is a mismatch too.
+		var b [1]byte
+		if n, _ := e.r.Read(b[:]); n > 0 {
+			return 0, errSizeMismatch
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if errors.Is(err, io.EOF) && e.n > 0 {
+		return n, errSizeMismatch
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// ConfigureBuckets implements ObjectStore.
+// Local has no object lock, its lifecycle rules are applied by ApplyLifecycle.
+func (l *Local) ConfigureBuckets(ctx context.Context, configs ...BucketConfig) error {
+	for _, c := range configs {
+		if c.ObjectLock {
+			return fmt.Errorf("bucket %s: object lock: %w", c.Name, ErrNotSupported)
+		}
+		if err := l.backend.makeBucket(c.Name); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range configs {
+		l.lifecycle[c.Name] = c.Lifecycle
+	}
+	return nil
+}
+
+// ApplyLifecycle deletes expired objects and aborts stale incomplete multipart uploads under lifecycle rules.
+// Objects aren't versioned, so noncurrent expiration doesn't apply. It's meant to run periodically as a background job.
+func (l *Local) ApplyLifecycle(ctx context.Context) error {
+	l.mu.Lock()
+	buckets := make(map[string][]LifecycleRule, len(l.lifecycle))
+	for b, rules := range l.lifecycle {
+		buckets[b] = rules
+	}
+	l.mu.Unlock()
+
+	now := l.now()
+	for bucket, rules := range buckets {
+		for _, r := range rules {
+			if r.ExpirationDays > 0 {
+				if err := l.expireObjects(ctx, bucket, r.Prefix, now.AddDate(0, 0, -r.ExpirationDays)); err != nil {
+					return err
+				}
+			}
+			if r.AbortIncompleteUploadDays > 0 {
+				if err := l.abortUploads(ctx, bucket, r.Prefix, now.AddDate(0, 0, -r.AbortIncompleteUploadDays)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expireObjects removes objects under prefix last modified before.
+func (l *Local) expireObjects(ctx context.Context, bucket, prefix string, before time.Time) error {
+	var keys []string
+	if err := l.ListObjects(ctx, bucket, prefix, func(info ObjectInfo) error {
+		if info.LastModified.Before(before) {
+			keys = append(keys, info.Key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := l.RemoveObject(ctx, bucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortUploads aborts multipart uploads of objects under prefix initiated before.
+func (l *Local) abortUploads(ctx context.Context, bucket, prefix string, before time.Time) error {
+	var uploads []MultipartUpload
+	if err := l.ListMultipartUploads(ctx, bucket, func(u MultipartUpload) error {
+		if strings.HasPrefix(u.Key, prefix) && u.Initiated.Before(before) {
+			uploads = append(uploads, u)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		if err := l.AbortMultipartUpload(ctx, bucket, u.Key, u.UploadID); err != nil && !errors.Is(err, ErrUploadNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMemory returns a Local keeping objects in memory, they are lost once the process exits.
+// It's meant for tests and development.
+func NewMemory(ctx context.Context, config ConfigOptions) (*Local, error) {
+	return newLocal(&memoryBackend{buckets: make(map[string]map[string]memoryObject)}, config)
+}
+
+// memoryObject is an object kept in memory.
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+// memoryBackend keeps objects in maps of buckets.
+type memoryBackend struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]memoryObject
+}
+
+func (m *memoryBackend) makeBucket(bucket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.buckets[bucket]; !ok {
+		m.buckets[bucket] = make(map[string]memoryObject)
+	}
+	return nil
+}
+
+func (m *memoryBackend) put(bucket, key string, r io.Reader, info func() ObjectInfo) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	objects, ok := m.buckets[bucket]
+	if !ok {
+		return errBucketNotFound
+	}
+	objects[key] = memoryObject{info(), data}
+	return nil
+}
+
+// object returns an object, or ErrObjectNotFound.
+func (m *memoryBackend) object(bucket, key string) (memoryObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	objects, ok := m.buckets[bucket]
+	if !ok {
+		return memoryObject{}, errBucketNotFound
+	}
+	o, ok := objects[key]
+	if !ok {
+		return memoryObject{}, ErrObjectNotFound
+	}
+	return o, nil
+}
+
+func (m *memoryBackend) get(bucket, key string) (ObjectInfo, io.ReadCloser, error) {
+	o, err := m.object(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	// Object data is never modified in place, a put replaces it.
+	return o.info, ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *memoryBackend) stat(bucket, key string) (ObjectInfo, error) {
+	o, err := m.object(bucket, key)
+	return o.info, err
+}
+
+func (m *memoryBackend) remove(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	objects, ok := m.buckets[bucket]
+	if !ok {
+		return errBucketNotFound
+	}
+	delete(objects, key)
+	return nil
+}
+
+func (m *memoryBackend) list(bucket, prefix string, fn func(ObjectInfo) error) error {
+	m.mu.RLock()
+	objects, ok := m.buckets[bucket]
+	if !ok {
+		m.mu.RUnlock()
+		return errBucketNotFound
+	}
+	var infos []ObjectInfo
+	for k, o := range objects {
+		if strings.HasPrefix(k, prefix) {
+			infos = append(infos, o.info)
+		}
+	}
+	// fn may modify objects, so it's called without holding lock.
+	m.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/williamlsh/orchid/pkg/logging"
+	"go.uber.org/zap"
+)
+
+// maxListParts is the most parts S3 lists in a response.
+const maxListParts = 1000
+
+// Minio is an ObjectStore of an AWS S3 compatible MinIO service.
+type Minio struct {
+	client *minio.Client
+	logger *zap.SugaredLogger
+}
+
+// NewMinio returns a new Minio.
+func NewMinio(ctx context.Context, config ConfigOptions) (*Minio, error) {
+	logger := logging.FromContext(ctx)
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.ID, config.Secret, ""),
+		Secure: config.Secure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client.TraceErrorsOnlyOn(os.Stderr)
+
+	return &Minio{client, logger}, nil
+}
+
+// core returns a low level client sharing connection with m, e.g. for multipart uploads.
+func (m *Minio) core() minio.Core {
+	return minio.Core{Client: m.client}
+}
+
+// toError translates S3 error codes to errors of this package.
+func toError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey":
+		return ErrObjectNotFound
+	case "NoSuchUpload":
+		return ErrUploadNotFound
+	case "InvalidPart", "InvalidPartOrder":
+		return ErrInvalidPart
+	}
+	return err
+}
+
+// toObjectInfo converts object information of minio.
+func toObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
+
+// PrepareBuckets implements ObjectStore.
+func (m *Minio) PrepareBuckets(ctx context.Context, buckets ...string) error {
+	for _, b := range buckets {
+		ok, err := m.client.BucketExists(ctx, b)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := m.client.MakeBucket(ctx, b, minio.MakeBucketOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigureBuckets implements ObjectStore.
+func (m *Minio) ConfigureBuckets(ctx context.Context, configs ...BucketConfig) error {
+	for _, c := range configs {
+		if err := m.configureBucket(ctx, c); err != nil {
+			return fmt.Errorf("bucket %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// configureBucket is an helper for ConfigureBuckets.
+func (m *Minio) configureBucket(ctx context.Context, c BucketConfig) error {
+	ok, err := m.client.BucketExists(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := m.client.MakeBucket(ctx, c.Name, minio.MakeBucketOptions{ObjectLocking: c.ObjectLock}); err != nil {
+			return err
+		}
+	} else if c.ObjectLock {
+		enabled, _, _, _, err := m.client.GetObjectLockConfig(ctx, c.Name)
+		if err != nil || enabled != "Enabled" {
+			return errors.New("object lock can't be enabled on an existing bucket")
+		}
+	}
+
+	if c.ObjectLock {
+		// Nil mode, validity and unit remove default retention.
+		var (
+			mode     *minio.RetentionMode
+			validity *uint
+			unit     *minio.ValidityUnit
+		)
+		if c.Retention != nil {
+			retention, days, u := minio.RetentionMode(c.Retention.Mode), c.Retention.Days, minio.Days
+			mode, validity, unit = &retention, &days, &u
+		}
+		if err := m.client.SetObjectLockConfig(ctx, c.Name, mode, validity, unit); err != nil {
+			return err
+		}
+	}
+
+	config := lifecycle.NewConfiguration()
+	for _, r := range c.Lifecycle {
+		rule := lifecycle.Rule{
+			ID:         r.ID,
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: r.Prefix},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(r.ExpirationDays)},
+			NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
+				NoncurrentDays: lifecycle.ExpirationDays(r.NoncurrentExpirationDays),
+			},
+			AbortIncompleteMultipartUpload: lifecycle.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: lifecycle.ExpirationDays(r.AbortIncompleteUploadDays),
+			},
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+	// An empty configuration removes lifecycle rules.
+	return m.client.SetBucketLifecycle(ctx, c.Name, config)
+}
+
+// PutObject implements ObjectStore.
+func (m *Minio) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	info, err := m.client.PutObject(ctx, bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: opts.ContentType,
+	})
+	if err != nil {
+		return ObjectInfo{}, toError(err)
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  opts.ContentType,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+// GetObject implements ObjectStore.
+func (m *Minio) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	obj, err := m.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, toError(err)
+	}
+	return obj, nil
+}
+
+// GetObjectRange implements ObjectStore.
+func (m *Minio) GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	var opts minio.GetObjectOptions
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+	obj, err := m.client.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, toError(err)
+	}
+	return obj, nil
+}
+
+// StatObject implements ObjectStore.
+func (m *Minio) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, toError(err)
+	}
+	return toObjectInfo(info), nil
+}
+
+// CopyObject implements ObjectStore.
+func (m *Minio) CopyObject(ctx context.Context, bucket, dst, src string) (ObjectInfo, error) {
+	// ComposeObject copies objects larger than 5GiB too, which CopyObject can't.
+	info, err := m.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: bucket, Object: src},
+	)
+	if err != nil {
+		return ObjectInfo{}, toError(err)
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+// RemoveObject implements ObjectStore.
+func (m *Minio) RemoveObject(ctx context.Context, bucket, key string) error {
+	return m.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+// RemovePrefix implements ObjectStore.
+func (m *Minio) RemovePrefix(ctx context.Context, bucket, prefix string) error {
+	objectsCh := m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	// Drain all errors so that removing goroutine can exit, but report only the first one.
+	var firstErr error
+	for e := range m.client.RemoveObjects(ctx, bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if firstErr == nil {
+			firstErr = e.Err
+		}
+	}
+	return firstErr
+}
+
+// ListObjects implements ObjectStore.
+func (m *Minio) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	// Cancelling stops listing goroutine when fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(toObjectInfo(info)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignGet implements ObjectStore.
+func (m *Minio) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return m.client.PresignedGetObject(ctx, bucket, key, expiry, params)
+}
+
+// PresignPost implements ObjectStore.
+func (m *Minio) PresignPost(ctx context.Context, p PostPolicy) (*url.URL, map[string]string, error) {
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(p.Bucket); err != nil {
+		return nil, nil, err
+	}
+	if p.KeyPrefix != "" {
+		if err := policy.SetKeyStartsWith(p.KeyPrefix); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.Key != "" {
+		if err := policy.SetKey(p.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.ContentType != "" {
+		if err := policy.SetContentType(p.ContentType); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := policy.SetContentLengthRange(p.MinSize, p.MaxSize); err != nil {
+		return nil, nil, err
+	}
+	if err := policy.SetExpires(p.Expires.UTC()); err != nil {
+		return nil, nil, err
+	}
+	return m.client.PresignedPostPolicy(ctx, policy)
+}
+
+// PresignPart implements ObjectStore.
+func (m *Minio) PresignPart(ctx context.Context, bucket, key, uploadID string, partNumber int, expiry time.Duration) (*url.URL, error) {
+	reqParams := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	return m.client.Presign(ctx, http.MethodPut, bucket, key, expiry, reqParams)
+}
+
+// NewMultipartUpload implements ObjectStore.
+func (m *Minio) NewMultipartUpload(ctx context.Context, bucket, key string, opts PutOptions) (string, error) {
+	return m.core().NewMultipartUpload(ctx, bucket, key, minio.PutObjectOptions{
+		ContentType: opts.ContentType,
+	})
+}
+
+// PutPart implements ObjectStore.
+func (m *Minio) PutPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader, size int64) (Part, error) {
+	part, err := m.core().PutObjectPart(ctx, bucket, key, uploadID, partNumber, r, size, "", "", nil)
+	if err != nil {
+		return Part{}, toError(err)
+	}
+	return Part{part.PartNumber, part.ETag}, nil
+}
+
+// ListParts implements ObjectStore.
+func (m *Minio) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	var parts []Part
+	marker := 0
+	for {
+		result, err := m.core().ListObjectParts(ctx, bucket, key, uploadID, marker, maxListParts)
+		if err != nil {
+			return nil, toError(err)
+		}
+		for _, p := range result.ObjectParts {
+			parts = append(parts, Part{p.PartNumber, p.ETag})
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipartUpload implements ObjectStore.
+func (m *Minio) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []Part) (ObjectInfo, error) {
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, p := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+	etag, err := m.core().CompleteMultipartUpload(ctx, bucket, key, uploadID, completeParts, minio.PutObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, toError(err)
+	}
+	return ObjectInfo{Key: key, ETag: etag}, nil
+}
+
+// AbortMultipartUpload implements ObjectStore.
+func (m *Minio) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	return toError(m.core().AbortMultipartUpload(ctx, bucket, key, uploadID))
+}
+
+// ListMultipartUploads implements ObjectStore.
+func (m *Minio) ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range m.client.ListIncompleteUploads(ctx, bucket, "", true) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(MultipartUpload{info.Key, info.UploadID, info.Initiated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of urls signed by Signer.
+const (
+	paramExpires   = "X-Orchid-Expires"
+	paramSignature = "X-Orchid-Signature"
+)
+
+var (
+	// ErrSignatureMismatch indicates a signed url has been tampered with or signed by another secret.
+	ErrSignatureMismatch = errors.New("signature does not match")
+	// ErrRequestExpired indicates a signed url has expired.
+	ErrRequestExpired = errors.New("request has expired")
+)
+
+// Signer signs urls of objects under a public url with HMAC, the way S3 presigns urls.
+// The urls are served by orchid itself, e.g. by Local.
+type Signer struct {
+	publicURL *url.URL
+	secret    []byte
+	now       func() time.Time
+}
+
+// NewSigner returns a new Signer of urls under publicURL, which must be absolute.
+func NewSigner(publicURL string, secret []byte) (*Signer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("signing secret is empty")
+	}
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("public url isn't absolute: %s", publicURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Signer{u, secret, time.Now}, nil
+}
+
+// PathPrefix returns url path of signed urls.
+func (s *Signer) PathPrefix() string {
+	return s.publicURL.Path + "/"
+}
+
+// URL returns unsigned url of an object, key is empty for a bucket.
+func (s *Signer) URL(bucket, key string) *url.URL {
+	u := *s.publicURL
+	u.Path = s.PathPrefix() + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	return &u
+}
+
+// SplitPath returns bucket and object key of an url path under PathPrefix, key is empty for a bucket.
+func (s *Signer) SplitPath(path string) (bucket, key string, ok bool) {
+	rest := strings.TrimPrefix(path, s.PathPrefix())
+	if rest == path {
+		return "", "", false
+	}
+	bucket, key = rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		bucket, key = rest[:i], rest[i+1:]
+	}
+	if bucket == "" || strings.HasPrefix(bucket, ".") {
+		return "", "", false
+	}
+	return bucket, key, true
+}
+
+// Sign returns an url of object signed for method and query until expiry.
+func (s *Signer) Sign(method, bucket, key string, expiry time.Duration, query url.Values) *url.URL {
+	query.Set(paramExpires, strconv.FormatInt(s.now().Add(expiry).Unix(), 10))
+	query.Set(paramSignature, s.sign(method, bucket, key, query))
+
+	u := s.URL(bucket, key)
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// Verify checks that query of request r to object carries a valid unexpired signature.
+func (s *Signer) Verify(r *http.Request, bucket, key string) error {
+	query := r.URL.Query()
+	want := s.sign(r.Method, bucket, key, query)
+	if !hmac.Equal([]byte(want), []byte(query.Get(paramSignature))) {
+		return ErrSignatureMismatch
+	}
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil || s.now().Unix() > expires {
+		return ErrRequestExpired
+	}
+	return nil
+}
+
+// sign returns HMAC of a request of method to object with query, ignoring signature in query.
+func (s *Signer) sign(method, bucket, key string, query url.Values) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != paramSignature {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, bucket, key, signed.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
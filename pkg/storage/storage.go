@@ -1,59 +1,149 @@
+// Package storage stores objects in buckets of MinIO, a local filesystem or memory.
 package storage
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Storage backends.
+const (
+	BackendMinio      = "minio"
+	BackendFilesystem = "filesystem"
+	BackendMemory     = "memory"
+)
 
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/williamlsh/orchid/pkg/logging"
-	"go.uber.org/zap"
+var (
+	// ErrObjectNotFound indicates an object doesn't exist.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrUploadNotFound indicates a multipart upload doesn't exist, e.g. it's completed or aborted.
+	ErrUploadNotFound = errors.New("multipart upload not found")
+	// ErrInvalidPart indicates a part to complete a multipart upload with is missing or its ETag doesn't match.
+	ErrInvalidPart = errors.New("invalid multipart upload part")
 )
 
-// ConfigOptions is configurate options for Minio.
+// ConfigOptions is configurate options for storage.
 type ConfigOptions struct {
+	Backend string
+
+	// Options of MinIO backend.
 	Endpoint string
 	ID       string
 	Secret   string
 	Secure   bool
+
+	// Options of local backends, i.e. filesystem and memory.
+	// Root is directory of filesystem backend. Presigned urls of local backends point to PublicURL
+	// where orchid serves them, they are signed with SigningSecret.
+	Root          string
+	PublicURL     string
+	SigningSecret string
 }
 
-// S3Client is a AWS S3 compatible Minio client.
-type S3Client struct {
-	*minio.Client
-	logger *zap.SugaredLogger
+// ObjectInfo is information of a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
 }
 
-// New returns a new S3Client.
-func New(ctx context.Context, config ConfigOptions) S3Client {
-	logger := logging.FromContext(ctx)
+// PutOptions are options of putting an object.
+type PutOptions struct {
+	ContentType string
+}
 
-	s3Client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.ID, config.Secret, ""),
-		Secure: config.Secure,
-	})
-	if err != nil {
-		panic(err)
-	}
+// Part is a part of a multipart upload. Its fields are named as minio.CompletePart,
+// so that both encode to the same JSON.
+type Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// MultipartUpload is an incomplete multipart upload.
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// PostPolicy constrains an object uploaded through a presigned HTTP multipart form post.
+type PostPolicy struct {
+	Bucket      string
+	Key         string
+	KeyPrefix   string
+	ContentType string
+	MinSize     int64
+	MaxSize     int64
+	Expires     time.Time
+}
+
+// ObjectStore stores objects in buckets.
+// Keys are S3 object keys, so that "a/b" and "a" may exist at the same time.
+type ObjectStore interface {
+	// PrepareBuckets creates buckets which don't exist yet.
+	PrepareBuckets(ctx context.Context, buckets ...string) error
+	// ConfigureBuckets creates buckets which don't exist yet and applies their configurations.
+	// Buckets with object lock must be configured before they're prepared, since it's only enabled at creation.
+	ConfigureBuckets(ctx context.Context, configs ...BucketConfig) error
+
+	// PutObject stores an object of size read from r, size -1 means unknown.
+	PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error)
+	// GetObject returns a reader of object content. ErrObjectNotFound may not be returned until the first read.
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// GetObjectRange returns a reader of length bytes of object content from offset, length must be positive.
+	// The range must be within object content.
+	GetObjectRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+	// StatObject returns object information, or ErrObjectNotFound.
+	StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error)
+	// CopyObject copies object src to dst in the same bucket.
+	CopyObject(ctx context.Context, bucket, dst, src string) (ObjectInfo, error)
+	// RemoveObject removes an object, removing a missing object isn't an error.
+	RemoveObject(ctx context.Context, bucket, key string) error
+	// RemovePrefix removes all objects whose keys start with prefix.
+	RemovePrefix(ctx context.Context, bucket, prefix string) error
+	// ListObjects calls fn with every object whose key starts with prefix in order of keys.
+	// Listing stops at the first error returned by fn.
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error
 
-	s3Client.TraceErrorsOnlyOn(os.Stderr)
+	// PresignGet returns an url downloading an object until expiry,
+	// params are response header overrides such as response-content-disposition.
+	PresignGet(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error)
+	// PresignPost returns an url and form data of an HTTP multipart form post uploading an object under policy.
+	PresignPost(ctx context.Context, policy PostPolicy) (*url.URL, map[string]string, error)
+	// PresignPart returns an url of HTTP PUT uploading a part of a multipart upload until expiry.
+	PresignPart(ctx context.Context, bucket, key, uploadID string, partNumber int, expiry time.Duration) (*url.URL, error)
 
-	return S3Client{s3Client, logger}
+	// NewMultipartUpload initiates a multipart upload and returns its id.
+	NewMultipartUpload(ctx context.Context, bucket, key string, opts PutOptions) (string, error)
+	// PutPart uploads a part of a multipart upload.
+	PutPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader, size int64) (Part, error)
+	// ListParts returns uploaded parts of a multipart upload in order of part numbers.
+	ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error)
+	// CompleteMultipartUpload assembles an object of parts in order, or returns ErrInvalidPart.
+	CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []Part) (ObjectInfo, error)
+	// AbortMultipartUpload discards a multipart upload and its parts, or returns ErrUploadNotFound.
+	AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error
+	// ListMultipartUploads calls fn with every incomplete multipart upload in bucket.
+	// Listing stops at the first error returned by fn.
+	ListMultipartUploads(ctx context.Context, bucket string, fn func(MultipartUpload) error) error
 }
 
-// PrepareBuckets prepares buckets before object operations.
-func (c S3Client) PrepareBuckets(ctx context.Context, buckets ...string) error {
-	for _, b := range buckets {
-		ok, err := c.BucketExists(context.Background(), b)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			// TODO: consider to enable object lock.
-			if err := c.MakeBucket(ctx, b, minio.MakeBucketOptions{}); err != nil {
-				return err
-			}
-		}
+// New returns an ObjectStore of backend in config.
+func New(ctx context.Context, config ConfigOptions) (ObjectStore, error) {
+	switch config.Backend {
+	case BackendMinio:
+		return NewMinio(ctx, config)
+	case BackendFilesystem:
+		return NewFilesystem(ctx, config)
+	case BackendMemory:
+		return NewMemory(ctx, config)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
 	}
-	return nil
 }
@@ -20,11 +20,12 @@ import (
 // Server implements jaeger-demo-frontend service
 type Server struct {
 	ConfigOptions
-	logger  *zap.SugaredLogger
-	tracer  opentracing.Tracer
-	cache   cache.Cache
-	db      database.Database
-	storage storage.S3Client
+	logger    *zap.SugaredLogger
+	tracer    opentracing.Tracer
+	cache     cache.Cache
+	db        database.Database
+	storage   storage.ObjectStore
+	encryptor *upload.Encryptor
 }
 
 // ConfigOptions provides all config options frontend service needs.
@@ -32,6 +33,8 @@ type ConfigOptions struct {
 	FrontendHostPort string
 	AuthSecrets      auth.ConfigOptions
 	Email            email.ConfigOptions
+	Users            users.ConfigOptions
+	Upload           upload.ConfigOptions
 }
 
 // NewServer creates a new frontend.Server
@@ -40,7 +43,8 @@ func NewServer(
 	tracer opentracing.Tracer,
 	cache cache.Cache,
 	db database.Database,
-	storage storage.S3Client,
+	storage storage.ObjectStore,
+	encryptor *upload.Encryptor,
 	config ConfigOptions,
 ) *Server {
 	return &Server{
@@ -50,6 +54,7 @@ func NewServer(
 		cache,
 		db,
 		storage,
+		encryptor,
 	}
 }
 
@@ -72,11 +77,36 @@ func (s *Server) createServeMux() http.Handler {
 
 	// Routers of users. They are under /api/user
 	userRouter := sr.PathPrefix("/user").Subrouter()
-	users.Group(s.logger, s.cache, s.db, s.Email, s.AuthSecrets, userRouter)
+	users.Group(s.logger, s.cache, s.db, s.encryptor, s.Email, s.Users, s.AuthSecrets, userRouter)
+
+	// Routers of users' public data. They are under /api/users
+	usersRouter := sr.PathPrefix("/users").Subrouter()
+	users.PublicGroup(s.logger, s.cache, s.db, s.Users, s.AuthSecrets, usersRouter)
 
 	// Routers of upload. They are under /api/upload
 	uploadRouter := sr.PathPrefix("/upload").Subrouter()
-	upload.Group(s.logger, s.cache, s.storage, s.AuthSecrets, uploadRouter)
+	upload.Group(s.logger, s.cache, s.db, s.storage, s.encryptor, s.Upload, s.AuthSecrets, uploadRouter)
+
+	// Routers of user's files. They are under /api/files
+	filesRouter := sr.PathPrefix("/files").Subrouter()
+	upload.FilesGroup(s.logger, s.cache, s.db, s.storage, s.encryptor, s.Upload, s.AuthSecrets, filesRouter)
+
+	// Routers of file share links. They are under /api/shares
+	sharesRouter := sr.PathPrefix("/shares").Subrouter()
+	upload.SharesGroup(s.logger, s.cache, s.db, s.storage, s.encryptor, s.Upload, s.AuthSecrets, sharesRouter)
+
+	// Routers of storage bucket notifications. They are under /internal/storage
+	storageRouter := r.PathPrefix("/internal/storage").Subrouter()
+	upload.NotificationsGroup(s.logger, s.cache, s.db, s.storage, s.encryptor, s.Upload, storageRouter)
+
+	// Presigned urls of local storage backends are served by frontend itself.
+	if local, ok := s.storage.(*storage.Local); ok {
+		r.PathPrefix(local.PathPrefix()).Handler(local)
+	}
+	// So are urls of encrypted content, which is decrypted on the way.
+	if s.encryptor.Enabled() {
+		r.PathPrefix(s.encryptor.PathPrefix()).Handler(s.encryptor)
+	}
 
 	// Opentracing for mux.
 	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {